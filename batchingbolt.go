@@ -0,0 +1,114 @@
+//   Copyright 2013 Vastech SA (PTY) LTD
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package gostorm
+
+import (
+	"fmt"
+	"github.com/jsgilmore/gostorm/core"
+	stormmsg "github.com/jsgilmore/gostorm/messages"
+)
+
+// BatchFlusher processes batches of tuples that are accumulated by a
+// batching bolt. Flush is called with every batch, along with an
+// emitter that anchors emissions to all the tuples of the batch. If
+// Flush returns an error, all the tuples of the batch are failed,
+// otherwise they are acked.
+type BatchFlusher interface {
+	FieldsFactory
+	Flush(batch []*core.Tuple, emitter BatchEmitter) error
+}
+
+// BatchEmitter emits tuples that are anchored to all the tuples of a
+// batch
+type BatchEmitter interface {
+	Emit(stream string, fields ...interface{}) (taskIds []int32)
+}
+
+// NewBatchingBolt returns a bolt that accumulates the tuples it
+// receives and passes them to the flusher when the batch reaches the
+// given size or when a tick tuple is received. A size of zero means
+// that batches are only flushed on tick tuples. A batch that is pending
+// when the bolt is cleaned up is dropped, since the stream to Storm has
+// been closed by then. Its tuples are neither acked nor failed, so
+// Storm replays them once they time out.
+func NewBatchingBolt(flusher BatchFlusher, size int) TickBolt {
+	return &batchingBoltImpl{
+		flusher: flusher,
+		size:    size,
+	}
+}
+
+type batchingBoltImpl struct {
+	flusher   BatchFlusher
+	size      int
+	collector OutputCollector
+	batch     []*core.Tuple
+	anchors   core.AnchorSet
+}
+
+func (this *batchingBoltImpl) Fields() []interface{} {
+	return this.flusher.Fields()
+}
+
+func (this *batchingBoltImpl) Prepare(context *stormmsg.Context, collector OutputCollector) {
+	this.collector = collector
+}
+
+func (this *batchingBoltImpl) Execute(meta stormmsg.BoltMsgMeta, fields ...interface{}) {
+	tuple := &core.Tuple{
+		Meta:   meta,
+		Fields: fields,
+	}
+	this.batch = append(this.batch, tuple)
+	this.anchors.Add(tuple)
+	if this.size > 0 && len(this.batch) >= this.size {
+		this.flush()
+	}
+}
+
+func (this *batchingBoltImpl) Tick(meta stormmsg.BoltMsgMeta) {
+	this.flush()
+}
+
+// Cleanup drops the pending batch, since the stream to Storm has been
+// closed and the batch can no longer be emitted, acked or failed
+func (this *batchingBoltImpl) Cleanup() {
+	this.batch = nil
+	this.anchors.Reset()
+}
+
+// Emit emits a tuple anchored to all the tuples in the current batch
+func (this *batchingBoltImpl) Emit(stream string, fields ...interface{}) (taskIds []int32) {
+	return this.collector.Emit(this.anchors.Ids(), stream, fields...)
+}
+
+func (this *batchingBoltImpl) flush() {
+	if len(this.batch) == 0 {
+		return
+	}
+	err := this.flusher.Flush(this.batch, this)
+	for _, tuple := range this.batch {
+		if err != nil {
+			this.collector.SendFail(tuple.Meta.Id)
+		} else {
+			this.collector.SendAck(tuple.Meta.Id)
+		}
+	}
+	if err != nil {
+		this.collector.Log(fmt.Sprintf("Failed batch of %d tuples: %v", len(this.batch), err))
+	}
+	this.batch = nil
+	this.anchors.Reset()
+}
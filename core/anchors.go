@@ -0,0 +1,166 @@
+//   Copyright 2013 Vastech SA (PTY) LTD
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package core
+
+import (
+	"fmt"
+)
+
+// AnchorSet accumulates the ids of the tuples that an emission should
+// be anchored to, such as all the tuples that were aggregated into a
+// single result. Ids are only added once and keep the order in which
+// they were first added. The zero value is an empty anchor set.
+type AnchorSet struct {
+	ids  []string
+	seen map[string]bool
+}
+
+// Add adds the id of the given tuple to the anchor set
+func (this *AnchorSet) Add(tuple *Tuple) {
+	this.AddId(tuple.Meta.Id)
+}
+
+// AddId adds a tuple id to the anchor set
+func (this *AnchorSet) AddId(id string) {
+	if this.seen == nil {
+		this.seen = make(map[string]bool)
+	}
+	if this.seen[id] {
+		return
+	}
+	this.seen[id] = true
+	this.ids = append(this.ids, id)
+}
+
+// Ids returns the ids in the anchor set, which can be passed as the
+// anchors of an emission
+func (this *AnchorSet) Ids() []string {
+	return this.ids
+}
+
+// Len returns the number of ids in the anchor set
+func (this *AnchorSet) Len() int {
+	return len(this.ids)
+}
+
+// Reset removes all ids from the anchor set, so that it can be reused
+// for the next window
+func (this *AnchorSet) Reset() {
+	this.ids = nil
+	this.seen = nil
+}
+
+// AnchorWindow is a bounded variant of AnchorSet that keeps the ids of
+// the most recent tuples that were added to it, such as the last tuples
+// of a streaming join. Once the window is full, adding an id evicts the
+// oldest id, which is returned so that its tuple can be acked.
+//
+// Storm ignores anchors to tuples that have already been acked or
+// failed, so the tuples in the window should only be acked once they
+// have been evicted.
+type AnchorWindow struct {
+	ids   []string
+	start int
+	count int
+}
+
+// NewAnchorWindow returns an empty anchor window that keeps the ids of
+// the given number of tuples. The size has to be at least one.
+func NewAnchorWindow(size int) (*AnchorWindow, error) {
+	if size < 1 {
+		return nil, fmt.Errorf("Anchor window size %d is smaller than one", size)
+	}
+	return &AnchorWindow{ids: make([]string, size)}, nil
+}
+
+// Add adds the id of the given tuple to the anchor window, as AddId does
+func (this *AnchorWindow) Add(tuple *Tuple) (evicted string, ok bool) {
+	return this.AddId(tuple.Meta.Id)
+}
+
+// AddId adds a tuple id to the anchor window. If the window was full,
+// the oldest id is evicted and returned with ok set to true.
+func (this *AnchorWindow) AddId(id string) (evicted string, ok bool) {
+	if this.count < len(this.ids) {
+		this.ids[(this.start+this.count)%len(this.ids)] = id
+		this.count++
+		return "", false
+	}
+	evicted = this.ids[this.start]
+	this.ids[this.start] = id
+	this.start = (this.start + 1) % len(this.ids)
+	return evicted, true
+}
+
+// Ids returns the ids in the anchor window from the oldest to the most
+// recent, which can be passed as the anchors of an emission. Ids that
+// were added more than once are only returned once.
+func (this *AnchorWindow) Ids() []string {
+	ids := make([]string, 0, this.count)
+	seen := make(map[string]bool, this.count)
+	for i := 0; i < this.count; i++ {
+		id := this.ids[(this.start+i)%len(this.ids)]
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// Len returns the number of ids in the anchor window
+func (this *AnchorWindow) Len() int {
+	return this.count
+}
+
+// Size returns the maximum number of ids in the anchor window
+func (this *AnchorWindow) Size() int {
+	return len(this.ids)
+}
+
+// SetSize changes the maximum number of ids in the anchor window. If the
+// window holds more ids than the new size, the oldest ids are evicted
+// and returned. The size has to be at least one.
+func (this *AnchorWindow) SetSize(size int) (evicted []string, err error) {
+	if size < 1 {
+		return nil, fmt.Errorf("Anchor window size %d is smaller than one", size)
+	}
+	drop := 0
+	if this.count > size {
+		drop = this.count - size
+	}
+	ids := make([]string, size)
+	for i := 0; i < this.count; i++ {
+		id := this.ids[(this.start+i)%len(this.ids)]
+		if i < drop {
+			evicted = append(evicted, id)
+		} else {
+			ids[i-drop] = id
+		}
+	}
+	this.count -= drop
+	this.ids = ids
+	this.start = 0
+	return evicted, nil
+}
+
+// Reset removes all ids from the anchor window, without changing its size
+func (this *AnchorWindow) Reset() {
+	for i := range this.ids {
+		this.ids[i] = ""
+	}
+	this.start = 0
+	this.count = 0
+}
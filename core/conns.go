@@ -12,18 +12,35 @@
 //   See the License for the specific language governing permissions and
 //   limitations under the License.
 
+// Package core implements the Storm multilang protocol for bolts and
+// spouts on top of the inputs and outputs of an encoding.
+//
+// BoltConn, SpoutConn, Input and Output only hold the functions that
+// every implementation needs. Features that were added later are
+// described by small optional interfaces, such as MessageSizeLimiter or
+// CheckedOutput, so that adding a feature never breaks an existing
+// implementation. The connections, inputs and outputs of this package
+// implement those that they support, which can be checked with a type
+// assertion.
 package core
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/jsgilmore/gostorm/messages"
+	"io"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
-// BoltConn is the interface that implements the possible bolt actions
+// BoltConn is the interface that implements the possible bolt actions.
+// The connections returned by NewBoltConn are closed through io.Closer.
 type BoltConn interface {
 	Connect()
 	Context() *messages.Context
@@ -36,7 +53,21 @@ type BoltConn interface {
 	EmitDirect(anchors []string, stream string, directTask int64, contents ...interface{})
 }
 
-// SpoutConn is the interface that implements the possible spout actions
+// The commands that a spout can receive from Storm, as returned by
+// ReadSpoutMsg. The ack and fail commands are accompanied by the id of
+// the acked or failed tuple. Storm versions that support it send the
+// activate and deactivate commands when the topology is activated or
+// deactivated, and expect a sync in reply, like for the other commands.
+const (
+	CommandNext       = "next"
+	CommandAck        = "ack"
+	CommandFail       = "fail"
+	CommandActivate   = "activate"
+	CommandDeactivate = "deactivate"
+)
+
+// SpoutConn is the interface that implements the possible spout actions.
+// The connections returned by NewSpoutConn are closed through io.Closer.
 type SpoutConn interface {
 	Connect()
 	Context() *messages.Context
@@ -54,6 +85,7 @@ func newStormConn(in Input, out Output, needTaskIds bool) *stormConnImpl {
 		Input:       in,
 		Output:      out,
 		needTaskIds: needTaskIds,
+		stats:       newStats(),
 	}
 	return stormConn
 }
@@ -62,8 +94,118 @@ func newStormConn(in Input, out Output, needTaskIds bool) *stormConnImpl {
 type stormConnImpl struct {
 	Input
 	Output
-	context     *messages.Context
-	needTaskIds bool
+	context           *messages.Context
+	needTaskIds       bool
+	rejectEmptyTuples bool
+	zeroTasks         func(stream string, contents []interface{})
+	outputFields      map[string][]string
+	directStreams     map[string]bool
+	pidFile           string
+	closed            bool
+	stats             *stats
+	marshalHook       func(content interface{}) interface{}
+	maxFieldSize      int
+	maxFieldSizes     map[int]int
+	initialised       func(context *messages.Context)
+	pid               int
+	pidDir            string
+	pidFileContents   bool
+	hooks             Hooks
+	trace             *Trace
+	testMode          bool
+	testTaskIds       []int32
+	taskIdsTimeout    time.Duration
+	// readErr is the error that every read returns once reading task
+	// ids has timed out, since the reply may still arrive afterwards
+	readErr error
+	// interrupter is the reader of the input, if it can be ended
+	// deliberately part way through a message
+	interrupter Interrupter
+	// outputLock serialises the messages written to the output, since
+	// metrics may be reported from another goroutine
+	outputLock sync.Mutex
+	metrics    metricsLoop
+}
+
+// SendMsg sends a message to Storm while holding the output lock
+func (this *stormConnImpl) SendMsg(msg interface{}) {
+	this.outputLock.Lock()
+	defer this.outputLock.Unlock()
+	this.Output.SendMsg(msg)
+}
+
+// EmitGeneric sends a shell message to Storm while holding the output
+// lock
+func (this *stormConnImpl) EmitGeneric(command, id, stream, msg string, anchors []string, directTask int64, needTaskIds bool, contents ...interface{}) {
+	this.outputLock.Lock()
+	defer this.outputLock.Unlock()
+	this.Output.EmitGeneric(command, id, stream, msg, anchors, directTask, needTaskIds, contents...)
+}
+
+// tryEmitGeneric sends a shell message to Storm while holding the output
+// lock, like EmitGeneric. An error is returned, and nothing is sent, if
+// the output implements CheckedOutput and cannot encode the contents.
+// Other outputs panic instead, as they do for EmitGeneric.
+func (this *stormConnImpl) tryEmitGeneric(command, id, stream, msg string, anchors []string, directTask int64, needTaskIds bool, contents ...interface{}) error {
+	this.outputLock.Lock()
+	defer this.outputLock.Unlock()
+	if checked, ok := this.Output.(CheckedOutput); ok {
+		return checked.TryEmitGeneric(command, id, stream, msg, anchors, directTask, needTaskIds, contents...)
+	}
+	this.Output.EmitGeneric(command, id, stream, msg, anchors, directTask, needTaskIds, contents...)
+	return nil
+}
+
+// Flush flushes the messages sent to Storm while holding the output lock
+func (this *stormConnImpl) Flush() {
+	this.outputLock.Lock()
+	defer this.outputLock.Unlock()
+	this.Output.Flush()
+}
+
+// The read functions of the Input are shadowed to flush the output
+// before every read that may block. Storm may wait for messages that are
+// still buffered, such as an emission of which the task ids are about to
+// be read, before sending what is read next, so reading without flushing
+// could deadlock. All reads from Storm go through these functions,
+// except for task ids read by readTaskIdsWithin, which flushes too.
+
+// ReadMsg flushes the output and reads a message from Storm
+func (this *stormConnImpl) ReadMsg(msg interface{}) (err error) {
+	if this.readErr != nil {
+		return this.readErr
+	}
+	this.Flush()
+	return this.interruptedEOF(this.Input.ReadMsg(msg))
+}
+
+// interruptedEOF reports a message that was cut off because the input
+// was ended deliberately as the end of the input, so that the component
+// shuts down as it does when Storm closes the stream
+func (this *stormConnImpl) interruptedEOF(err error) error {
+	if err == io.ErrUnexpectedEOF && this.interrupter != nil && this.interrupter.Interrupted() {
+		return io.EOF
+	}
+	return err
+}
+
+// ReadTaskIds flushes the output and reads the task ids of an emission
+// from Storm
+func (this *stormConnImpl) ReadTaskIds() (taskIds []int32) {
+	if this.readErr != nil {
+		panic(this.readErr)
+	}
+	this.Flush()
+	return this.Input.ReadTaskIds()
+}
+
+// ReadBoltMsg flushes the output and reads a tuple from Storm
+func (this *stormConnImpl) ReadBoltMsg(meta *messages.BoltMsgMeta, contentStructs ...interface{}) (err error) {
+	if this.readErr != nil {
+		return this.readErr
+	}
+	this.Flush()
+	return this.interruptedEOF(this.Input.ReadBoltMsg(meta, contentStructs...))
 }
 
 func (this *stormConnImpl) readContext() (context *messages.Context, err error) {
@@ -72,22 +214,42 @@ func (this *stormConnImpl) readContext() (context *messages.Context, err error)
 	if err != nil {
 		return nil, err
 	}
+	if context.Topology == nil {
+		return nil, errors.New("Handshake from Storm does not contain the topology context")
+	}
 	return context, nil
 }
 
 func (this *stormConnImpl) reportPid() {
+	pid := this.pid
+	if pid == 0 {
+		pid = os.Getpid()
+	}
 	// Send the pid to Storm
 	msg := &messages.Pid{
-		Pid: int32(os.Getpid()),
+		Pid: int32(pid),
 	}
 	this.SendMsg(msg)
 	this.Flush()
 
-	// Write an empty file with the pid, which storm can use to kill our process
-	pidFile, err := os.Create(filepath.Join(this.Context().PidDir, strconv.Itoa(os.Getpid())))
+	pidDir := this.pidDir
+	if pidDir == "" {
+		pidDir = this.Context().PidDir
+	}
+	// Write a file named by the pid, which storm can use to kill our
+	// process. The file is empty, unless the pid has to be written to it.
+	this.pidFile = filepath.Join(pidDir, strconv.Itoa(pid))
+	pidFile, err := os.Create(this.pidFile)
 	if err != nil {
 		panic(err)
 	}
+	if this.pidFileContents {
+		_, err = pidFile.WriteString(strconv.Itoa(pid))
+		if err != nil {
+			pidFile.Close()
+			panic(err)
+		}
+	}
 	err = pidFile.Close()
 	if err != nil {
 		panic(err)
@@ -105,12 +267,469 @@ func (this *stormConnImpl) Connect() {
 		panic(fmt.Sprintf("Storm failed to initialise: %v", err))
 	}
 	this.reportPid()
+	if this.initialised != nil {
+		this.initialised(this.context)
+	}
+}
+
+// PidConfigurer is implemented by connections that can configure the pid that is
+// reported to Storm and the pid file
+type PidConfigurer interface {
+	SetPid(pid int)
+	SetPidDir(dir string)
+	SetPidFileContents(enabled bool)
+	PidDir() string
+}
+
+// SetPid sets the pid that is reported to Storm and used to name the
+// pid file, instead of the pid of the process. This allows the
+// handshake to be tested deterministically and multiple connections to
+// be run in one process. It has to be called before Connect.
+func (this *stormConnImpl) SetPid(pid int) {
+	this.pid = pid
+}
+
+// SetPidDir sets the directory in which the pid file is created,
+// instead of the directory provided by Storm. It has to be called
+// before Connect.
+func (this *stormConnImpl) SetPidDir(dir string) {
+	this.pidDir = dir
+}
+
+// SetPidFileContents sets whether the pid is written into the pid
+// file. By default the pid file is empty and only its name holds the
+// pid. It has to be called before Connect.
+func (this *stormConnImpl) SetPidFileContents(enabled bool) {
+	this.pidFileContents = enabled
+}
+
+// SetMaxMessageSize sets the maximum size in bytes of a message read
+// from Storm. Reading a larger message returns ErrMessageTooLarge
+// instead of buffering the message, which protects the process against
+// running out of memory if a component sends a pathologically large
+// tuple or the stream loses sync. A size of zero, which is the default,
+// means that messages are unlimited. It panics if the input does not
+// support a maximum message size.
+func (this *stormConnImpl) SetMaxMessageSize(n int) {
+	limiter, ok := this.Input.(MessageSizeLimiter)
+	if !ok {
+		panic(fmt.Sprintf("Input %T does not support a maximum message size", this.Input))
+	}
+	limiter.SetMaxMessageSize(n)
+}
+
+// SetAutoResync sets whether the connection skips malformed messages
+// from Storm and carries on reading after the next message boundary,
+// instead of returning an error, as described at Resyncer. Every
+// skipped frame is logged. It is disabled by default, since the skipped
+// messages are lost. It panics if the input does not support resyncing.
+func (this *stormConnImpl) SetAutoResync(enabled bool) {
+	resyncer, ok := this.Input.(Resyncer)
+	if !ok {
+		panic(fmt.Sprintf("Input %T does not support resyncing", this.Input))
+	}
+	resyncer.SetAutoResync(enabled)
+}
+
+// TraceRecorder is implemented by connections that can trace or record the frames
+// exchanged with Storm
+type TraceRecorder interface {
+	SetTrace(writer io.Writer)
+	SetRecordTo(writer io.Writer)
+}
+
+// SetTrace writes every frame that is read from or sent to Storm to the
+// given writer, in the format described by Trace. The trace can be used
+// to debug the protocol or, with NewReplayReader, to replay the input
+// of a session. It has to be called before Connect to include the
+// handshake. It panics if the input or output does not support tracing.
+func (this *stormConnImpl) SetTrace(writer io.Writer) {
+	this.installTrace(true).SetWriter(writer)
+}
+
+// SetRecordTo writes every frame that is read from Storm to the given
+// writer, exactly as it appeared on the wire. The recording can be used
+// as the input of a connection to replay the session, for instance to
+// reproduce a problem seen in production. It has to be called before
+// Connect to include the handshake. It panics if the input does not
+// support tracing.
+func (this *stormConnImpl) SetRecordTo(writer io.Writer) {
+	this.installTrace(false).SetRecorder(writer)
+}
+
+// Sync flushes the messages sent to Storm and, if the output writes to a
+// file, commits them to stable storage, so that another process can read
+// them from disk. For other writers, Sync only flushes. Connections
+// implement Syncer, which can be checked with a type assertion.
+func (this *stormConnImpl) Sync() error {
+	this.outputLock.Lock()
+	defer this.outputLock.Unlock()
+	if syncer, ok := this.Output.(Syncer); ok {
+		return syncer.Sync()
+	}
+	this.Output.Flush()
+	return nil
+}
+
+// installTrace sets the trace of the connection on its input and, if
+// output is true, its output, and returns the trace
+func (this *stormConnImpl) installTrace(output bool) *Trace {
+	if this.trace == nil {
+		this.trace = &Trace{}
+	}
+	input, ok := this.Input.(Tracer)
+	if !ok {
+		panic(fmt.Sprintf("Input %T does not support tracing", this.Input))
+	}
+	input.SetTrace(this.trace)
+	if output {
+		tracer, ok := this.Output.(Tracer)
+		if !ok {
+			panic(fmt.Sprintf("Output %T does not support tracing", this.Output))
+		}
+		tracer.SetTrace(this.trace)
+	}
+	return this.trace
+}
+
+// InitialisedNotifier is implemented by connections that call a handler once the
+// handshake with Storm has completed
+type InitialisedNotifier interface {
+	OnInitialised(handler func(context *messages.Context))
+}
+
+// OnInitialised registers a handler that is called once Connect has
+// completed the handshake with Storm and reported the pid. It allows
+// setup that depends on the topology context and configuration to run
+// exactly once. The handler has to be registered before Connect is
+// called.
+func (this *stormConnImpl) OnInitialised(handler func(context *messages.Context)) {
+	this.initialised = handler
+}
+
+// Close flushes any buffered output and removes the pid file that was
+// created when connecting to Storm. Closing a connection more than once
+// has no effect. The input and output are not closed, since they were
+// provided by the caller.
+func (this *stormConnImpl) Close() error {
+	if this.closed {
+		return nil
+	}
+	this.closed = true
+	this.stopMetrics()
+	this.Flush()
+	if this.pidFile != "" {
+		err := os.Remove(this.pidFile)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
 }
 
 func (this *stormConnImpl) Context() *messages.Context {
 	return this.context
 }
 
+// ErrUninitialised is returned when a connection is used to read from
+// Storm before Connect has completed the handshake
+var ErrUninitialised = errors.New("Attempting to read from uninitialised Storm connection")
+
+// InitialisedChecker is implemented by connections that report whether
+// they have been initialised.
+type InitialisedChecker interface {
+	Initialised() bool
+}
+
+// Initialised returns whether Connect has completed the handshake with
+// Storm, after which messages can be read and emitted
+func (this *stormConnImpl) Initialised() bool {
+	return this.context != nil
+}
+
+// PidDir returns the directory in which Storm expects the pid file of
+// this process. It is empty before Connect has been called.
+func (this *stormConnImpl) PidDir() string {
+	if this.context == nil {
+		return ""
+	}
+	return this.context.PidDir
+}
+
+// StatsReporter is implemented by connections that count the messages they
+// exchange with Storm
+type StatsReporter interface {
+	Stats() *Stats
+}
+
+// Stats returns a snapshot of the counters of the messages exchanged
+// with Storm. It is safe to call Stats from another goroutine, such as
+// an HTTP debug handler, while the connection is in use. The snapshot
+// is consistent: an ack that tracks latency, for example, is counted in
+// both Acked and AckLatency or in neither.
+func (this *stormConnImpl) Stats() *Stats {
+	return this.stats.snapshot()
+}
+
+// HooksSetter is implemented by connections that call Hooks for the messages
+// they exchange with Storm
+type HooksSetter interface {
+	SetHooks(hooks Hooks)
+}
+
+// SetHooks sets the functions that are called on the protocol
+// operations of the connection. It replaces any hooks that were set
+// before.
+func (this *stormConnImpl) SetHooks(hooks Hooks) {
+	this.hooks = hooks
+}
+
+// EmptyTupleRejecter is implemented by connections that can reject emissions without
+// fields
+type EmptyTupleRejecter interface {
+	SetRejectEmptyTuples(reject bool)
+}
+
+// SetRejectEmptyTuples specifies whether emitting a tuple without any
+// contents should panic. By default, such a tuple is sent to Storm as
+// an empty tuple ("tuple":[]).
+func (this *stormConnImpl) SetRejectEmptyTuples(reject bool) {
+	this.rejectEmptyTuples = reject
+}
+
+// OutputFieldsDeclarer is implemented by connections that check emissions against the
+// fields declared for their stream
+type OutputFieldsDeclarer interface {
+	DeclareOutputFields(stream string, fields []string)
+}
+
+// DeclareOutputFields declares the names of the fields of the tuples
+// emitted on the given stream. This should match the output fields
+// declared for the shell component in the topology. Once fields have
+// been declared for a stream, emitting a tuple with a different number
+// of fields on that stream panics, instead of failing in Storm where
+// the error is much harder to trace. The emit functions panic instead
+// of returning an error, as they do for other misuse such as emitting
+// from a spout that is not ready to send, since they only return task
+// ids and adding an error would break every existing caller. Spouts can
+// use TryEmit of CheckedEmitter to receive these errors instead.
+// Streams reserved by Storm, as described at IsReservedStream, have to
+// be declared before tuples can be emitted on them.
+func (this *stormConnImpl) DeclareOutputFields(stream string, fields []string) {
+	if this.outputFields == nil {
+		this.outputFields = make(map[string][]string)
+	}
+	this.outputFields[streamName(stream)] = fields
+}
+
+// streamName returns the name of the given stream, where the empty
+// string denotes the default stream
+func streamName(stream string) string {
+	if stream == "" {
+		return DefaultStream
+	}
+	return stream
+}
+
+// DefaultStream is the name of the stream on which tuples are emitted
+// when no stream is given
+const DefaultStream = "default"
+
+// wireStream returns the stream as it is sent to Storm. The default
+// stream is always sent as the empty stream, which the encodings leave
+// out of the message and Storm takes for the default stream, so that
+// "" and "default" produce the same emission.
+func wireStream(stream string) string {
+	if stream == DefaultStream {
+		return ""
+	}
+	return stream
+}
+
+// validateContents returns an error if a tuple cannot be emitted on the
+// given stream
+func (this *stormConnImpl) validateContents(stream string, contents []interface{}) error {
+	if this.rejectEmptyTuples && len(contents) == 0 {
+		return errors.New("Emitting a tuple without contents")
+	}
+	fields, declared := this.outputFields[streamName(stream)]
+	if declared && len(fields) != len(contents) {
+		return fmt.Errorf("Emitting a tuple with %d fields on stream %s, which declares %d fields: %v", len(contents), streamName(stream), len(fields), fields)
+	}
+	if !declared && IsReservedStream(stream) {
+		return fmt.Errorf("Emitting a tuple on stream %s, which is reserved by Storm and has not been declared with DeclareOutputFields", stream)
+	}
+	if this.maxFieldSize > 0 || len(this.maxFieldSizes) > 0 {
+		return this.validateFieldSizes(stream, contents)
+	}
+	return nil
+}
+
+// FieldSizeLimiter is implemented by connections that limit the size of the fields
+// they emit
+type FieldSizeLimiter interface {
+	SetMaxFieldSize(size int)
+	SetMaxFieldSizeAt(index int, size int)
+}
+
+// SetMaxFieldSize sets the maximum size in bytes of every field of an
+// emitted tuple. Emitting a tuple with a larger field panics. A size of
+// zero, which is the default, means that fields are unlimited. Limits
+// set for specific fields with SetMaxFieldSizeAt take precedence. Like
+// the arity check of DeclareOutputFields, an oversized field panics
+// instead of returning an error, since the emit functions only return
+// task ids.
+func (this *stormConnImpl) SetMaxFieldSize(size int) {
+	this.maxFieldSize = size
+}
+
+// SetMaxFieldSizeAt sets the maximum size in bytes of the field at the
+// given index of an emitted tuple. Emitting a tuple with a larger field
+// at that index panics. A size of zero removes the limit.
+func (this *stormConnImpl) SetMaxFieldSizeAt(index int, size int) {
+	if this.maxFieldSizes == nil {
+		this.maxFieldSizes = make(map[int]int)
+	}
+	if size == 0 {
+		delete(this.maxFieldSizes, index)
+		return
+	}
+	this.maxFieldSizes[index] = size
+}
+
+func (this *stormConnImpl) validateFieldSizes(stream string, contents []interface{}) error {
+	for i, content := range contents {
+		max, ok := this.maxFieldSizes[i]
+		if !ok {
+			max = this.maxFieldSize
+		}
+		if max <= 0 {
+			continue
+		}
+		size, err := fieldSize(content)
+		if err != nil {
+			return err
+		}
+		if size > max {
+			return fmt.Errorf("Emitting a tuple on stream %s with field %d of %d bytes, which exceeds the maximum of %d bytes", streamName(stream), i, size, max)
+		}
+	}
+	return nil
+}
+
+// fieldSize returns the size of a tuple field. The size of strings and
+// byte slices is their length, while the size of other values is the
+// length of their JSON encoding.
+func fieldSize(content interface{}) (int, error) {
+	switch field := content.(type) {
+	case string:
+		return len(field), nil
+	case []byte:
+		return len(field), nil
+	}
+	data, err := json.Marshal(content)
+	if err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// MarshalHookSetter is implemented by connections that pass every emitted field
+// through a hook before encoding it
+type MarshalHookSetter interface {
+	SetMarshalHook(hook func(content interface{}) interface{})
+}
+
+// SetMarshalHook registers a function that is applied to every field of
+// an emitted tuple before it is encoded. This allows values of types
+// that do not round-trip through the encoding, such as time.Time, to be
+// converted into a suitable representation without converting them
+// before every emission.
+func (this *stormConnImpl) SetMarshalHook(hook func(content interface{}) interface{}) {
+	this.marshalHook = hook
+}
+
+// marshalContents applies the marshal hook to the fields of a tuple
+func (this *stormConnImpl) marshalContents(contents []interface{}) []interface{} {
+	if this.marshalHook == nil {
+		return contents
+	}
+	marshalled := make([]interface{}, len(contents))
+	for i, content := range contents {
+		marshalled[i] = this.marshalHook(content)
+	}
+	return marshalled
+}
+
+// ZeroTasksNotifier is implemented by connections that call a handler for
+// emissions that were sent to no tasks
+type ZeroTasksNotifier interface {
+	OnZeroTasks(handler func(stream string, contents []interface{}))
+}
+
+// OnZeroTasks registers a handler that is called when Storm reports
+// that an emission was sent to no tasks. This usually means that no
+// component subscribes to the stream. The handler is only called if
+// task ids are requested from Storm.
+func (this *stormConnImpl) OnZeroTasks(handler func(stream string, contents []interface{})) {
+	this.zeroTasks = handler
+}
+
+// readTaskIds reads the task ids of an emission from Storm and calls
+// the zero tasks handler if the emission was sent to no tasks. The
+// returned slice is never nil, so that an emission that was sent to no
+// tasks can be told apart from one for which no task ids were requested,
+// whatever the encoding decodes an empty list of task ids into.
+// It panics if the task ids cannot be read, such as when they are not
+// received within the task ids timeout.
+func (this *stormConnImpl) readTaskIds(stream string, contents []interface{}) (taskIds []int32) {
+	taskIds, err := this.tryReadTaskIds(stream, contents)
+	if err != nil {
+		panic(err)
+	}
+	return taskIds
+}
+
+// tryReadTaskIds reads the task ids of an emission like readTaskIds, but
+// returns ErrReadTimeout instead of panicking if the task ids were not
+// received in time
+func (this *stormConnImpl) tryReadTaskIds(stream string, contents []interface{}) (taskIds []int32, err error) {
+	if this.testMode {
+		taskIds = make([]int32, len(this.testTaskIds))
+		copy(taskIds, this.testTaskIds)
+	} else {
+		taskIds, err = this.readTaskIdsWithin(this.taskIdsTimeout)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if taskIds == nil {
+		taskIds = []int32{}
+	}
+	if len(taskIds) == 0 && this.zeroTasks != nil {
+		this.zeroTasks(stream, contents)
+	}
+	return taskIds, nil
+}
+
+// TestModeSetter is implemented by connections that can run without Storm, for
+// tests
+type TestModeSetter interface {
+	SetTestMode(taskIds []int32)
+}
+
+// SetTestMode makes emissions that need task ids return the given task
+// ids, instead of reading them from Storm. This allows a component that
+// emits tuples to be run against a fixture that only contains the
+// messages from Storm, such as the input frames of a trace. Without it,
+// the component would block on reading task ids that the fixture does
+// not contain. The channel returned by EmitAsync already holds the task
+// ids. Emissions are still written to the output as usual.
+func (this *stormConnImpl) SetTestMode(taskIds []int32) {
+	this.testMode = true
+	this.testTaskIds = taskIds
+}
+
 // Log sends a log message that will be logged by Storm
 func (this *stormConnImpl) Log(text string) {
 	this.EmitGeneric("log", "", "", text, nil, 0, false)
@@ -118,6 +737,28 @@ func (this *stormConnImpl) Log(text string) {
 	this.Flush()
 }
 
+// LogFields sends a structured log to Storm, as a log message of which
+// the text is formatted by FormatLogFields
+func (this *stormConnImpl) LogFields(msg string, fields map[string]interface{}) {
+	this.Log(FormatLogFields(msg, fields))
+}
+
+// ErrorReporter is implemented by connections that can report errors to
+// Storm.
+type ErrorReporter interface {
+	ReportError(msg string)
+}
+
+// ReportError reports an error to Storm, which shows it as the last
+// error of the component in the Storm UI, like the reportError of the
+// output collector of Java components. Unlike a log message, it does
+// not have to be found in the worker logs. Errors are flushed
+// immediately, like logs.
+func (this *stormConnImpl) ReportError(msg string) {
+	this.EmitGeneric("error", "", "", msg, nil, 0, false)
+	this.Flush()
+}
+
 // NewBoltConn returns a Storm bolt connection that a Go bolt can use to communicate with Storm
 func NewBoltConn(in Input, out Output, needTaskIds bool) BoltConn {
 	boltConn := &boltConnImpl{
@@ -128,6 +769,35 @@ func NewBoltConn(in Input, out Output, needTaskIds bool) BoltConn {
 
 type boltConnImpl struct {
 	*stormConnImpl
+	dedupAnchors bool
+	// pendingLock guards pending, since ReadBoltMsg reads the task ids of
+	// pending emissions and may be called by ReadTuples on a separate
+	// goroutine
+	pendingLock sync.Mutex
+	pending     []*pendingEmission
+	decodeHook  func(contents []interface{}) error
+	outstanding *outstandingIds
+	readTimes   map[string]time.Time
+	// readLock guards readTimes and currentId, since tuples may be read
+	// by ReadTuples on a separate goroutine while they are acked
+	readLock    sync.Mutex
+	inputFields map[string][]string
+	autoAnchor  bool
+	currentId   *string
+	// nextTask holds the round robin position of EmitDirectToComponent
+	// for every component
+	nextTask map[string]int
+	// inputSchemas holds the kinds of the fields expected on every
+	// stream for which a schema has been registered
+	inputSchemas map[string][]reflect.Kind
+}
+
+// pendingEmission is an asynchronous emission of which the task ids
+// have not been read yet
+type pendingEmission struct {
+	taskIds  chan []int32
+	stream   string
+	contents []interface{}
 }
 
 func newTupleMetadata(id, comp, stream string, task int64) *messages.BoltMsgMeta {
@@ -143,14 +813,38 @@ func newTupleMetadata(id, comp, stream string, task int64) *messages.BoltMsgMeta
 // SendAck acks the received message id
 // SendAck has to be called after an emission anchored to the acked id,
 // otherwise Storm will report an error.
+// Messages are written to Storm in the order in which they are sent, so
+// an emission made after SendAck returns is never written before the
+// ack. Since a bolt connection is not safe for concurrent use, ordering
+// dependent acks and emissions should be sent from the same goroutine.
+// The id is sent exactly as given and must be the id of the tuple as
+// Storm sent it. An empty id is rejected, as described at SetValidateAcks.
 func (this *boltConnImpl) SendAck(id string) {
+	if !this.complete("ack", id) {
+		return
+	}
+	readTime, tracked := this.takeReadTime(id)
+	this.completeCurrentId(id)
 	this.EmitGeneric("ack", id, "", "", nil, 0, false)
+	if tracked {
+		this.stats.addAckedWithLatency(time.Since(readTime))
+	} else {
+		this.stats.addAcked()
+	}
+	this.hooks.acked(id)
 }
 
 // SendFail reports that the message with the given Id failed
 // No emission should be anchored to a failed message Id
 func (this *boltConnImpl) SendFail(id string) {
+	if !this.complete("fail", id) {
+		return
+	}
+	this.takeReadTime(id)
+	this.completeCurrentId(id)
 	this.EmitGeneric("fail", id, "", "", nil, 0, false)
+	this.stats.addFailed()
+	this.hooks.failed(id)
 }
 
 // SendSync sends a sync typically in response to a heartbeat
@@ -158,15 +852,299 @@ func (this *boltConnImpl) SendSync() {
 	this.EmitGeneric("sync", "", "", "", nil, 0, false)
 }
 
+// AckValidator is implemented by bolt connections that can check that acked
+// and failed ids were read from Storm
+type AckValidator interface {
+	SetValidateAcks(limit int)
+}
+
+// SetValidateAcks enables the validation of acked and failed ids. When
+// enabled, the ids of tuples that have been read but not yet acked or
+// failed are tracked, and an ack or fail of an id that was never read,
+// or that was already acked or failed, is rejected: it is not sent to
+// Storm, and the error is logged and reported to the OnError hook.
+// At most limit ids are tracked as outstanding. Once the limit is
+// reached, the oldest ids are remembered as evicted and can still be
+// acked or failed. Once more than limit ids have been evicted, unknown
+// ids can no longer be told apart from evicted ones and validation is
+// skipped, so the limit should exceed the number of tuples that the
+// bolt holds on to. A limit of zero disables validation, which is the
+// default. Acks and fails with an empty id are rejected in the same way
+// whether or not validation is enabled, and ids that are not plain
+// integers, such as quoted or float formatted ids, cause a warning to be
+// logged, since they rarely match the ids that Storm generates.
+func (this *boltConnImpl) SetValidateAcks(limit int) {
+	if limit <= 0 {
+		this.outstanding = nil
+		return
+	}
+	this.outstanding = newOutstandingIds(limit)
+}
+
+// LatencyTracker is implemented by bolt connections that can measure the time
+// between reading and acking a tuple
+type LatencyTracker interface {
+	SetTrackLatency(track bool)
+}
+
+// SetTrackLatency specifies whether the time between reading a tuple
+// and acking it should be measured. The latencies are counted in the
+// AckLatency histogram of Stats. Read times are kept until a tuple is
+// acked or failed, so every tuple should eventually be acked or failed
+// when latency is tracked. Latency is not tracked by default.
+func (this *boltConnImpl) SetTrackLatency(track bool) {
+	this.readLock.Lock()
+	defer this.readLock.Unlock()
+	if !track {
+		this.readTimes = nil
+		return
+	}
+	if this.readTimes == nil {
+		this.readTimes = make(map[string]time.Time)
+	}
+}
+
+// recordReadTime records the time at which the tuple with the given id
+// was read, if latency is tracked
+func (this *boltConnImpl) recordReadTime(id string) {
+	this.readLock.Lock()
+	if this.readTimes != nil {
+		this.readTimes[id] = time.Now()
+	}
+	this.readLock.Unlock()
+}
+
+// takeReadTime returns and forgets the time at which the tuple with the
+// given id was read, if latency is tracked
+func (this *boltConnImpl) takeReadTime(id string) (readTime time.Time, ok bool) {
+	this.readLock.Lock()
+	defer this.readLock.Unlock()
+	readTime, ok = this.readTimes[id]
+	if ok {
+		delete(this.readTimes, id)
+	}
+	return readTime, ok
+}
+
+// complete removes an acked or failed id from the outstanding ids, if
+// ack validation is enabled. It returns whether the ack or fail may be
+// sent, and reports an error if not. An empty id is always rejected,
+// since Storm cannot match it to a tuple and would kill the worker.
+func (this *boltConnImpl) complete(command, id string) bool {
+	err := validateCompletedId(command, id)
+	if err == nil {
+		if this.outstanding == nil || this.outstanding.remove(id) {
+			return true
+		}
+		err = fmt.Errorf("core: Rejected %s for id %s, which is not outstanding", command, id)
+	}
+	Logger().Print(err)
+	this.hooks.error(err)
+	return false
+}
+
+// AnchorDeduplicator is implemented by bolt connections that can remove duplicate
+// anchors from emissions
+type AnchorDeduplicator interface {
+	SetDedupAnchors(dedup bool)
+}
+
+// SetDedupAnchors specifies whether duplicate ids should be removed
+// from the anchor list of an emission before it is sent to Storm.
+// By default, anchors are sent exactly as provided.
+func (this *boltConnImpl) SetDedupAnchors(dedup bool) {
+	this.dedupAnchors = dedup
+}
+
+// dedupAnchors returns the anchors with duplicate ids removed,
+// preserving the order in which the ids first appear
+func dedupAnchors(anchors []string) []string {
+	seen := make(map[string]bool, len(anchors))
+	deduped := make([]string, 0, len(anchors))
+	for _, anchor := range anchors {
+		if !seen[anchor] {
+			seen[anchor] = true
+			deduped = append(deduped, anchor)
+		}
+	}
+	return deduped
+}
+
+// ReadBoltMsg reads the next tuple from Storm, after reading the task
+// ids of any outstanding asynchronous emissions. ErrUninitialised is
+// returned if Connect has not been called.
+func (this *boltConnImpl) ReadBoltMsg(meta *messages.BoltMsgMeta, contentStructs ...interface{}) (err error) {
+	if this.context == nil {
+		return ErrUninitialised
+	}
+	this.ReadPendingTaskIds()
+	for {
+		err = this.stormConnImpl.ReadBoltMsg(meta, contentStructs...)
+		if err != nil {
+			return this.hooks.readError(err)
+		}
+		this.stats.addRead()
+		this.hooks.read(meta)
+		if this.inputSchemas == nil {
+			break
+		}
+		err = this.validateSchema(meta, contentStructs)
+		if err == nil {
+			break
+		}
+		// The tuple is rejected before the bolt sees it
+		this.ReportError(err.Error())
+		this.EmitGeneric("fail", meta.Id, "", "", nil, 0, false)
+		this.stats.addFailed()
+		this.hooks.failed(meta.Id)
+	}
+	// Heartbeats are answered with a sync instead of an ack, so they are
+	// neither tracked nor anchored to
+	if meta.Stream != HeartbeatStream {
+		if this.outstanding != nil {
+			this.outstanding.add(meta.Id)
+		}
+		this.recordReadTime(meta.Id)
+		this.setCurrentId(meta.Id)
+	}
+	if this.decodeHook != nil {
+		err = this.decodeHook(contentStructs)
+		if err != nil {
+			return this.hooks.readError(err)
+		}
+	}
+	return nil
+}
+
+// AutoAnchorer is implemented by bolt connections that can anchor
+// emissions to the current tuple automatically.
+type AutoAnchorer interface {
+	SetAutoAnchor(enabled bool)
+}
+
+// SetAutoAnchor specifies whether emissions without anchors should be
+// anchored to the current tuple, which is the last tuple read, until it
+// is acked or failed. This suits the common bolt that emits tuples
+// derived from each tuple it reads before acking it, without passing its
+// id as the anchor of every emission. Emissions with a nil anchor list
+// are anchored to the current tuple, while those with other anchors are
+// sent unchanged, so a non-nil empty list emits an unanchored tuple.
+// Heartbeats do not change the current tuple. Since the current tuple is
+// the last one read, auto anchoring should not be combined with
+// ReadTuples, which reads tuples ahead of the bolt. It is disabled by
+// default.
+func (this *boltConnImpl) SetAutoAnchor(enabled bool) {
+	this.autoAnchor = enabled
+}
+
+// setCurrentId sets the id of the current tuple, which is used for auto
+// anchoring and by Emit1. An empty id clears the current tuple.
+func (this *boltConnImpl) setCurrentId(id string) {
+	this.readLock.Lock()
+	defer this.readLock.Unlock()
+	if id == "" {
+		this.currentId = nil
+	} else {
+		this.currentId = &id
+	}
+}
+
+// completeCurrentId clears the current tuple if it has the given id
+func (this *boltConnImpl) completeCurrentId(id string) {
+	this.readLock.Lock()
+	defer this.readLock.Unlock()
+	if this.currentId != nil && *this.currentId == id {
+		this.currentId = nil
+	}
+}
+
+// currentAnchors returns the anchors of an emission to the current
+// tuple, or nil if there is no current tuple
+func (this *boltConnImpl) currentAnchors() []string {
+	this.readLock.Lock()
+	defer this.readLock.Unlock()
+	if this.currentId == nil {
+		return nil
+	}
+	return []string{*this.currentId}
+}
+
+// DefaultBoltEmitter is implemented by bolt connections that can emit
+// tuples on the default stream with a single short call.
+type DefaultBoltEmitter interface {
+	Emit1(contents ...interface{}) (taskIds []int32)
+}
+
+// Emit1 emits a tuple with the given contents on the default stream,
+// anchored to the current tuple, which is the last tuple read until it
+// is acked or failed, as described at SetAutoAnchor. The current tuple
+// is tracked whether or not auto anchoring is enabled. If there is no
+// current tuple, the emitted tuple is unanchored. Like auto anchoring,
+// Emit1 should not be combined with ReadTuples, which reads tuples ahead
+// of the bolt.
+func (this *boltConnImpl) Emit1(contents ...interface{}) (taskIds []int32) {
+	anchors := this.currentAnchors()
+	if anchors == nil {
+		anchors = []string{}
+	}
+	return this.Emit(anchors, "", contents...)
+}
+
+// InputFieldsDeclarer is implemented by bolt connections that know the field names
+// of the tuples they read
+type InputFieldsDeclarer interface {
+	DeclareInputFields(component, stream string, fields []string)
+	InputFields(component, stream string) []string
+}
+
+// DeclareInputFields declares the names of the fields of the tuples
+// that the bolt receives from the given component on the given stream.
+// Storm only sends the values of a tuple, so the names have to match
+// the output fields declared by the emitting component. The names are
+// set on the tuples read by ReadTuples, which allows their fields to be
+// accessed by name with Tuple.Get.
+func (this *boltConnImpl) DeclareInputFields(component, stream string, fields []string) {
+	if this.inputFields == nil {
+		this.inputFields = make(map[string][]string)
+	}
+	this.inputFields[component+"/"+streamName(stream)] = fields
+}
+
+// InputFields returns the names of the fields of the tuples received
+// from the given component on the given stream, or nil if they have not
+// been declared
+func (this *boltConnImpl) InputFields(component, stream string) []string {
+	return this.inputFields[component+"/"+streamName(stream)]
+}
+
+// DecodeHookSetter is implemented by bolt connections that pass the decoded
+// fields of every tuple through a hook
+type DecodeHookSetter interface {
+	SetDecodeHook(hook func(contents []interface{}) error)
+}
+
+// SetDecodeHook registers a function that is called with the decoded
+// fields of every tuple that is read. The hook can be used to convert
+// fields into types that do not survive the round-trip through the
+// encoding, such as parsing RFC3339 strings into time.Time values. An
+// error returned by the hook is returned by ReadBoltMsg.
+func (this *boltConnImpl) SetDecodeHook(hook func(contents []interface{}) error) {
+	this.decodeHook = hook
+}
+
 // Emit emits a tuple with the given array of interface{}s as values,
 // anchored to the given array of taskIds, sent out on the given stream.
-// A stream value of "" or "default" can be used to denote the default stream
+// A stream value of "" or "default" can be used to denote the default stream,
+// which is sent to Storm in the same way for both
 // The function returns a list of taskIds to which the message was sent.
+// If task ids are requested, the list is empty, but not nil, when the
+// tuple was sent to no tasks. It is nil when no task ids are requested.
 func (this *boltConnImpl) Emit(anchors []string, stream string, contents ...interface{}) (taskIds []int32) {
 	this.EmitDirect(anchors, stream, 0, contents...)
 	this.Flush()
+	this.ReadPendingTaskIds()
 	if this.needTaskIds {
-		return this.ReadTaskIds()
+		return this.readTaskIds(stream, contents)
 	} else {
 		return nil
 	}
@@ -177,76 +1155,607 @@ func (this *boltConnImpl) Emit(anchors []string, stream string, contents ...inte
 // to the given taskId.
 // The topology should have been configured for direct transmission
 // for this call to work.
-// A stream value of "" or "default" can be used to denote the default stream
-// The function returns a list of taskIds to which the message was sent.
+// A stream value of "" or "default" can be used to denote the default stream,
+// which is sent to Storm in the same way for both
+// No task ids are returned, since Storm does not reply to direct
+// emissions: the tuple is only sent to the given task.
 func (this *boltConnImpl) EmitDirect(anchors []string, stream string, directTask int64, contents ...interface{}) {
-	this.EmitGeneric("emit", "", stream, "", anchors, directTask, this.needTaskIds, contents...)
+	this.emit(anchors, stream, directTask, this.needTaskIds, contents)
+}
+
+// ComponentEmitter is implemented by bolt connections that can emit
+// tuples directly to a task of a component given by name.
+type ComponentEmitter interface {
+	EmitDirectToComponent(anchors []string, stream string, component string, contents ...interface{}) (task int64, err error)
+}
+
+// EmitDirectToComponent emits a tuple directly to one of the tasks of
+// the given component, as EmitDirect does for a task id. The tasks of
+// the component are looked up in the task to component mapping of the
+// topology context and are chosen round robin in ascending order of
+// their ids, so that consecutive emissions are spread over all tasks.
+// The chosen task is returned. An error is returned, and nothing is
+// sent, if the connection is not initialised or the component has no
+// tasks.
+func (this *boltConnImpl) EmitDirectToComponent(anchors []string, stream string, component string, contents ...interface{}) (task int64, err error) {
+	if this.context == nil {
+		return 0, errors.New("Attempting to emit to a component on an uninitialised Storm connection")
+	}
+	tasks := this.context.ComponentTasks(component)
+	if len(tasks) == 0 {
+		return 0, fmt.Errorf("Emitting to component %s, which has no tasks in the topology", component)
+	}
+	if this.nextTask == nil {
+		this.nextTask = make(map[string]int)
+	}
+	task = tasks[this.nextTask[component]%len(tasks)]
+	this.nextTask[component]++
+	this.EmitDirect(anchors, stream, task, contents...)
+	return task, nil
+}
+
+func (this *boltConnImpl) emit(anchors []string, stream string, directTask int64, needTaskIds bool, contents []interface{}) {
+	if err := this.tryEmit(anchors, stream, directTask, needTaskIds, contents); err != nil {
+		panic(err)
+	}
+}
+
+// tryEmit sends an emission to Storm if its contents are valid and can
+// be encoded, and returns an error otherwise
+func (this *boltConnImpl) tryEmit(anchors []string, stream string, directTask int64, needTaskIds bool, contents []interface{}) error {
+	if err := this.validateContents(stream, contents); err != nil {
+		return err
+	}
+	if anchors == nil && this.autoAnchor {
+		anchors = this.currentAnchors()
+	}
+	if this.dedupAnchors {
+		anchors = dedupAnchors(anchors)
+	}
+	if err := this.tryEmitGeneric("emit", "", wireStream(stream), "", anchors, directTask, needTaskIds, this.marshalContents(contents)...); err != nil {
+		return err
+	}
+	this.stats.addEmitted(stream)
+	this.hooks.emitted(stream, 1)
+	return nil
+}
+
+// CheckedBoltEmitter is implemented by bolt connections that return an
+// error instead of panicking when a tuple cannot be emitted.
+type CheckedBoltEmitter interface {
+	TryEmit(anchors []string, stream string, contents ...interface{}) (taskIds []int32, err error)
+	TryEmitDirect(anchors []string, stream string, directTask int64, contents ...interface{}) error
+}
+
+// TryEmit emits a tuple like Emit, but returns an error instead of
+// panicking when the tuple cannot be emitted: an error describing
+// contents that Emit would reject, or an error of the output if a field
+// cannot be encoded, such as a channel or a function. Nothing is sent to
+// Storm when an error is returned. Encoding errors are only returned by
+// outputs that implement CheckedOutput, which the JSON, hybrid and avro
+// encodings do. Failures to communicate with Storm still panic, since
+// the connection cannot be used after them.
+func (this *boltConnImpl) TryEmit(anchors []string, stream string, contents ...interface{}) (taskIds []int32, err error) {
+	if err := this.tryEmit(anchors, stream, 0, this.needTaskIds, contents); err != nil {
+		return nil, err
+	}
+	this.Flush()
+	this.ReadPendingTaskIds()
+	if this.needTaskIds {
+		return this.tryReadTaskIds(stream, contents)
+	}
+	return nil, nil
+}
+
+// TryEmitDirect emits a tuple to the given task like EmitDirect, but
+// returns an error instead of panicking, as TryEmit does
+func (this *boltConnImpl) TryEmitDirect(anchors []string, stream string, directTask int64, contents ...interface{}) error {
+	return this.tryEmit(anchors, stream, directTask, this.needTaskIds, contents)
+}
+
+// StructEmitter is implemented by bolt connections that can emit the fields of a
+// struct
+type StructEmitter interface {
+	EmitStruct(v interface{}, anchors []string, stream string) (taskIds []int32)
+}
+
+// EmitStruct emits the exported fields of the given struct as the
+// contents of a tuple, in the order in which they are declared. Fields
+// tagged with `storm:"-"` are not emitted and nested structs are emitted
+// as single fields. This allows the emitted tuples to be defined by the
+// same struct that the receiving bolt decodes them into.
+func (this *boltConnImpl) EmitStruct(v interface{}, anchors []string, stream string) (taskIds []int32) {
+	return this.Emit(anchors, stream, structFields(v)...)
+}
+
+// RawEmitter is implemented by bolt connections that can emit a tuple given
+// as a raw JSON array
+type RawEmitter interface {
+	EmitRaw(raw json.RawMessage, anchors []string, stream string) (taskIds []int32)
+}
+
+// EmitRaw emits a tuple of which the contents are given as a raw JSON
+// array. Every element of the array is emitted as a json.RawMessage, so
+// that it is not decoded and re-encoded. Together with decoding the
+// fields of received tuples into json.RawMessage values, this allows a
+// bolt to pass on tuples without changing the formatting of numbers or
+// the order of object keys.
+func (this *boltConnImpl) EmitRaw(raw json.RawMessage, anchors []string, stream string) (taskIds []int32) {
+	var fields []json.RawMessage
+	err := json.Unmarshal(raw, &fields)
+	if err != nil {
+		panic(fmt.Sprintf("Emitting raw tuple that is not a JSON array: %v", err))
+	}
+	contents := make([]interface{}, len(fields))
+	for i, field := range fields {
+		contents[i] = field
+	}
+	return this.Emit(anchors, stream, contents...)
+}
+
+// AsyncEmitter is implemented by bolt connections that can emit without
+// waiting for the task ids of the tuple
+type AsyncEmitter interface {
+	EmitAsync(anchors []string, stream string, contents ...interface{}) <-chan []int32
+	ReadPendingTaskIds()
+}
+
+// EmitAsync emits a tuple like Emit, but does not wait for Storm to
+// reply with the task ids to which the tuple was sent. This allows
+// many tuples to be emitted without waiting for a round trip to Storm
+// for each of them. Task ids are always requested for asynchronous
+// emissions and are sent on the returned channel once they have been
+// read. They are read when the bolt next reads a tuple or emits a tuple
+// synchronously, or when ReadPendingTaskIds is called. Receiving from
+// the channel before that happens blocks forever.
+func (this *boltConnImpl) EmitAsync(anchors []string, stream string, contents ...interface{}) <-chan []int32 {
+	this.emit(anchors, stream, 0, true, contents)
+	this.Flush()
+	emission := &pendingEmission{
+		taskIds:  make(chan []int32, 1),
+		stream:   stream,
+		contents: contents,
+	}
+	// In test mode, the task ids are not read from Storm, so they are
+	// available immediately
+	if this.testMode {
+		emission.taskIds <- this.readTaskIds(stream, contents)
+		return emission.taskIds
+	}
+	this.pendingLock.Lock()
+	this.pending = append(this.pending, emission)
+	this.pendingLock.Unlock()
+	return emission.taskIds
+}
+
+// ReadPendingTaskIds reads the task ids of all outstanding asynchronous
+// emissions from Storm, in the order in which they were emitted. Tuples
+// that are received in the meantime are buffered for the next read.
+func (this *boltConnImpl) ReadPendingTaskIds() {
+	this.pendingLock.Lock()
+	pending := this.pending
+	this.pending = nil
+	this.pendingLock.Unlock()
+	for _, emission := range pending {
+		emission.taskIds <- this.readTaskIds(emission.stream, emission.contents)
+	}
 }
 
 // NewSpoutConn returns a Storm spout connection that a Go spout can use to communicate with Storm
 func NewSpoutConn(in Input, out Output, needTaskIds bool) SpoutConn {
 	spoutConn := &spoutConnImpl{
+		state:         SpoutAwaitingCommand,
 		stormConnImpl: newStormConn(in, out, needTaskIds),
 	}
 	return spoutConn
 }
 
+// spoutConnImpl implements the spout side of the protocol as the state
+// machine documented at SpoutState. The state moves to
+// SpoutHandlingCommand when a command is read and back to
+// SpoutAwaitingCommand when the sync for it is sent.
 type spoutConnImpl struct {
-	readyToSend bool
+	state        SpoutState
+	lastCommand  string
+	tuplesSent   bool
+	waitStrategy WaitStrategy
+	tracked      map[string]*trackedEmission
+	trackedCount uint64
+	failDropped  bool
 	*stormConnImpl
 }
 
-// ReadMsg reads a message from Storm.
-// The message read can be either a next, ack or fail message.
-// A check is performed to verify that Storm has been initialised.
+// ReadSpoutMsg reads a command from Storm.
+// The command read can be either a next, ack or fail command, which
+// can be compared against CommandNext, CommandAck and CommandFail, or
+// CommandActivate and CommandDeactivate.
+// The command and id are the fields of the messages.SpoutMsg that was
+// read, which is the exported type of spout commands.
+// The id is only set for ack and fail messages.
+// ErrUninitialised is returned if Connect has not been called.
+// Reading a command before the sync for the previous command has been
+// sent is allowed, since Storm only sends the next command after the
+// sync, but tuples emitted in between are attributed to the new command.
 func (this *spoutConnImpl) ReadSpoutMsg() (command, id string, err error) {
 	if this.context == nil {
-		return "", "", errors.New("Attempting to read from uninitialised Storm connection")
+		return "", "", ErrUninitialised
 	}
-	this.readyToSend = true
 
 	msg := &messages.SpoutMsg{}
 	err = this.ReadMsg(msg)
 	if err != nil {
-		return "", "", err
+		return "", "", this.hooks.readError(err)
+	}
+	this.state = SpoutHandlingCommand
+	this.lastCommand = msg.Command
+	this.tuplesSent = false
+	this.stats.addRead()
+	switch msg.Command {
+	case CommandAck:
+		this.stats.addAcked()
+		this.hooks.acked(msg.Id)
+	case CommandFail:
+		this.stats.addFailed()
+		this.hooks.failed(msg.Id)
 	}
 	return msg.Command, msg.Id, nil
 }
 
+// SpoutWaiter is implemented by spout connections that can wait before
+// replying to Storm when the spout is idle
+type SpoutWaiter interface {
+	SetSyncSleep(d time.Duration)
+	SetWaitStrategy(strategy WaitStrategy)
+	TuplesSentSinceNext() bool
+}
+
+// SetSyncSleep sets the time that SendSync waits before replying to a
+// next command during which no tuples were emitted. This mimics the
+// sleep spout wait strategy of Java spouts and saves CPU for idle
+// spouts. The sleep only happens when no tuples were sent since the
+// last next, so a busy spout is never delayed. The default of zero
+// disables the sleep: SendSync then replies immediately, even to idle
+// next commands, which Storm accepts. Since it replaces the wait
+// strategy, a sleep of zero also removes a strategy that was set with
+// SetWaitStrategy.
+func (this *spoutConnImpl) SetSyncSleep(d time.Duration) {
+	if d <= 0 {
+		this.SetWaitStrategy(nil)
+		return
+	}
+	this.SetWaitStrategy(NewSleepWaitStrategy(d))
+}
+
+// SetWaitStrategy sets the strategy that decides how long SendSync
+// waits before replying to Storm. A nil strategy disables waiting.
+func (this *spoutConnImpl) SetWaitStrategy(strategy WaitStrategy) {
+	this.waitStrategy = strategy
+}
+
+// State returns the state of the spout in the protocol
+func (this *spoutConnImpl) State() SpoutState {
+	if this.context == nil {
+		return SpoutUninitialised
+	}
+	return this.state
+}
+
+// TuplesSentSinceNext returns whether any tuples have been emitted
+// since the last message was read from Storm. Despite the name, this
+// covers the last ack and fail as well, and is what the wait strategy
+// uses to decide whether the spout is idle.
+func (this *spoutConnImpl) TuplesSentSinceNext() bool {
+	return this.tuplesSent
+}
+
 // SendSync sends a sync message to Storm.
 // After a sync message is sent, it is not possible for a spout to
-// emit a message before a ReadMsg has been performed. This is to
+// emit a message before a ReadSpoutMsg has been performed. This is to
 // enforce the synchronous behaviour of a spout as required by Storm.
+// Before the sync is sent, the wait strategy may delay it if no tuples
+// were emitted for the last command.
+// SendSync sends the sync in any state; TrySendSync only sends it in
+// reply to a command.
 func (this *spoutConnImpl) SendSync() {
+	if this.waitStrategy != nil {
+		if wait := this.waitStrategy.Wait(this.lastCommand, this.tuplesSent); wait > 0 {
+			time.Sleep(wait)
+		}
+	}
 	this.EmitGeneric("sync", "", "", "", nil, 0, false)
-	this.readyToSend = false
+	this.state = SpoutAwaitingCommand
 	this.Flush()
 }
 
+// TrySendSync sends a sync message to Storm like SendSync, but returns
+// a *SpoutStateError instead if the spout is not handling a command,
+// because no command has been read or its sync has already been sent.
+// Nothing is sent to Storm when an error is returned.
+func (this *spoutConnImpl) TrySendSync() error {
+	if state := this.State(); state != SpoutHandlingCommand {
+		return &SpoutStateError{Op: "sync", State: state, Expected: SpoutHandlingCommand}
+	}
+	this.SendSync()
+	return nil
+}
+
 // Emit emits a tuple with the given array of interface{}s as values,
 // with the given taskId, sent out on the given stream.
-// A stream value of "" or "default" can be used to denote the default stream
+// The id is always sent to Storm as a string and is returned unchanged
+// in the ack or fail for the tuple. An empty id leaves the id out of the
+// emission, which makes it unreliable: Storm will not track the tuple.
+// A stream value of "" or "default" can be used to denote the default stream,
+// which is sent to Storm in the same way for both
 // The function returns a list of taskIds to which the message was sent.
+// If task ids are requested, the list is empty, but not nil, when the
+// tuple was sent to no tasks. It is nil when no task ids are requested.
+// EmitDelivered always requests task ids.
+// Ids starting with TrackedIdPrefix are reserved for EmitTracked and
+// ids starting with KeyedIdPrefix for EmitWithKey.
+// Emit panics with a *SpoutStateError if it is called while the spout
+// is not handling a command, as described at SpoutState.
 func (this *spoutConnImpl) Emit(id string, stream string, contents ...interface{}) (taskIds []int32) {
-	this.EmitDirect(id, stream, 0, contents...)
+	checkUserId(id)
+	return this.emitAndRead(id, stream, contents)
+}
+
+func (this *spoutConnImpl) emitAndRead(id string, stream string, contents []interface{}) (taskIds []int32) {
+	this.emit(id, stream, 0, this.needTaskIds, contents)
 	// Flush this message now so that we can receive the taskIds before returning.
 	this.Flush()
 	if this.needTaskIds {
-		return this.ReadTaskIds()
+		return this.readTaskIds(stream, contents)
 	} else {
 		return nil
 	}
 }
 
+// checkUserId panics if an id passed to an emit function is reserved
+// for tracked or keyed emissions, since its ack or fail would otherwise
+// be mistaken for that of such an emission
+func checkUserId(id string) {
+	if err := validateUserId(id); err != nil {
+		panic(err)
+	}
+}
+
+func validateUserId(id string) error {
+	if strings.HasPrefix(id, TrackedIdPrefix) {
+		return fmt.Errorf("Emitting a tuple with id %s, which is reserved for tracked emissions", id)
+	}
+	if strings.HasPrefix(id, KeyedIdPrefix) {
+		return fmt.Errorf("Emitting a tuple with id %s, which is reserved for keyed emissions", id)
+	}
+	return nil
+}
+
+// UnreliableEmitter is implemented by spout connections that can emit
+// tuples without an id
+type UnreliableEmitter interface {
+	EmitUnreliable(stream string, contents ...interface{}) (taskIds []int32)
+}
+
+// EmitUnreliable emits a tuple without an id, so that Storm does not
+// track it. The spout will never receive an ack or fail for the tuple.
+func (this *spoutConnImpl) EmitUnreliable(stream string, contents ...interface{}) (taskIds []int32) {
+	return this.Emit("", stream, contents...)
+}
+
+// TrackedEmitter is implemented by spout connections that can emit tuples
+// with ack and fail callbacks.
+type TrackedEmitter interface {
+	EmitTracked(stream string, onAck, onFail func(), contents ...interface{}) (id string)
+	Dispatch(command, id string) (handled bool)
+}
+
+// TrackedIdPrefix is the prefix of the ids generated by EmitTracked.
+// Ids with this prefix cannot be passed to the other emit functions.
+const TrackedIdPrefix = "__tracked-"
+
+// trackedEmission holds the callbacks of a tracked emission
+type trackedEmission struct {
+	onAck  func()
+	onFail func()
+}
+
+// EmitTracked emits a tuple with a generated id and registers callbacks
+// that are called when the tuple is acked or failed. Either callback may
+// be nil. The callbacks are called by Dispatch, which the shell spout
+// calls for every ack and fail it receives. The generated id starts
+// with TrackedIdPrefix and is returned.
+//
+// The callbacks are kept until the tuple is acked or failed. Storm fails
+// every tuple that is not completed within topology.message.timeout.secs,
+// so the number of callbacks is bounded by the number of tuples that can
+// be emitted within the message timeout, or by topology.max.spout.pending
+// if it is set. Callbacks are only released if Dispatch is called for
+// every ack and fail, as the shell spout does.
+func (this *spoutConnImpl) EmitTracked(stream string, onAck, onFail func(), contents ...interface{}) (id string) {
+	this.trackedCount++
+	id = TrackedIdPrefix + strconv.FormatUint(this.trackedCount, 10)
+	if this.tracked == nil {
+		this.tracked = make(map[string]*trackedEmission)
+	}
+	emission := &trackedEmission{
+		onAck:  onAck,
+		onFail: onFail,
+	}
+	this.tracked[id] = emission
+	if !this.failDropped {
+		this.emitAndRead(id, stream, contents)
+		return id
+	}
+	this.emit(id, stream, 0, true, contents)
+	this.Flush()
+	if taskIds := this.readTaskIds(stream, contents); len(taskIds) == 0 {
+		// Storm acks the tuple, which must not reach the callbacks
+		emission.onAck, emission.onFail = nil, nil
+		if onFail != nil {
+			onFail()
+		}
+	}
+	return id
+}
+
+// DroppedFailer is implemented by spout connections that can fail
+// tracked emissions that were not sent to any task.
+type DroppedFailer interface {
+	SetFailDropped(enabled bool)
+}
+
+// SetFailDropped sets whether tuples emitted with EmitTracked that were
+// not sent to any task are failed. Storm acks such a tuple right away,
+// since no task has to process it, so without this, a tuple that is
+// dropped because no component subscribes to its stream is silently
+// counted as done. When enabled, EmitTracked always requests the task
+// ids of the tuple, like EmitDelivered, and calls onFail before it
+// returns if there are none. The ack that Storm sends for the tuple is
+// then ignored, and the tuple is counted as pending until it arrives.
+// It is disabled by default, since some topologies emit on streams
+// without subscribers on purpose.
+func (this *spoutConnImpl) SetFailDropped(enabled bool) {
+	this.failDropped = enabled
+}
+
+// PendingCounter is implemented by spout connections that count the
+// tracked emissions that have not been acked or failed yet.
+type PendingCounter interface {
+	Pending() int
+}
+
+// Pending returns the number of tuples emitted with EmitTracked that
+// have not been acked or failed yet. Tuples emitted with the other emit
+// functions are not counted. Like the other spout functions, it must be
+// called on the goroutine that handles the commands from Storm.
+func (this *spoutConnImpl) Pending() int {
+	return len(this.tracked)
+}
+
+// Dispatch calls the callback of a tracked emission for an ack or fail
+// command read from Storm. It returns whether the id belonged to a
+// tracked emission, in which case the command has been handled.
+func (this *spoutConnImpl) Dispatch(command, id string) (handled bool) {
+	emission, ok := this.tracked[id]
+	if !ok {
+		return false
+	}
+	delete(this.tracked, id)
+	switch command {
+	case CommandAck:
+		if emission.onAck != nil {
+			emission.onAck()
+		}
+	case CommandFail:
+		if emission.onFail != nil {
+			emission.onFail()
+		}
+	}
+	return true
+}
+
 // EmitDirect emits a tuple with the given array of interface{}s as values,
 // with the given taskId, sent out on the given stream, to the given taskId.
 // The topology should have been configured for direct transmission
 // for this call to work.
-// A stream value of "" or "default" can be used to denote the default stream
-// The function returns a list of taskIds to which the message was sent.
+// A stream value of "" or "default" can be used to denote the default stream,
+// which is sent to Storm in the same way for both
+// No task ids are returned, since Storm does not reply to direct
+// emissions: the tuple is only sent to the given task.
 func (this *spoutConnImpl) EmitDirect(id string, stream string, directTask int64, contents ...interface{}) {
-	if !this.readyToSend {
-		panic("Spout not ready to send")
+	checkUserId(id)
+	this.emit(id, stream, directTask, this.needTaskIds, contents)
+}
+
+func (this *spoutConnImpl) emit(id string, stream string, directTask int64, needTaskIds bool, contents []interface{}) {
+	if err := this.tryEmit(id, stream, directTask, needTaskIds, contents); err != nil {
+		panic(err)
+	}
+}
+
+// tryEmit sends an emission to Storm if the spout is handling a command
+// and the contents are valid, and returns an error otherwise
+func (this *spoutConnImpl) tryEmit(id string, stream string, directTask int64, needTaskIds bool, contents []interface{}) error {
+	if state := this.State(); state != SpoutHandlingCommand {
+		return &SpoutStateError{Op: "emit", State: state, Expected: SpoutHandlingCommand}
+	}
+	if err := this.validateContents(stream, contents); err != nil {
+		return err
+	}
+	if err := this.tryEmitGeneric("emit", id, wireStream(stream), "", nil, directTask, needTaskIds, this.marshalContents(contents)...); err != nil {
+		return err
+	}
+	this.tuplesSent = true
+	this.stats.addEmitted(stream)
+	this.hooks.emitted(stream, 1)
+	return nil
+}
+
+// DefaultEmitter is implemented by spout connections that can emit
+// tuples on the default stream with a single short call.
+type DefaultEmitter interface {
+	Emit1(id string, contents ...interface{}) (taskIds []int32)
+}
+
+// Emit1 emits a tuple with the given id and contents on the default
+// stream, like Emit. An empty id emits an unreliable tuple.
+func (this *spoutConnImpl) Emit1(id string, contents ...interface{}) (taskIds []int32) {
+	return this.Emit(id, "", contents...)
+}
+
+// DeliveryEmitter is implemented by spout connections that can report
+// whether an emitted tuple was sent to any task.
+type DeliveryEmitter interface {
+	EmitDelivered(id string, stream string, contents ...interface{}) (taskIds []int32, delivered bool)
+}
+
+// EmitDelivered emits a tuple like Emit, but always requests the task
+// ids to which the tuple was sent from Storm, whether or not the
+// connection was created to request them. It returns whether the tuple
+// was delivered to at least one task. A tuple that is not delivered,
+// for instance because no component subscribes to the stream, is acked
+// by Storm right away, since no task has to process it, so a spout that
+// routes tuples can fail or retry it instead of counting it as done.
+func (this *spoutConnImpl) EmitDelivered(id string, stream string, contents ...interface{}) (taskIds []int32, delivered bool) {
+	checkUserId(id)
+	this.emit(id, stream, 0, true, contents)
+	this.Flush()
+	taskIds = this.readTaskIds(stream, contents)
+	return taskIds, len(taskIds) > 0
+}
+
+// CheckedEmitter is implemented by spout connections that return an
+// error instead of panicking when a tuple cannot be emitted.
+type CheckedEmitter interface {
+	TryEmit(id string, stream string, contents ...interface{}) (taskIds []int32, err error)
+	TryEmitDirect(id string, stream string, directTask int64, contents ...interface{}) error
+}
+
+// TryEmit emits a tuple like Emit, but returns an error instead of
+// panicking when the tuple cannot be emitted: a *SpoutStateError when
+// the spout is not handling a command, an error describing an id or
+// contents that Emit would reject, or an error of the output if a field
+// cannot be encoded, as described at the TryEmit of bolt connections.
+// Nothing is sent to Storm when an error is returned. Failures to communicate with Storm still panic,
+// since the connection cannot be used after them.
+func (this *spoutConnImpl) TryEmit(id string, stream string, contents ...interface{}) (taskIds []int32, err error) {
+	if err := validateUserId(id); err != nil {
+		return nil, err
+	}
+	if err := this.tryEmit(id, stream, 0, this.needTaskIds, contents); err != nil {
+		return nil, err
+	}
+	this.Flush()
+	if this.needTaskIds {
+		return this.tryReadTaskIds(stream, contents)
+	}
+	return nil, nil
+}
+
+// TryEmitDirect emits a tuple to the given task like EmitDirect, but
+// returns an error instead of panicking, as TryEmit does
+func (this *spoutConnImpl) TryEmitDirect(id string, stream string, directTask int64, contents ...interface{}) error {
+	if err := validateUserId(id); err != nil {
+		return err
 	}
-	this.EmitGeneric("emit", id, stream, "", nil, directTask, this.needTaskIds, contents...)
+	return this.tryEmit(id, stream, directTask, this.needTaskIds, contents)
 }
@@ -0,0 +1,81 @@
+//   Copyright 2013 Vastech SA (PTY) LTD
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package core
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+)
+
+// StreamDeclaration describes an output stream of a component, as it is
+// declared with the OutputFieldsDeclarer of a Java component. Direct
+// streams only accept emissions to a given task.
+type StreamDeclaration struct {
+	Stream string   `json:"stream"`
+	Fields []string `json:"fields"`
+	Direct bool     `json:"direct"`
+}
+
+// OutputDeclarer is implemented by connections that can describe the
+// output streams declared on them, so that a topology that is built
+// dynamically can declare the same streams for the shell component.
+type OutputDeclarer interface {
+	DeclareDirectOutputFields(stream string, fields []string)
+	OutputDeclarations() []StreamDeclaration
+	WriteOutputDeclarations(writer io.Writer) error
+}
+
+// DeclareDirectOutputFields declares the fields of a stream like
+// DeclareOutputFields and marks the stream as direct in the output
+// declarations. Emissions are not checked against the direct flag, since
+// Storm rejects emissions that do not match the declaration of the
+// stream in the topology.
+func (this *stormConnImpl) DeclareDirectOutputFields(stream string, fields []string) {
+	this.DeclareOutputFields(stream, fields)
+	if this.directStreams == nil {
+		this.directStreams = make(map[string]bool)
+	}
+	this.directStreams[streamName(stream)] = true
+}
+
+// OutputDeclarations returns the output streams that have been declared
+// on the connection, sorted by stream name
+func (this *stormConnImpl) OutputDeclarations() []StreamDeclaration {
+	declarations := make([]StreamDeclaration, 0, len(this.outputFields))
+	for stream, fields := range this.outputFields {
+		if fields == nil {
+			fields = []string{}
+		}
+		declarations = append(declarations, StreamDeclaration{
+			Stream: stream,
+			Fields: fields,
+			Direct: this.directStreams[stream],
+		})
+	}
+	sort.Slice(declarations, func(i, j int) bool {
+		return declarations[i].Stream < declarations[j].Stream
+	})
+	return declarations
+}
+
+// WriteOutputDeclarations writes the output declarations of the
+// connection to the given writer as a JSON array of StreamDeclarations,
+// followed by a newline. The writer must not be the output to Storm,
+// which is usually stdout. A file, or another file descriptor that the
+// process inherits from the topology builder, can be used instead.
+func (this *stormConnImpl) WriteOutputDeclarations(writer io.Writer) error {
+	return json.NewEncoder(writer).Encode(this.OutputDeclarations())
+}
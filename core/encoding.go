@@ -18,8 +18,13 @@ import (
 	"fmt"
 	"github.com/jsgilmore/gostorm/messages"
 	"io"
+	"os"
+	"syscall"
 )
 
+// Input reads messages from Storm. ReadMsg and ReadBoltMsg return
+// io.EOF when Storm has closed the stream between messages and
+// io.ErrUnexpectedEOF when the stream ended part way through a message.
 type Input interface {
 	ReadMsg(msg interface{}) (err error)
 	ReadTaskIds() (taskIds []int32)
@@ -32,6 +37,43 @@ type Output interface {
 	Flush()
 }
 
+// CheckedInput is implemented by inputs that return an error instead of
+// panicking when task ids cannot be read, such as when Storm sends a
+// malformed reply.
+type CheckedInput interface {
+	TryReadTaskIds() (taskIds []int32, err error)
+}
+
+// CheckedOutput is implemented by outputs that return an error instead
+// of panicking when the contents of a message cannot be encoded, such as
+// a channel or a function that cannot be marshalled to JSON. Nothing is
+// written when an error is returned, so the output can still be used.
+type CheckedOutput interface {
+	TryEmitGeneric(command, id, stream, msg string, anchors []string, directTask int64, needTaskIds bool, contents ...interface{}) error
+}
+
+// Syncer is implemented by outputs and connections that can commit the
+// messages written to them to stable storage
+type Syncer interface {
+	Sync() error
+}
+
+// SyncWriter commits the data written to the given writer to stable
+// storage if the writer can be synced, such as an *os.File. It does
+// nothing for other writers. Files that cannot be synced, such as pipes
+// and terminals, are treated like other writers.
+func SyncWriter(writer io.Writer) error {
+	syncer, ok := writer.(Syncer)
+	if !ok {
+		return nil
+	}
+	err := syncer.Sync()
+	if pathErr, ok := err.(*os.PathError); ok && pathErr.Err == syscall.EINVAL {
+		return nil
+	}
+	return err
+}
+
 type InputFactory interface {
 	NewInput(reader io.Reader) Input
 }
@@ -84,7 +126,9 @@ func LookupBoltConn(encoding string, reader io.Reader, writer io.Writer) BoltCon
 	output := LookupOutput(encoding, writer)
 	// The default is to not require taskIds
 	// This value can be changed using the conn interface
-	return NewBoltConn(input, output, false)
+	boltConn := NewBoltConn(input, output, false).(*boltConnImpl)
+	boltConn.interrupter, _ = reader.(Interrupter)
+	return boltConn
 }
 
 func LookupSpoutConn(encoding string, reader io.Reader, writer io.Writer) SpoutConn {
@@ -92,5 +136,21 @@ func LookupSpoutConn(encoding string, reader io.Reader, writer io.Writer) SpoutC
 	output := LookupOutput(encoding, writer)
 	// The default is to not require taskIds
 	// This value can be changed using the conn interface
-	return NewSpoutConn(input, output, false)
+	spoutConn := NewSpoutConn(input, output, false).(*spoutConnImpl)
+	spoutConn.interrupter, _ = reader.(Interrupter)
+	return spoutConn
+}
+
+// StdioBoltConn returns a bolt connection with the given encoding that
+// reads from stdin and writes to stdout, which is how Storm communicates
+// with every shell component. Connect performs the handshake with Storm.
+// LookupBoltConn can be used for other readers and writers.
+func StdioBoltConn(encoding string) BoltConn {
+	return LookupBoltConn(encoding, os.Stdin, os.Stdout)
+}
+
+// StdioSpoutConn returns a spout connection with the given encoding that
+// reads from stdin and writes to stdout, as StdioBoltConn does for bolts
+func StdioSpoutConn(encoding string) SpoutConn {
+	return LookupSpoutConn(encoding, os.Stdin, os.Stdout)
 }
@@ -0,0 +1,78 @@
+//   Copyright 2013 Vastech SA (PTY) LTD
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package core
+
+import (
+	"io"
+	"os"
+)
+
+// OpenFixtures returns a reader that reads the given fixture files one
+// after the other, as if they were a single fixture, so that a component
+// can process several files in a single run. The reader only returns
+// io.EOF once the last file has been read. Only the first file holds the
+// handshake, since a connection reads it once, before any tuples. The
+// other files only hold the frames that follow it, and every file has to
+// end after a complete frame, including the "end" line of the JSON
+// encodings. Files are opened when they are reached and closed once they
+// have been read, but OpenFixtures returns an error if any of them
+// cannot be found. Close closes the file that is being read.
+func OpenFixtures(filenames ...string) (io.ReadCloser, error) {
+	for _, filename := range filenames {
+		if _, err := os.Stat(filename); err != nil {
+			return nil, err
+		}
+	}
+	return &fixtureReader{filenames: filenames}, nil
+}
+
+type fixtureReader struct {
+	filenames []string
+	file      *os.File
+}
+
+func (this *fixtureReader) Read(p []byte) (n int, err error) {
+	for {
+		if this.file == nil {
+			if len(this.filenames) == 0 {
+				return 0, io.EOF
+			}
+			this.file, err = os.Open(this.filenames[0])
+			if err != nil {
+				return 0, err
+			}
+			this.filenames = this.filenames[1:]
+		}
+		n, err = this.file.Read(p)
+		if err != io.EOF {
+			return n, err
+		}
+		this.file.Close()
+		this.file = nil
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+func (this *fixtureReader) Close() error {
+	this.filenames = nil
+	if this.file == nil {
+		return nil
+	}
+	err := this.file.Close()
+	this.file = nil
+	return err
+}
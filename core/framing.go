@@ -0,0 +1,215 @@
+//   Copyright 2013 Vastech SA (PTY) LTD
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrMessageTooLarge is returned when a message from Storm exceeds the
+// maximum message size. The stream cannot be read any further, since
+// the rest of the message has not been read.
+var ErrMessageTooLarge = errors.New("Message from Storm exceeds the maximum message size")
+
+// FrameSyncError is returned by a framing when a message is not followed
+// by its delimiter, which means that the stream has lost sync and that
+// the following messages would be misread.
+type FrameSyncError struct {
+	// Frame is the data that was read as the message
+	Frame []byte
+	// Delimiter is what was read instead of the delimiter
+	Delimiter []byte
+}
+
+func (this *FrameSyncError) Error() string {
+	return fmt.Sprintf("core: Expected end statement, received: %q", this.Delimiter)
+}
+
+// FrameResyncer is implemented by framings that can find the boundary
+// of the next message after a FrameSyncError. Resync reads up to and
+// including the next delimiter and returns the data that it skipped.
+type FrameResyncer interface {
+	Resync(reader *bufio.Reader, maxSize int) (skipped [][]byte, err error)
+}
+
+// Resyncer is implemented by inputs, and by the connections that use
+// them, that can recover from a stream that has lost sync. When auto
+// resync is enabled, a message that is not followed by its delimiter, or
+// that cannot be parsed, is logged and skipped, and reading carries on
+// with the message after the next delimiter, instead of returning an
+// error.
+//
+// Resyncing loses data: the malformed message, and any messages that
+// are skipped on the way to the next delimiter, are never seen by the
+// component. This is only safe for at-least-once topologies, where Storm
+// replays the tuples that time out, and is therefore disabled by
+// default. Replies with task ids are not resynced, since skipping one
+// would attribute the task ids of a later emission to the wrong tuple.
+type Resyncer interface {
+	SetAutoResync(enabled bool)
+}
+
+// Framing delimits the messages that text based encodings send to and
+// receive from Storm. ReadFrame returns the next message without its
+// delimiters, io.EOF when the stream was closed between messages and
+// io.ErrUnexpectedEOF when the stream ended part way through a message.
+// If maxSize is larger than zero, ReadFrame returns ErrMessageTooLarge
+// instead of reading a message that is larger than maxSize.
+// Custom framings can be used to interoperate with shell components
+// that do not follow the standard multilang framing.
+type Framing interface {
+	ReadFrame(reader *bufio.Reader, maxSize int) (data []byte, err error)
+	WriteFrame(writer *bufio.Writer, data []byte)
+}
+
+// MessageSizeLimiter is implemented by inputs, and by the connections
+// that use them, that can limit the size of the messages that they read
+// from Storm
+type MessageSizeLimiter interface {
+	SetMaxMessageSize(n int)
+}
+
+// ReadLine reads up to and including the next newline. If maxSize is
+// larger than zero, ErrMessageTooLarge is returned as soon as the line
+// exceeds maxSize, instead of buffering the whole line.
+func ReadLine(reader *bufio.Reader, maxSize int) (line []byte, err error) {
+	for {
+		data, err := reader.ReadSlice('\n')
+		if maxSize > 0 && len(line)+len(data) > maxSize+1 {
+			return nil, ErrMessageTooLarge
+		}
+		line = append(line, data...)
+		if err != bufio.ErrBufferFull {
+			return line, err
+		}
+	}
+}
+
+// NewLineFraming returns the framing of the Storm multilang protocol,
+// which terminates every message with a newline, followed by an "end"
+// statement
+func NewLineFraming() Framing {
+	return lineFraming{}
+}
+
+// NewLengthPrefixedFraming returns a framing that precedes every
+// message with its length instead of following it with an "end"
+// statement
+func NewLengthPrefixedFraming() Framing {
+	return lengthPrefixedFraming{}
+}
+
+// lineFraming terminates every message with a newline, followed by an
+// "end" statement, as required by the Storm multilang protocol
+type lineFraming struct{}
+
+func (this lineFraming) ReadFrame(reader *bufio.Reader, maxSize int) (data []byte, err error) {
+	// Read a single json record from the input file
+	data, err = ReadLine(reader, maxSize)
+	if err == io.EOF && len(data) > 0 {
+		return nil, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return nil, err
+	}
+
+	//Read the end delimiter
+	end, err := ReadLine(reader, maxSize)
+	if err == io.EOF && !isEnd(end) {
+		// The stream ended in the middle of a message, which is not
+		// the same as Storm cleanly closing the stream. An end
+		// statement without a trailing newline still completes the
+		// message.
+		return nil, io.ErrUnexpectedEOF
+	} else if err != nil && err != io.EOF {
+		return nil, err
+	}
+	// Anything other than an end statement means that the stream is out
+	// of sync, in which case all following messages would be misread.
+	if !isEnd(end) {
+		return nil, &FrameSyncError{Frame: bytes.TrimRight(data, "\n"), Delimiter: end}
+	}
+
+	// Remove the newline character
+	data = bytes.TrimRight(data, "\n")
+	return data, nil
+}
+
+// Resync skips lines up to and including the next end statement. A line
+// that was read in place of an end statement may be the first line of
+// the next message, so that message is lost as well.
+func (this lineFraming) Resync(reader *bufio.Reader, maxSize int) (skipped [][]byte, err error) {
+	for {
+		line, err := ReadLine(reader, maxSize)
+		if isEnd(line) && (err == nil || err == io.EOF) {
+			return skipped, nil
+		}
+		if err == io.EOF {
+			return skipped, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return skipped, err
+		}
+		skipped = append(skipped, bytes.TrimRight(line, "\n"))
+	}
+}
+
+// isEnd returns whether a line is the end statement of a message
+func isEnd(line []byte) bool {
+	return bytes.Equal(bytes.TrimSpace(line), []byte("end"))
+}
+
+func (this lineFraming) WriteFrame(writer *bufio.Writer, data []byte) {
+	writer.Write(data)
+	writer.WriteByte('\n')
+	// Storm requires that every message be suffixed with an "end" string
+	writer.WriteString("end\n")
+}
+
+// lengthPrefixedFraming precedes every message with its length, encoded
+// as a varint, in the same way as the protobuf encoding. This framing
+// does not depend on newlines, so it is safe for binary transports, but
+// it is not understood by the standard Storm shell components.
+type lengthPrefixedFraming struct{}
+
+func (this lengthPrefixedFraming) ReadFrame(reader *bufio.Reader, maxSize int) (data []byte, err error) {
+	msgLen, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, err
+	}
+	if maxSize > 0 && msgLen > uint64(maxSize) {
+		return nil, ErrMessageTooLarge
+	}
+	data = make([]byte, msgLen)
+	// ReadFull is required since a bufio reader can return less data
+	// than required in a single read
+	_, err = io.ReadFull(reader, data)
+	if err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (this lengthPrefixedFraming) WriteFrame(writer *bufio.Writer, data []byte) {
+	var msgLen [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(msgLen[:], uint64(len(data)))
+	writer.Write(msgLen[:n])
+	writer.Write(data)
+}
@@ -0,0 +1,79 @@
+//   Copyright 2013 Vastech SA (PTY) LTD
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package core
+
+import (
+	"github.com/jsgilmore/gostorm/messages"
+	"io"
+)
+
+// Hooks contains functions that are called on the protocol operations
+// of a connection, which can be used to feed a metrics backend. Any of
+// the functions may be nil. The hooks are called on the goroutine that
+// performs the operation and should return quickly.
+//
+// OnRead is called for every tuple read by a bolt. OnEmit is called with
+// the stream and number of tuples for every emission. For a bolt, OnAck
+// and OnFail are called for the acks and fails sent to Storm, while for
+// a spout they are called for the acks and fails received from Storm.
+// OnError is called when reading from Storm fails, other than at the
+// end of the input, with the errors returned by the decode hook and
+// with acks and fails that are rejected by ack validation.
+type Hooks struct {
+	OnRead  func(meta *messages.BoltMsgMeta)
+	OnEmit  func(stream string, n int)
+	OnAck   func(id string)
+	OnFail  func(id string)
+	OnError func(err error)
+}
+
+func (this *Hooks) read(meta *messages.BoltMsgMeta) {
+	if this.OnRead != nil {
+		this.OnRead(meta)
+	}
+}
+
+func (this *Hooks) emitted(stream string, n int) {
+	if this.OnEmit != nil {
+		this.OnEmit(streamName(stream), n)
+	}
+}
+
+func (this *Hooks) acked(id string) {
+	if this.OnAck != nil {
+		this.OnAck(id)
+	}
+}
+
+func (this *Hooks) failed(id string) {
+	if this.OnFail != nil {
+		this.OnFail(id)
+	}
+}
+
+func (this *Hooks) error(err error) {
+	if this.OnError != nil {
+		this.OnError(err)
+	}
+}
+
+// readError reports an error to the error hook and returns it, so that
+// it can be used in return statements
+func (this *Hooks) readError(err error) error {
+	if err != io.EOF {
+		this.error(err)
+	}
+	return err
+}
@@ -0,0 +1,66 @@
+//   Copyright 2013 Vastech SA (PTY) LTD
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// NormalizeId returns the canonical form of a tuple id, for comparing ids
+// that were produced by components written in different languages.
+// Storm generates tuple ids as 64-bit integers and sends them to bolts as
+// strings, which is what GoStorm expects, but a component that handles
+// ids as JSON values may quote them again or format them as floats.
+// NormalizeId removes surrounding whitespace and quotes and formats
+// integral numbers without a fraction or exponent, so "\"42\"" and
+// "4.2e1" both become "42". Other ids are returned unchanged.
+//
+// GoStorm always treats ids as opaque strings: anchors and the ids of
+// acks and fails are sent to Storm exactly as given, and Storm only
+// recognises the id as it sent it. The normalized id should therefore
+// only be used for comparison and logging, never for anchoring or acking.
+func NormalizeId(id string) string {
+	normalized := strings.TrimSpace(id)
+	if strings.HasPrefix(normalized, `"`) {
+		var unquoted string
+		if err := json.Unmarshal([]byte(normalized), &unquoted); err == nil {
+			normalized = strings.TrimSpace(unquoted)
+		}
+	}
+	if _, err := strconv.ParseInt(normalized, 10, 64); err == nil {
+		return normalized
+	}
+	if f, err := strconv.ParseFloat(normalized, 64); err == nil && f == float64(int64(f)) {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return normalized
+}
+
+// validateCompletedId returns an error for the id of an ack or fail that
+// Storm cannot match to a tuple. An id that is not in its normalized
+// form is allowed, but a warning is logged, since it is likely to have
+// been converted by a component that treats ids as numbers.
+func validateCompletedId(command, id string) error {
+	if id == "" {
+		return fmt.Errorf("core: Rejected %s with an empty id", command)
+	}
+	if normalized := NormalizeId(id); normalized != id {
+		Logger().Printf("core: The id %q of a %s is not a plain integer and may not match the id of the tuple, which Storm sends as a string such as %q", id, command, normalized)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+//   Copyright 2013 Vastech SA (PTY) LTD
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package core
+
+import (
+	"strconv"
+	"strings"
+)
+
+// KeyedIdPrefix is the prefix of the ids generated by EmitWithKey. Ids
+// with this prefix cannot be passed to the other emit functions.
+const KeyedIdPrefix = "__key-"
+
+// TupleKey is the key of a tuple emitted with EmitWithKey, as it is
+// returned when the tuple is acked or failed. Spouts that replay from a
+// durable log usually use the position in the log as the key, which the
+// conversion functions parse back.
+type TupleKey string
+
+// String returns the key as it was passed to EmitWithKey
+func (this TupleKey) String() string {
+	return string(this)
+}
+
+// Int64 parses the key as a base 10 signed integer, such as an offset
+// that was formatted with strconv.FormatInt
+func (this TupleKey) Int64() (int64, error) {
+	return strconv.ParseInt(string(this), 10, 64)
+}
+
+// Uint64 parses the key as a base 10 unsigned integer
+func (this TupleKey) Uint64() (uint64, error) {
+	return strconv.ParseUint(string(this), 10, 64)
+}
+
+// ParseKey returns the key of a tuple from the id of an ack or fail,
+// and whether the tuple was emitted with EmitWithKey. Spouts that
+// implement gostorm.KeyedSpout receive the key directly, so only other
+// spouts need to parse it.
+func ParseKey(id string) (key TupleKey, ok bool) {
+	if !strings.HasPrefix(id, KeyedIdPrefix) {
+		return "", false
+	}
+	return TupleKey(strings.TrimPrefix(id, KeyedIdPrefix)), true
+}
+
+// KeyedEmitter is implemented by spout connections that can emit tuples
+// with a key instead of an id.
+type KeyedEmitter interface {
+	EmitWithKey(key string, stream string, contents ...interface{}) (taskIds []int32)
+}
+
+// EmitWithKey emits a reliable tuple like Emit, with an id that is
+// derived from the given key. When the tuple is acked or failed, the key
+// is returned by ParseKey, or delivered directly to a gostorm.KeyedSpout.
+// Unlike a tracked emission, nothing is kept for the tuple until it is
+// acked or failed, so a key such as a log offset is all that a replaying
+// spout needs to find the tuple again. Keys do not have to be unique,
+// but the spout cannot tell apart the acks of tuples with the same key.
+func (this *spoutConnImpl) EmitWithKey(key string, stream string, contents ...interface{}) (taskIds []int32) {
+	return this.emitAndRead(KeyedIdPrefix+key, stream, contents)
+}
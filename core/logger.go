@@ -0,0 +1,99 @@
+//   Copyright 2013 Vastech SA (PTY) LTD
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+var (
+	loggerLock sync.RWMutex
+	logger     = log.New(os.Stderr, "", log.LstdFlags)
+)
+
+// SetLogger sets the logger to which GoStorm writes its own diagnostics,
+// such as messages from Storm that could not be unmarshalled. By
+// default, diagnostics are written to stderr. This logger is separate
+// from the Log function of bolt and spout connections, which sends log
+// messages to Storm. Since stdout is used to communicate with Storm,
+// the logger should never write to stdout.
+func SetLogger(l *log.Logger) {
+	loggerLock.Lock()
+	defer loggerLock.Unlock()
+	logger = l
+}
+
+// Logger returns the logger to which GoStorm writes its own diagnostics
+func Logger() *log.Logger {
+	loggerLock.RLock()
+	defer loggerLock.RUnlock()
+	return logger
+}
+
+// LogFieldsSeparator separates the message of a structured log from its
+// fields, as described at FormatLogFields
+const LogFieldsSeparator = "\t"
+
+// FieldLogger is implemented by connections that can send structured
+// logs to Storm.
+type FieldLogger interface {
+	LogFields(msg string, fields map[string]interface{})
+}
+
+// FormatLogFields formats a structured log as the text of a single log
+// message, since the log command of the protocol only carries a string.
+// The message is followed by LogFieldsSeparator, a tab, and the fields
+// as a JSON object on a single line, with its keys sorted:
+//
+//	connection lost\t{"host":"db1","retries":3}
+//
+// Since encoding/json escapes tabs in strings, the fields always follow
+// the last tab of the text, even if the message contains tabs itself.
+// Values that cannot be encoded as JSON, such as channels, are replaced
+// by their text as formatted by fmt. Without fields, the message is
+// returned unchanged.
+func FormatLogFields(msg string, fields map[string]interface{}) string {
+	if len(fields) == 0 {
+		return msg
+	}
+	encoded, err := json.Marshal(fields)
+	if err != nil {
+		printable := make(map[string]interface{}, len(fields))
+		for key, value := range fields {
+			if _, err := json.Marshal(value); err != nil {
+				value = fmt.Sprint(value)
+			}
+			printable[key] = value
+		}
+		encoded, _ = json.Marshal(printable)
+	}
+	return msg + LogFieldsSeparator + string(encoded)
+}
+
+// ParseLogFields splits a log message formatted by FormatLogFields into
+// the message and its fields. It returns false if the text has no
+// fields, in which case the whole text is the message.
+func ParseLogFields(text string) (msg string, fields map[string]interface{}, ok bool) {
+	i := strings.LastIndex(text, LogFieldsSeparator)
+	if i < 0 || json.Unmarshal([]byte(text[i+len(LogFieldsSeparator):]), &fields) != nil || fields == nil {
+		return text, nil, false
+	}
+	return text[:i], fields, true
+}
@@ -0,0 +1,240 @@
+//   Copyright 2013 Vastech SA (PTY) LTD
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package core
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MetricsBucketSizeKey is the configuration key of the interval at which
+// Storm's built-in metrics are reported
+const MetricsBucketSizeKey = "topology.builtin.metrics.bucket.size.secs"
+
+// defaultMetricsInterval is Storm's default metrics bucket size
+const defaultMetricsInterval = 60 * time.Second
+
+// Metric is a value that is reported to Storm periodically. Like the
+// IMetric interface of Java components, ValueAndReset returns the value
+// for the interval that has passed and starts a new interval. It may be
+// called from another goroutine than the one that updates the metric.
+type Metric interface {
+	ValueAndReset() interface{}
+}
+
+// CountMetric is a metric that counts events within an interval. The
+// zero value is a counter at zero. It is safe for concurrent use.
+type CountMetric struct {
+	value int64
+}
+
+// Incr adds one to the count
+func (this *CountMetric) Incr() {
+	atomic.AddInt64(&this.value, 1)
+}
+
+// IncrBy adds n to the count
+func (this *CountMetric) IncrBy(n int64) {
+	atomic.AddInt64(&this.value, n)
+}
+
+// ValueAndReset returns the count as an int64 and resets it to zero
+func (this *CountMetric) ValueAndReset() interface{} {
+	return atomic.SwapInt64(&this.value, 0)
+}
+
+// MetricFunc is a metric of which the value is returned by a function,
+// such as a gauge that reports the length of a queue
+type MetricFunc func() interface{}
+
+// ValueAndReset returns the value returned by the function
+func (this MetricFunc) ValueAndReset() interface{} {
+	return this()
+}
+
+// MetricsSender is implemented by outputs that can send metrics to
+// Storm. Every metrics message updates the metric with the given name
+// that is registered with the shell component on the Java side.
+type MetricsSender interface {
+	SendMetrics(name string, params interface{})
+}
+
+// MetricsReporter is implemented by connections that can report metrics
+// to Storm.
+type MetricsReporter interface {
+	ReportMetric(name string, params interface{}) error
+	RegisterMetric(name string, metric Metric)
+	StartMetrics(interval time.Duration) (stop func())
+}
+
+// metricsLoop holds the registered metrics of a connection and the state
+// of the goroutine that reports them
+type metricsLoop struct {
+	lock    sync.Mutex
+	metrics map[string]Metric
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// ReportMetric sends the given parameters to the metric with the given
+// name, which has to be registered as an IShellMetric of the shell
+// component in the topology. Storm kills the worker if no metric with
+// the name is registered. An error is returned if the output does not
+// support metrics. ReportMetric may be called from any goroutine.
+func (this *stormConnImpl) ReportMetric(name string, params interface{}) error {
+	sender, ok := this.Output.(MetricsSender)
+	if !ok {
+		return fmt.Errorf("Output %T does not support metrics", this.Output)
+	}
+	this.outputLock.Lock()
+	defer this.outputLock.Unlock()
+	sender.SendMetrics(name, params)
+	this.Output.Flush()
+	return nil
+}
+
+// RegisterMetric registers a metric that is reported under the given
+// name by the loop started with StartMetrics. Registering a metric under
+// a name that is already registered replaces it.
+func (this *stormConnImpl) RegisterMetric(name string, metric Metric) {
+	this.metrics.lock.Lock()
+	defer this.metrics.lock.Unlock()
+	if this.metrics.metrics == nil {
+		this.metrics.metrics = make(map[string]Metric)
+	}
+	this.metrics.metrics[name] = metric
+}
+
+// StartMetrics starts a goroutine that reports every registered metric
+// at the given interval, in the order of their names. An interval of
+// zero reports metrics at the interval of Storm's built-in metrics,
+// topology.builtin.metrics.bucket.size.secs, or every minute if it is
+// not configured. Messages sent by the goroutine never interleave with
+// the messages of the connection, since all messages are written under
+// the same lock. Errors are logged and passed to the OnError hook. The
+// returned function stops the goroutine and waits for it to exit. Close
+// stops the goroutine as well.
+func (this *stormConnImpl) StartMetrics(interval time.Duration) (stop func()) {
+	if interval <= 0 {
+		interval = defaultMetricsInterval
+		if this.context != nil {
+			if secs, ok := this.context.ConfInt(MetricsBucketSizeKey); ok && secs > 0 {
+				interval = time.Duration(secs) * time.Second
+			}
+		}
+	}
+	this.stopMetrics()
+	this.metrics.lock.Lock()
+	stopping := make(chan struct{})
+	done := make(chan struct{})
+	this.metrics.stop, this.metrics.done = stopping, done
+	this.metrics.lock.Unlock()
+
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				this.reportMetrics()
+			case <-stopping:
+				return
+			}
+		}
+	}()
+	return this.stopMetrics
+}
+
+// stopMetrics stops the metrics goroutine, if it is running, and waits
+// for it to exit
+func (this *stormConnImpl) stopMetrics() {
+	this.metrics.lock.Lock()
+	stopping, done := this.metrics.stop, this.metrics.done
+	this.metrics.stop, this.metrics.done = nil, nil
+	this.metrics.lock.Unlock()
+	if stopping != nil {
+		close(stopping)
+		<-done
+	}
+}
+
+// reportMetrics reports the value of every registered metric
+func (this *stormConnImpl) reportMetrics() {
+	this.metrics.lock.Lock()
+	names := make([]string, 0, len(this.metrics.metrics))
+	for name := range this.metrics.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	metrics := make([]Metric, len(names))
+	for i, name := range names {
+		metrics[i] = this.metrics.metrics[name]
+	}
+	this.metrics.lock.Unlock()
+
+	for i, metric := range metrics {
+		if err := this.ReportMetric(names[i], metric.ValueAndReset()); err != nil {
+			Logger().Printf("core: Reporting metric %s: %v", names[i], err)
+			this.hooks.error(err)
+		}
+	}
+}
+
+// StatsMetric is a metric that reports the Stats of a connection for
+// the interval that has passed, as a map of counter names to counts:
+// "acked", "failed", "read" and "emitted.<stream>" for every stream that
+// has been emitted to. Every report starts a new interval, while the
+// counters returned by Stats keep counting from the creation of the
+// connection. Registering a StatsMetric and calling StartMetrics reports
+// the stats of a component periodically:
+//
+//	reporter.RegisterMetric("stats", core.NewStatsMetric(conn.(core.StatsReporter)))
+//	stop := reporter.StartMetrics(0)
+type StatsMetric struct {
+	reporter StatsReporter
+	lock     sync.Mutex
+	last     *Stats
+}
+
+// NewStatsMetric returns a StatsMetric of the given connection, of which
+// the first interval starts now
+func NewStatsMetric(reporter StatsReporter) *StatsMetric {
+	return &StatsMetric{
+		reporter: reporter,
+		last:     reporter.Stats(),
+	}
+}
+
+// ValueAndReset returns the counts of the interval that has passed as a
+// map[string]uint64 and starts a new interval
+func (this *StatsMetric) ValueAndReset() interface{} {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	stats := this.reporter.Stats()
+	value := map[string]uint64{
+		"acked":  stats.Acked - this.last.Acked,
+		"failed": stats.Failed - this.last.Failed,
+		"read":   stats.Read - this.last.Read,
+	}
+	for stream, count := range stats.EmittedByStream {
+		value["emitted."+stream] = count - this.last.EmittedByStream[stream]
+	}
+	this.last = stats
+	return value
+}
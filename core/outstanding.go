@@ -0,0 +1,92 @@
+//   Copyright 2013 Vastech SA (PTY) LTD
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package core
+
+import (
+	"container/list"
+	"sync"
+)
+
+// outstandingIds tracks the ids of tuples that have been read, but not
+// yet acked or failed. Once the limit is reached, the oldest ids are
+// no longer tracked as outstanding, but are remembered as evicted, so
+// that they can still be acked or failed. Once more than limit ids have
+// been evicted, ids can no longer be validated. The ids are safe for
+// concurrent use, since tuples may be read on a separate goroutine.
+type outstandingIds struct {
+	lock     sync.Mutex
+	limit    int
+	order    *list.List
+	ids      map[string]*list.Element
+	evicted  map[string]struct{}
+	overflow bool
+}
+
+func newOutstandingIds(limit int) *outstandingIds {
+	return &outstandingIds{
+		limit:   limit,
+		order:   list.New(),
+		ids:     make(map[string]*list.Element),
+		evicted: make(map[string]struct{}),
+	}
+}
+
+func (this *outstandingIds) add(id string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if _, ok := this.ids[id]; ok {
+		return
+	}
+	if this.order.Len() >= this.limit {
+		oldest := this.order.Remove(this.order.Front()).(string)
+		delete(this.ids, oldest)
+		this.evict(oldest)
+	}
+	this.ids[id] = this.order.PushBack(id)
+}
+
+// evict remembers an id that is no longer tracked as outstanding
+func (this *outstandingIds) evict(id string) {
+	if this.overflow {
+		return
+	}
+	if len(this.evicted) >= this.limit {
+		this.overflow = true
+		this.evicted = nil
+		return
+	}
+	this.evicted[id] = struct{}{}
+}
+
+// remove removes the id and returns whether it may be acked or failed,
+// which is the case if it was outstanding or evicted, or if ids can no
+// longer be validated
+func (this *outstandingIds) remove(id string) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if e, ok := this.ids[id]; ok {
+		this.order.Remove(e)
+		delete(this.ids, id)
+		return true
+	}
+	if this.overflow {
+		return true
+	}
+	if _, ok := this.evicted[id]; ok {
+		delete(this.evicted, id)
+		return true
+	}
+	return false
+}
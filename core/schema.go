@@ -0,0 +1,106 @@
+//   Copyright 2013 Vastech SA (PTY) LTD
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package core
+
+import (
+	"fmt"
+	"github.com/jsgilmore/gostorm/messages"
+	"reflect"
+)
+
+// SchemaValidator is implemented by bolt connections that can validate
+// the tuples that they read against the kinds of fields expected on a
+// stream.
+type SchemaValidator interface {
+	RegisterInputSchema(stream string, kinds []reflect.Kind)
+}
+
+// RegisterInputSchema registers the kinds of the fields of the tuples
+// that are expected on the given stream, of any component. Once a schema
+// has been registered for a stream, every tuple read from it is checked
+// after it has been decoded, before the decode hook is called. A tuple
+// that does not match is rejected: it is failed, the mismatch is
+// reported to Storm with ReportError, and ReadBoltMsg continues with the
+// next tuple, so the bolt never sees it.
+//
+// Fields are checked by position, and only those for which a kind is
+// registered. The kind of a field is that of the value it was decoded
+// into: the dynamic value for fields decoded into an interface{}, and
+// the pointed to value otherwise. A field decoded into an interface{}
+// that remains nil, because the tuple has fewer fields or the field is
+// null, only matches reflect.Interface. Since JSON numbers are decoded as
+// float64 values, they match every integer kind as long as they have no
+// fractional part, as well as both float kinds. Fields beyond the last
+// registered kind are not checked. Registering a nil schema removes it.
+// Streams without a schema are not checked. Schemas have to be
+// registered before tuples are read, since ReadTuples reads them on a
+// separate goroutine.
+func (this *boltConnImpl) RegisterInputSchema(stream string, kinds []reflect.Kind) {
+	if kinds == nil {
+		delete(this.inputSchemas, streamName(stream))
+		return
+	}
+	if this.inputSchemas == nil {
+		this.inputSchemas = make(map[string][]reflect.Kind)
+	}
+	this.inputSchemas[streamName(stream)] = kinds
+}
+
+// validateSchema returns an error if the decoded contents of a tuple do
+// not match the schema registered for its stream
+func (this *boltConnImpl) validateSchema(meta *messages.BoltMsgMeta, contents []interface{}) error {
+	kinds, ok := this.inputSchemas[streamName(meta.Stream)]
+	if !ok {
+		return nil
+	}
+	if len(contents) < len(kinds) {
+		return fmt.Errorf("Tuple %s on stream %s was read into %d fields, while its schema has %d fields", meta.Id, streamName(meta.Stream), len(contents), len(kinds))
+	}
+	for i, kind := range kinds {
+		if !kindMatches(contents[i], kind) {
+			return fmt.Errorf("Tuple %s from %s on stream %s does not match its schema: field %d is not a %v", meta.Id, meta.Comp, streamName(meta.Stream), i, kind)
+		}
+	}
+	return nil
+}
+
+// kindMatches returns whether a decoded field is of the given kind
+func kindMatches(field interface{}, kind reflect.Kind) bool {
+	value := reflect.ValueOf(field)
+	for value.Kind() == reflect.Ptr && !value.IsNil() {
+		value = value.Elem()
+	}
+	if value.Kind() == reflect.Interface {
+		if value.IsNil() {
+			return kind == reflect.Interface
+		}
+		value = value.Elem()
+	}
+	if value.Kind() == kind {
+		return true
+	}
+	if value.Kind() != reflect.Float64 {
+		return false
+	}
+	switch kind {
+	case reflect.Float32:
+		return true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		f := value.Float()
+		return f == float64(int64(f))
+	}
+	return false
+}
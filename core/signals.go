@@ -0,0 +1,73 @@
+//   Copyright 2013 Vastech SA (PTY) LTD
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package core
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// HandleSignals returns a reader that reads from the given reader until
+// the process receives SIGTERM or SIGINT, or the context is cancelled.
+// From then on, reads return io.EOF, so that a component stops reading
+// tuples and exits as if Storm had closed the stream. The shell bolt and
+// spout then clean up, after which closing the connection flushes any
+// pending output and removes the pid file.
+//
+// Messages that the input has already buffered in full are still read,
+// but nothing more is read from the given reader. A message that has
+// only partly arrived when the signal is received is dropped: the
+// connections returned by LookupBoltConn and LookupSpoutConn report it
+// as io.EOF instead of io.ErrUnexpectedEOF, since the reader implements
+// Interrupter. A spout only reads from Storm after it has synced, so it
+// always finishes its current NextTuple, Acked or Failed call and the
+// sync that follows before exiting.
+func HandleSignals(ctx context.Context, reader io.Reader) TimeoutReader {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-signals:
+		case <-ctx.Done():
+		}
+		signal.Stop(signals)
+		close(done)
+	}()
+	return &timeoutReaderImpl{
+		reader: reader,
+		done:   done,
+	}
+}
+
+// Interrupter is implemented by readers that can be ended deliberately,
+// such as the reader returned by HandleSignals
+type Interrupter interface {
+	Interrupted() bool
+}
+
+// Interrupted reports whether reading has been ended by a signal or by
+// the cancellation of the context passed to HandleSignals
+func (this *timeoutReaderImpl) Interrupted() bool {
+	select {
+	case <-this.done:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,91 @@
+//   Copyright 2013 Vastech SA (PTY) LTD
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package core
+
+import (
+	"fmt"
+)
+
+// SpoutState is the state of a spout connection in the multilang
+// protocol. Storm drives a spout by sending it one command at a time
+// and waiting for a sync in reply:
+//
+//	SpoutUninitialised --Connect--> SpoutAwaitingCommand
+//	SpoutAwaitingCommand --ReadSpoutMsg--> SpoutHandlingCommand
+//	SpoutHandlingCommand --SendSync--> SpoutAwaitingCommand
+//
+// Tuples can only be emitted in SpoutHandlingCommand, that is between
+// reading a next, ack or fail and sending the sync for it. Any number of
+// tuples can be emitted in this window, so a batch of tuples can be
+// emitted for a single next, followed by a single sync. Storm buffers
+// emissions until it reads the sync, so tuples emitted after the sync
+// would be read as part of the reply to the following command.
+//
+// Acks and fails are commands like next, so a spout may emit while
+// handling them, for instance to retry a failed tuple. Storm sends the
+// ack or fail for a tuple only after the sync that ended the turn in
+// which it was emitted, so an ack never interleaves with the emissions
+// of a turn.
+//
+// A sync is only valid in SpoutHandlingCommand as well: Storm expects
+// exactly one sync per command, and an extra sync would be read as the
+// reply to the following command. SendSync does not check the state, so
+// that existing callers that sync on their own keep working, but
+// TrySendSync of the CheckedSyncer interface returns a *SpoutStateError
+// for a sync that is out of sequence.
+type SpoutState int
+
+const (
+	SpoutUninitialised SpoutState = iota
+	SpoutAwaitingCommand
+	SpoutHandlingCommand
+)
+
+func (this SpoutState) String() string {
+	switch this {
+	case SpoutUninitialised:
+		return "uninitialised"
+	case SpoutAwaitingCommand:
+		return "awaiting command"
+	case SpoutHandlingCommand:
+		return "handling command"
+	}
+	return fmt.Sprintf("SpoutState(%d)", int(this))
+}
+
+// SpoutStater is implemented by spout connections that report the state
+// of the protocol.
+type SpoutStater interface {
+	State() SpoutState
+}
+
+// CheckedSyncer is implemented by spout connections that return an error
+// instead of sending a sync that is out of sequence.
+type CheckedSyncer interface {
+	TrySendSync() error
+}
+
+// SpoutStateError is the error for an operation that is not allowed in
+// the current state of a spout connection, such as an emit after the
+// sync for the last command has been sent.
+type SpoutStateError struct {
+	Op       string
+	State    SpoutState
+	Expected SpoutState
+}
+
+func (this *SpoutStateError) Error() string {
+	return fmt.Sprintf("Spout cannot %s while %s, only while %s", this.Op, this.State, this.Expected)
+}
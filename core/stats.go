@@ -0,0 +1,138 @@
+//   Copyright 2013 Vastech SA (PTY) LTD
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package core
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Stats contains counters of the messages that a connection has
+// exchanged with Storm since it was created. For a bolt, Acked and
+// Failed count the acks and fails sent to Storm, while for a spout they
+// count the acks and fails received from Storm. Read counts the tuples
+// read by a bolt and the commands read by a spout. AckLatency is only
+// counted by bolts that track latency.
+type Stats struct {
+	EmittedByStream map[string]uint64
+	Acked           uint64
+	Failed          uint64
+	Read            uint64
+	AckLatency      []LatencyBucket
+}
+
+// LatencyBucket counts the tuples that were acked more than the upper
+// bound of the previous bucket, but at most Le, after they were read
+type LatencyBucket struct {
+	Le    time.Duration
+	Count uint64
+}
+
+var latencyBounds = [...]time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+	10 * time.Second,
+	math.MaxInt64,
+}
+
+// stats holds the counters of a connection. They are updated by the
+// goroutines that read from and write to Storm and may be read by any
+// other goroutine, so every counter is guarded by the same lock, which
+// ensures that a snapshot never holds counters that were updated by
+// different halves of a single update.
+type stats struct {
+	lock    sync.Mutex
+	acked   uint64
+	failed  uint64
+	read    uint64
+	latency [len(latencyBounds)]uint64
+	emitted map[string]uint64
+}
+
+func newStats() *stats {
+	return &stats{
+		emitted: make(map[string]uint64),
+	}
+}
+
+func (this *stats) addEmitted(stream string) {
+	this.lock.Lock()
+	this.emitted[streamName(stream)]++
+	this.lock.Unlock()
+}
+
+func (this *stats) addAcked() {
+	this.lock.Lock()
+	this.acked++
+	this.lock.Unlock()
+}
+
+// addAckedWithLatency counts an ack of a tuple that was acked the given
+// time after it was read
+func (this *stats) addAckedWithLatency(latency time.Duration) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.acked++
+	for i, bound := range latencyBounds {
+		if latency <= bound {
+			this.latency[i]++
+			return
+		}
+	}
+}
+
+func (this *stats) addFailed() {
+	this.lock.Lock()
+	this.failed++
+	this.lock.Unlock()
+}
+
+func (this *stats) addRead() {
+	this.lock.Lock()
+	this.read++
+	this.lock.Unlock()
+}
+
+// snapshot returns a copy of the counters, which is consistent: every
+// update is either fully included or not at all
+func (this *stats) snapshot() *Stats {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	emitted := make(map[string]uint64, len(this.emitted))
+	for stream, count := range this.emitted {
+		emitted[stream] = count
+	}
+	latency := make([]LatencyBucket, len(latencyBounds))
+	for i, bound := range latencyBounds {
+		latency[i] = LatencyBucket{
+			Le:    bound,
+			Count: this.latency[i],
+		}
+	}
+	return &Stats{
+		EmittedByStream: emitted,
+		Acked:           this.acked,
+		Failed:          this.failed,
+		Read:            this.read,
+		AckLatency:      latency,
+	}
+}
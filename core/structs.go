@@ -0,0 +1,61 @@
+//   Copyright 2013 Vastech SA (PTY) LTD
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package core
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// structFields returns the values of the exported fields of a struct in
+// declaration order. Fields tagged with `storm:"-"` are skipped. Nested
+// structs are returned as they are, so that they are encoded as objects.
+func structFields(v interface{}) []interface{} {
+	fields, err := tryStructFields(v)
+	if err != nil {
+		panic(err.Error())
+	}
+	return fields
+}
+
+// tryStructFields returns the fields of a struct like structFields, but
+// returns an error instead of panicking if v is not a struct
+func tryStructFields(v interface{}) ([]interface{}, error) {
+	value := reflect.Indirect(reflect.ValueOf(v))
+	if value.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("Emitting a %T as a struct", v)
+	}
+	indices := tupleFieldIndices(value.Type())
+	fields := make([]interface{}, len(indices))
+	for i, index := range indices {
+		fields[i] = value.Field(index).Interface()
+	}
+	return fields, nil
+}
+
+// tupleFieldIndices returns the indices of the fields of a struct type
+// that are mapped to the fields of a tuple, which are its exported fields
+// that are not tagged with `storm:"-"`
+func tupleFieldIndices(structType reflect.Type) []int {
+	indices := make([]int, 0, structType.NumField())
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		if field.PkgPath != "" || field.Tag.Get("storm") == "-" {
+			continue
+		}
+		indices = append(indices, i)
+	}
+	return indices
+}
@@ -0,0 +1,203 @@
+//   Copyright 2013 Vastech SA (PTY) LTD
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package core
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrReadTimeout is returned by a TimeoutReader if no data was
+// received within the read timeout
+var ErrReadTimeout = errors.New("Timed out waiting for data from Storm")
+
+// TimeoutReader is a reader that returns ErrReadTimeout if no data
+// arrives within the specified read timeout. This allows a component to
+// detect that the Storm supervisor has died, instead of blocking on its
+// input forever. Since stdin does not support read deadlines, the
+// underlying reader is read from a background goroutine.
+type TimeoutReader interface {
+	io.Reader
+	SetReadTimeout(d time.Duration)
+}
+
+type readResult struct {
+	data []byte
+	err  error
+}
+
+// NewTimeoutReader returns a TimeoutReader that reads from the given
+// reader. By default, no read timeout is set.
+func NewTimeoutReader(reader io.Reader) TimeoutReader {
+	return &timeoutReaderImpl{
+		reader: reader,
+	}
+}
+
+type timeoutReaderImpl struct {
+	reader  io.Reader
+	results chan readResult
+	pending []byte
+	err     error
+	timeout time.Duration
+	done    <-chan struct{}
+}
+
+// SetReadTimeout sets the time that a read waits for data before
+// returning ErrReadTimeout. A timeout of zero disables the timeout.
+// A timeout is fatal: all following reads return ErrReadTimeout, since
+// the message that was being read when the timeout occurred would be
+// incomplete.
+func (this *timeoutReaderImpl) SetReadTimeout(d time.Duration) {
+	this.timeout = d
+}
+
+func (this *timeoutReaderImpl) readLoop() {
+	for {
+		data := make([]byte, 4096)
+		n, err := this.reader.Read(data)
+		this.results <- readResult{data: data[:n], err: err}
+		if err != nil {
+			close(this.results)
+			return
+		}
+	}
+}
+
+func (this *timeoutReaderImpl) Read(p []byte) (n int, err error) {
+	if len(this.pending) == 0 {
+		if this.err != nil {
+			return 0, this.err
+		}
+		if this.results == nil {
+			this.results = make(chan readResult, 1)
+			go this.readLoop()
+		}
+
+		var timeout <-chan time.Time
+		if this.timeout > 0 {
+			timer := time.NewTimer(this.timeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+
+		var result readResult
+		select {
+		case result = <-this.results:
+		case <-timeout:
+			this.err = ErrReadTimeout
+			return 0, ErrReadTimeout
+		case <-this.done:
+			this.err = io.EOF
+			return 0, io.EOF
+		}
+		this.pending = result.data
+		this.err = result.err
+	}
+
+	n = copy(p, this.pending)
+	this.pending = this.pending[n:]
+	if len(this.pending) == 0 && this.err != nil {
+		return n, this.err
+	}
+	return n, nil
+}
+
+// TaskIdsTimeoutSetter is implemented by connections that can limit the
+// time that an emission waits for Storm to reply with its task ids.
+type TaskIdsTimeoutSetter interface {
+	SetTaskIdsTimeout(d time.Duration)
+}
+
+// SetTaskIdsTimeout sets the time that an emission waits for Storm to
+// reply with the task ids to which the tuple was sent. Unlike the other
+// reads, this read happens inside the emit functions, so a reply that
+// never arrives, such as when the worker is being shut down, would hang
+// the component in a call that it does not control. If the reply does
+// not arrive in time, TryEmit returns ErrReadTimeout, while the emit
+// functions that do not return an error panic with it. A timeout of
+// zero, which is the default, waits forever.
+//
+// Like the timeout of a TimeoutReader, this timeout is fatal: the reply
+// may still arrive later, so every following read from Storm returns
+// ErrReadTimeout. It applies only to task ids, so it can be shorter than
+// the read timeout of a TimeoutReader that the connection reads from,
+// which also applies to reading tuples and commands, and which has to
+// allow for the time between tuples. If the read timeout of the reader
+// expires first, TryEmit returns ErrReadTimeout as well.
+func (this *stormConnImpl) SetTaskIdsTimeout(d time.Duration) {
+	this.taskIdsTimeout = d
+}
+
+// readTaskIdsWithin reads task ids from Storm, returning ErrReadTimeout
+// if they are not received within the given timeout. Reading continues
+// on a separate goroutine after a timeout, which is why the connection
+// fails every read after it. A timeout of zero waits forever.
+func (this *stormConnImpl) readTaskIdsWithin(timeout time.Duration) (taskIds []int32, err error) {
+	if this.readErr != nil {
+		return nil, this.readErr
+	}
+	this.Flush()
+	if timeout <= 0 {
+		return this.readTaskIdsOrTimeout()
+	}
+	type result struct {
+		taskIds []int32
+		err     error
+		panic   interface{}
+	}
+	results := make(chan result, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				results <- result{panic: r}
+			}
+		}()
+		taskIds, err := this.readTaskIdsOrTimeout()
+		results <- result{taskIds: taskIds, err: err}
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case r := <-results:
+		if r.panic != nil {
+			panic(r.panic)
+		}
+		return r.taskIds, r.err
+	case <-timer.C:
+		this.readErr = ErrReadTimeout
+		return nil, ErrReadTimeout
+	}
+}
+
+// readTaskIdsOrTimeout reads task ids from the input. A CheckedInput
+// returns every error. Other inputs panic if the read fails, and
+// ErrReadTimeout is returned instead of panicking if they timed out.
+// The output has to be flushed before.
+func (this *stormConnImpl) readTaskIdsOrTimeout() (taskIds []int32, err error) {
+	if input, ok := this.Input.(CheckedInput); ok {
+		return input.TryReadTaskIds()
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			if r != ErrReadTimeout {
+				panic(r)
+			}
+			err = ErrReadTimeout
+		}
+	}()
+	return this.Input.ReadTaskIds(), nil
+}
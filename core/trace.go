@@ -0,0 +1,165 @@
+//   Copyright 2013 Vastech SA (PTY) LTD
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// TraceIn is the direction of frames read from Storm
+	TraceIn = "in"
+	// TraceOut is the direction of frames sent to Storm
+	TraceOut = "out"
+)
+
+// Tracer is implemented by inputs and outputs that can write the frames
+// that they exchange with Storm to a trace
+type Tracer interface {
+	SetTrace(trace *Trace)
+}
+
+// Trace writes the protocol frames exchanged with Storm to a trace
+// writer and the frames read from Storm to a recording writer. In the
+// trace, every frame is preceded by a line with the time at which it
+// was read or sent, its direction and its length in bytes, after which
+// the frame follows exactly as it appears on the wire, including any
+// delimiters. The recording only contains the frames read from Storm,
+// exactly as they appeared on the wire, so it can be used as the input
+// of a connection. A trace may be shared by an input and an output. The
+// methods of a nil trace do nothing, so that encodings do not need to
+// check whether tracing is enabled.
+type Trace struct {
+	lock     sync.Mutex
+	writer   io.Writer
+	recorder io.Writer
+}
+
+// NewTrace returns a trace that writes to the given trace writer. The
+// writes are made while messages are exchanged with Storm, so a slow
+// writer should be buffered.
+func NewTrace(writer io.Writer) *Trace {
+	return &Trace{
+		writer: writer,
+	}
+}
+
+// SetWriter sets the writer to which all frames are written along with
+// their headers
+func (this *Trace) SetWriter(writer io.Writer) {
+	this.lock.Lock()
+	this.writer = writer
+	this.lock.Unlock()
+}
+
+// SetRecorder sets the writer to which the frames read from Storm are
+// written without headers
+func (this *Trace) SetRecorder(recorder io.Writer) {
+	this.lock.Lock()
+	this.recorder = recorder
+	this.lock.Unlock()
+}
+
+// Frame writes a frame in its wire format to the trace
+func (this *Trace) Frame(direction string, frame []byte) {
+	if this == nil {
+		return
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.writer != nil {
+		_, err := fmt.Fprintf(this.writer, "%s %s %d\n", time.Now().Format(time.RFC3339Nano), direction, len(frame))
+		if err == nil {
+			_, err = this.writer.Write(frame)
+		}
+		if err != nil {
+			Logger().Printf("core: Writing trace: %v", err)
+		}
+	}
+	if this.recorder != nil && direction == TraceIn {
+		_, err := this.recorder.Write(frame)
+		if err != nil {
+			Logger().Printf("core: Writing recording: %v", err)
+		}
+	}
+}
+
+// WriteFrame writes the data, delimited by the given framing, to the
+// trace
+func (this *Trace) WriteFrame(direction string, framing Framing, data []byte) {
+	if this == nil {
+		return
+	}
+	frame := &bytes.Buffer{}
+	writer := bufio.NewWriter(frame)
+	framing.WriteFrame(writer, data)
+	writer.Flush()
+	this.Frame(direction, frame.Bytes())
+}
+
+// NewReplayReader returns a reader of the frames that were read from
+// Storm in the given trace, without their headers. This allows a trace
+// to be replayed as the input of a connection.
+func NewReplayReader(trace io.Reader) io.Reader {
+	return &replayReader{
+		trace: bufio.NewReader(trace),
+	}
+}
+
+type replayReader struct {
+	trace   *bufio.Reader
+	pending []byte
+}
+
+func (this *replayReader) Read(p []byte) (n int, err error) {
+	for len(this.pending) == 0 {
+		header, err := this.trace.ReadString('\n')
+		if err == io.EOF && len(header) == 0 {
+			return 0, io.EOF
+		} else if err == io.EOF {
+			return 0, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return 0, err
+		}
+		parts := strings.Fields(header)
+		if len(parts) != 3 {
+			return 0, fmt.Errorf("core: Invalid trace header: %q", header)
+		}
+		length, err := strconv.Atoi(parts[2])
+		if err != nil {
+			return 0, fmt.Errorf("core: Invalid trace header: %q", header)
+		}
+		frame := make([]byte, length)
+		_, err = io.ReadFull(this.trace, frame)
+		if err == io.EOF {
+			return 0, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return 0, err
+		}
+		if parts[1] == TraceIn {
+			this.pending = frame
+		}
+	}
+	n = copy(p, this.pending)
+	this.pending = this.pending[n:]
+	return n, nil
+}
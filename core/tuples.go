@@ -0,0 +1,334 @@
+//   Copyright 2013 Vastech SA (PTY) LTD
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package core
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/jsgilmore/gostorm/messages"
+	"io"
+	"math"
+	"reflect"
+	"strings"
+	"time"
+)
+
+const (
+	// TickStream is the stream on which Storm sends tick tuples to
+	// components that set topology.tick.tuple.freq.secs
+	TickStream = "__tick"
+	// SystemComponent is the component from which Storm sends tick
+	// tuples
+	SystemComponent = "__system"
+	// HeartbeatStream is the stream on which Storm sends heartbeats to
+	// shell bolts, which have to be answered with a sync
+	HeartbeatStream = "__heartbeat"
+	// SystemStream is the stream on which Storm's system bolt sends
+	// coordination tuples
+	SystemStream = "__system"
+	// MetricsStream is the stream on which Storm sends metrics to the
+	// metrics consumers of the topology
+	MetricsStream = "__metrics"
+	// ReservedStreamPrefix is the prefix of the streams that Storm
+	// reserves for its own use, as described at IsReservedStream
+	ReservedStreamPrefix = "__"
+)
+
+// IsReservedStream returns whether the given stream is reserved by
+// Storm, such as SystemStream, TickStream, MetricsStream and
+// HeartbeatStream. Emitting on a reserved stream that has not been
+// declared with DeclareOutputFields is rejected, so that a stream name
+// cannot collide with Storm's streams by accident. Components that take
+// part in Storm's coordination can emit on these streams once they have
+// declared them, as the topology has to do for the shell component.
+func IsReservedStream(stream string) bool {
+	return strings.HasPrefix(stream, ReservedStreamPrefix)
+}
+
+// Tuple is a tuple received from Storm along with its metadata. Names
+// holds the names of the fields, if they have been declared as input
+// fields of the bolt.
+type Tuple struct {
+	Meta     messages.BoltMsgMeta
+	Fields   []interface{}
+	Names    []string
+	readTime time.Time
+}
+
+// Get returns the field with the given name, which is the object that
+// the field was decoded into. Fields are matched to names by position.
+// Nil is returned if the name is unknown, if no names were declared for
+// the tuple's component and stream, and if the name is declared at a
+// position beyond the last field. Fields beyond the last declared name
+// can only be accessed through Fields.
+func (this *Tuple) Get(name string) interface{} {
+	for i, fieldName := range this.Names {
+		if fieldName == name {
+			if i < len(this.Fields) {
+				return this.Fields[i]
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+// The typed accessors below return the field at the given index as a
+// value of their type. Fields are usually pointers to the objects they
+// were decoded into, which are dereferenced, so both a *string and a
+// *interface{} holding a string can be read with String. Unlike a type
+// assertion on Fields, they return an error instead of panicking if the
+// index is out of range, the field is nil or its type does not match.
+
+// String returns the field at the given index as a string. Byte slices
+// are converted to strings.
+func (this *Tuple) String(i int) (string, error) {
+	value, err := this.field(i)
+	if err != nil {
+		return "", err
+	}
+	if value.Kind() == reflect.String {
+		return value.String(), nil
+	}
+	if value.Kind() == reflect.Slice && value.Type().Elem().Kind() == reflect.Uint8 {
+		return string(value.Bytes()), nil
+	}
+	return "", this.typeError(i, value, "string")
+}
+
+// Int64 returns the field at the given index as an int64. Since JSON
+// numbers are decoded into float64s, floats and json.Numbers without a
+// fractional part are converted, as long as they fit in an int64.
+func (this *Tuple) Int64(i int) (int64, error) {
+	value, err := this.field(i)
+	if err != nil {
+		return 0, err
+	}
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return value.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if value.Uint() <= math.MaxInt64 {
+			return int64(value.Uint()), nil
+		}
+	case reflect.Float32, reflect.Float64:
+		f := value.Float()
+		// float64(math.MaxInt64) rounds up to 2^63, which does not fit
+		if f == math.Trunc(f) && f >= math.MinInt64 && f < math.MaxInt64 {
+			return int64(f), nil
+		}
+	case reflect.String:
+		if number, ok := value.Interface().(json.Number); ok {
+			if n, err := number.Int64(); err == nil {
+				return n, nil
+			}
+		}
+	}
+	return 0, this.typeError(i, value, "int64")
+}
+
+// Float64 returns the field at the given index as a float64. Integers
+// and json.Numbers are converted.
+func (this *Tuple) Float64(i int) (float64, error) {
+	value, err := this.field(i)
+	if err != nil {
+		return 0, err
+	}
+	switch value.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return value.Float(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(value.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return float64(value.Uint()), nil
+	case reflect.String:
+		if number, ok := value.Interface().(json.Number); ok {
+			if f, err := number.Float64(); err == nil {
+				return f, nil
+			}
+		}
+	}
+	return 0, this.typeError(i, value, "float64")
+}
+
+// Bool returns the field at the given index as a bool
+func (this *Tuple) Bool(i int) (bool, error) {
+	value, err := this.field(i)
+	if err != nil {
+		return false, err
+	}
+	if value.Kind() == reflect.Bool {
+		return value.Bool(), nil
+	}
+	return false, this.typeError(i, value, "bool")
+}
+
+// Bytes returns the field at the given index as binary data. Since JSON
+// cannot carry raw bytes, binary fields are sent as strings holding the
+// standard base64 encoding of RFC 4648, with padding, which is what
+// encoding/json produces for a []byte and what java.util.Base64's basic
+// encoder produces. String fields are decoded from base64, while fields
+// that were decoded into a []byte are returned as they are, since
+// encoding/json has already decoded them.
+func (this *Tuple) Bytes(i int) ([]byte, error) {
+	value, err := this.field(i)
+	if err != nil {
+		return nil, err
+	}
+	if value.Kind() == reflect.Slice && value.Type().Elem().Kind() == reflect.Uint8 {
+		return value.Bytes(), nil
+	}
+	if value.Kind() != reflect.String {
+		return nil, this.typeError(i, value, "base64 encoded bytes")
+	}
+	data, err := base64.StdEncoding.DecodeString(value.String())
+	if err != nil {
+		return nil, fmt.Errorf("Field %d of the tuple is not valid base64: %v", i, err)
+	}
+	return data, nil
+}
+
+// Object decodes the field at the given index into dest, which must be a
+// pointer, as json.Unmarshal does. This gives a typed view of a field
+// that was emitted as a JSON object, but decoded into a map with float64
+// numbers because the bolt declared it as an interface{}. Fields that
+// were decoded into a json.RawMessage are unmarshalled directly, which
+// avoids marshalling the field again and keeps numbers exact. Other
+// fields are marshalled to JSON before being unmarshalled into dest.
+func (this *Tuple) Object(i int, dest interface{}) error {
+	value, err := this.field(i)
+	if err != nil {
+		return err
+	}
+	data, ok := value.Interface().(json.RawMessage)
+	if !ok {
+		data, err = json.Marshal(value.Interface())
+		if err != nil {
+			return fmt.Errorf("Field %d of the tuple cannot be marshalled: %v", i, err)
+		}
+	}
+	err = json.Unmarshal(data, dest)
+	if err != nil {
+		return fmt.Errorf("Field %d of the tuple cannot be decoded into %T: %v", i, dest, err)
+	}
+	return nil
+}
+
+// EncodeBytes returns the standard base64 encoding of binary data, as
+// read by Tuple.Bytes, for emitting it as a string field. Emitting the
+// []byte itself with a JSON encoding produces the same field, but
+// encoding it explicitly keeps the convention visible and also works for
+// encodings and marshal hooks that do not treat []byte that way.
+func EncodeBytes(data []byte) string {
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+// field returns the value of the field at the given index, after
+// dereferencing any pointers and interfaces
+func (this *Tuple) field(i int) (reflect.Value, error) {
+	if i < 0 || i >= len(this.Fields) {
+		return reflect.Value{}, fmt.Errorf("Tuple has no field %d, it has %d fields", i, len(this.Fields))
+	}
+	value := reflect.ValueOf(this.Fields[i])
+	for value.Kind() == reflect.Ptr || value.Kind() == reflect.Interface {
+		if value.IsNil() {
+			break
+		}
+		value = value.Elem()
+	}
+	if !value.IsValid() || ((value.Kind() == reflect.Ptr || value.Kind() == reflect.Interface) && value.IsNil()) {
+		return reflect.Value{}, fmt.Errorf("Field %d of the tuple is nil", i)
+	}
+	return value, nil
+}
+
+func (this *Tuple) typeError(i int, value reflect.Value, typeName string) error {
+	return fmt.Errorf("Field %d of the tuple is the %v %v, which cannot be read as %s", i, value.Type(), value.Interface(), typeName)
+}
+
+// NormalizedId returns the id of the tuple in the form returned by
+// NormalizeId. It should only be used to compare ids with those of other
+// components: tuples are anchored, acked and failed with Meta.Id, which
+// is the id exactly as Storm sent it.
+func (this *Tuple) NormalizedId() string {
+	return NormalizeId(this.Meta.Id)
+}
+
+// ReadTime returns the time at which the tuple was read by ReadTuples.
+// It is the zero time for tuples that were created in another way.
+func (this *Tuple) ReadTime() time.Time {
+	return this.readTime
+}
+
+// Latency returns the time since the tuple was read by ReadTuples
+func (this *Tuple) Latency() time.Duration {
+	return time.Since(this.readTime)
+}
+
+// IsTick returns whether the tuple is a tick tuple
+func (this *Tuple) IsTick() bool {
+	return IsTick(&this.Meta)
+}
+
+// IsTick returns whether the given metadata belongs to a tick tuple
+func IsTick(meta *messages.BoltMsgMeta) bool {
+	return meta.Comp == SystemComponent && meta.Stream == TickStream
+}
+
+// ReadTuples reads tuples from the bolt connection on a separate
+// goroutine and sends them on the returned tuple channel, which allows
+// a bolt to range over its input. The fields function is called for
+// every tuple to obtain the objects that the tuple's fields should be
+// decoded into. The tuple channel is closed when Storm closes the
+// stream. If a read fails, the error is sent on the error channel
+// before both channels are closed.
+//
+// Acking and failing tuples is left to the bolt. Heartbeat tuples are
+// passed on and should be answered with a SendSync.
+//
+// The connection is not safe for concurrent use, so all emissions and
+// acks must still be made from a single goroutine. ReadTuples cannot be
+// used if the connection requests task ids, or with EmitAsync, since the
+// task ids of an emission would then be read concurrently with the next
+// tuple.
+func ReadTuples(boltConn BoltConn, fields func() []interface{}) (<-chan *Tuple, <-chan error) {
+	tuples := make(chan *Tuple)
+	errs := make(chan error, 1)
+	declarer, _ := boltConn.(InputFieldsDeclarer)
+	go func() {
+		defer close(errs)
+		defer close(tuples)
+		for {
+			tuple := &Tuple{
+				Fields: fields(),
+			}
+			err := boltConn.ReadBoltMsg(&tuple.Meta, tuple.Fields...)
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				errs <- err
+				return
+			}
+			tuple.readTime = time.Now()
+			if declarer != nil {
+				tuple.Names = declarer.InputFields(tuple.Meta.Comp, tuple.Meta.Stream)
+			}
+			tuples <- tuple
+		}
+	}()
+	return tuples, errs
+}
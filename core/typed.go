@@ -0,0 +1,76 @@
+//go:build go1.18
+// +build go1.18
+
+//   Copyright 2013 Vastech SA (PTY) LTD
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package core
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// EmitTyped emits the exported fields of v as the contents of a tuple,
+// in the order in which they are declared, like EmitStruct. Fields
+// tagged with `storm:"-"` are not emitted. Unlike EmitStruct, it returns
+// an error instead of panicking if T is not a struct or a pointer to a
+// struct, and, if the connection implements CheckedBoltEmitter, if the
+// tuple cannot be emitted. DecodeTuple decodes the emitted tuple into a
+// value of the same type.
+func EmitTyped[T any](conn BoltConn, v T, anchors []string, stream string) (taskIds []int32, err error) {
+	fields, err := tryStructFields(v)
+	if err != nil {
+		return nil, err
+	}
+	if checked, ok := conn.(CheckedBoltEmitter); ok {
+		return checked.TryEmit(anchors, stream, fields...)
+	}
+	return conn.Emit(anchors, stream, fields...), nil
+}
+
+// DecodeTuple decodes the fields of a tuple into a struct of type T, by
+// position, as EmitTyped emits them. The tuple must have a field for
+// every exported field of T that is not tagged with `storm:"-"`. Fields
+// are assigned directly if their types match and are otherwise decoded
+// as JSON, like Tuple.Object does, so that a float64 can be decoded into
+// an integer field and a map into a struct. Nil fields leave the
+// corresponding field of T at its zero value.
+func DecodeTuple[T any](tuple *Tuple) (T, error) {
+	var result T
+	value := reflect.ValueOf(&result).Elem()
+	if value.Kind() != reflect.Struct {
+		return result, fmt.Errorf("Decoding a tuple into %T, which is not a struct", result)
+	}
+	indices := tupleFieldIndices(value.Type())
+	if len(tuple.Fields) != len(indices) {
+		return result, fmt.Errorf("Tuple has %d fields, but %T has %d", len(tuple.Fields), result, len(indices))
+	}
+	for i, index := range indices {
+		dest := value.Field(index)
+		field, err := tuple.field(i)
+		if err != nil {
+			// The field is nil
+			continue
+		}
+		if field.Type().AssignableTo(dest.Type()) {
+			dest.Set(field)
+			continue
+		}
+		if err := tuple.Object(i, dest.Addr().Interface()); err != nil {
+			return result, fmt.Errorf("Decoding %s of %T: %v", value.Type().Field(index).Name, result, err)
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,48 @@
+//   Copyright 2013 Vastech SA (PTY) LTD
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package core
+
+import (
+	"time"
+)
+
+// WaitStrategy decides how long a spout waits before sending a sync
+// message to Storm. It receives the command that was last read from
+// Storm and whether any tuples were emitted since that command was
+// read. This allows spouts to implement custom wait strategies, such as
+// backing off for longer when the spout has been idle for a while.
+type WaitStrategy interface {
+	Wait(command string, tuplesSent bool) time.Duration
+}
+
+// NewSleepWaitStrategy returns a wait strategy that sleeps for the
+// given duration after a next command during which no tuples were
+// emitted. This mimics the sleep spout wait strategy of Java spouts.
+func NewSleepWaitStrategy(sleep time.Duration) WaitStrategy {
+	return &sleepWaitStrategy{
+		sleep: sleep,
+	}
+}
+
+type sleepWaitStrategy struct {
+	sleep time.Duration
+}
+
+func (this *sleepWaitStrategy) Wait(command string, tuplesSent bool) time.Duration {
+	if command == CommandNext && !tuplesSent {
+		return this.sleep
+	}
+	return 0
+}
@@ -0,0 +1,196 @@
+//   Copyright 2013 Vastech SA (PTY) LTD
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+// Package avro implements an encoding that sends tuple fields as Avro
+// binary data inside the Storm multilang JSON envelope, so that the
+// existing Storm shell components can be used. This encoding is not
+// imported by the encodings package, since it depends on goavro.
+package avro
+
+import (
+	"fmt"
+	"github.com/jsgilmore/gostorm/core"
+	jsonencoding "github.com/jsgilmore/gostorm/encodings/json"
+	"github.com/jsgilmore/gostorm/messages"
+	"github.com/linkedin/goavro/v2"
+	"io"
+)
+
+// Datum is a tuple field that is encoded with the Avro schema of its
+// codec. Value holds the field in the native Go form used by goavro,
+// e.g. a map[string]interface{} for an Avro record. To receive Avro
+// fields, a bolt's fields factory should return a Datum with only the
+// codec set for each field.
+type Datum struct {
+	Codec *goavro.Codec
+	Value interface{}
+}
+
+func NewDatum(codec *goavro.Codec, value interface{}) *Datum {
+	return &Datum{
+		Codec: codec,
+		Value: value,
+	}
+}
+
+func NewAvroInputFactory() core.InputFactory {
+	return &avroInputFactory{}
+}
+
+type avroInputFactory struct{}
+
+func (this *avroInputFactory) NewInput(reader io.Reader) core.Input {
+	return NewAvroInput(reader)
+}
+
+func NewAvroInput(reader io.Reader) core.Input {
+	return &avroInput{
+		Input: jsonencoding.NewJsonObjectInput(reader),
+	}
+}
+
+// avroInput reuses the JSON object input for reading messages and task
+// ids, but decodes the tuple fields from Avro binary data
+type avroInput struct {
+	core.Input
+}
+
+// SetMaxMessageSize sets the maximum size of a message read from Storm,
+// after which reads return core.ErrMessageTooLarge
+func (this *avroInput) SetMaxMessageSize(n int) {
+	this.Input.(core.MessageSizeLimiter).SetMaxMessageSize(n)
+}
+
+// SetAutoResync sets whether malformed messages from Storm are skipped,
+// as described at core.Resyncer
+func (this *avroInput) SetAutoResync(enabled bool) {
+	this.Input.(core.Resyncer).SetAutoResync(enabled)
+}
+
+// SetTrace sets the trace to which the frames read from Storm are
+// written
+func (this *avroInput) SetTrace(trace *core.Trace) {
+	this.Input.(core.Tracer).SetTrace(trace)
+}
+
+func (this *avroInput) constructInput(contents ...interface{}) []interface{} {
+	contentList := make([]interface{}, len(contents))
+	for i := 0; i < len(contents); i++ {
+		contentList[i] = &[]byte{}
+	}
+	return contentList
+}
+
+func (this *avroInput) decodeInput(contentList []interface{}, contentStructs ...interface{}) (err error) {
+	for i, content := range contentStructs {
+		datum := content.(*Datum)
+		datum.Value, _, err = datum.Codec.NativeFromBinary(*contentList[i].(*[]byte))
+		if err != nil {
+			return fmt.Errorf("Avro: decoding field %d: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// ReadBoltMsg reads a tuple from Storm of which the contents are known
+// and decodes the contents into the provided list of Datums
+func (this *avroInput) ReadBoltMsg(metadata *messages.BoltMsgMeta, contentStructs ...interface{}) (err error) {
+	boltMsg := &messages.BoltMsg{
+		BoltMsgJson: &messages.BoltMsgJson{
+			BoltMsgMeta: metadata,
+			Contents:    this.constructInput(contentStructs...),
+		},
+	}
+	err = this.ReadMsg(boltMsg)
+	if err != nil {
+		return err
+	}
+
+	return this.decodeInput(boltMsg.BoltMsgJson.Contents, contentStructs...)
+}
+
+func NewAvroOutputFactory() core.OutputFactory {
+	return &avroOutputFactory{}
+}
+
+type avroOutputFactory struct{}
+
+func (this *avroOutputFactory) NewOutput(writer io.Writer) core.Output {
+	return NewAvroOutput(writer)
+}
+
+func NewAvroOutput(writer io.Writer) core.Output {
+	return &avroOutput{
+		Output: jsonencoding.NewJsonObjectOutput(writer),
+	}
+}
+
+// avroOutput reuses the JSON object output for sending messages, but
+// encodes the tuple fields as Avro binary data
+type avroOutput struct {
+	core.Output
+}
+
+// SetTrace sets the trace to which the frames sent to Storm are written
+func (this *avroOutput) SetTrace(trace *core.Trace) {
+	this.Output.(core.Tracer).SetTrace(trace)
+}
+
+// SendMetrics sends the parameters of a metric to Storm
+func (this *avroOutput) SendMetrics(name string, params interface{}) {
+	this.Output.(core.MetricsSender).SendMetrics(name, params)
+}
+
+// Sync flushes the buffered messages and commits them to stable storage
+// if the underlying writer is a file
+func (this *avroOutput) Sync() error {
+	return this.Output.(core.Syncer).Sync()
+}
+
+func (this *avroOutput) constructOutput(contents ...interface{}) ([]interface{}, error) {
+	contentList := make([]interface{}, len(contents))
+	for i, content := range contents {
+		datum, ok := content.(*Datum)
+		if !ok {
+			return nil, fmt.Errorf("Field %d of type %T is not an avro datum", i, content)
+		}
+		encoded, err := datum.Codec.BinaryFromNative(nil, datum.Value)
+		if err != nil {
+			return nil, err
+		}
+		contentList[i] = &encoded
+	}
+	return contentList, nil
+}
+
+func (this *avroOutput) EmitGeneric(command, id, stream, msg string, anchors []string, directTask int64, needTaskIds bool, contents ...interface{}) {
+	if err := this.TryEmitGeneric(command, id, stream, msg, anchors, directTask, needTaskIds, contents...); err != nil {
+		panic(err)
+	}
+}
+
+// TryEmitGeneric sends a shell message like EmitGeneric, but returns an
+// error instead of panicking if the contents cannot be encoded
+func (this *avroOutput) TryEmitGeneric(command, id, stream, msg string, anchors []string, directTask int64, needTaskIds bool, contents ...interface{}) error {
+	contentList, err := this.constructOutput(contents...)
+	if err != nil {
+		return err
+	}
+	return this.Output.(core.CheckedOutput).TryEmitGeneric(command, id, stream, msg, anchors, directTask, needTaskIds, contentList...)
+}
+
+func init() {
+	core.RegisterInput("avro", NewAvroInputFactory())
+	core.RegisterOutput("avro", NewAvroOutputFactory())
+}
@@ -0,0 +1,106 @@
+//   Copyright 2013 Vastech SA (PTY) LTD
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package avro
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/jsgilmore/gostorm/messages"
+	"github.com/linkedin/goavro/v2"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+const testSchema = `{"type": "record", "name": "Test", "fields": [
+	{"name": "Name", "type": "string"},
+	{"name": "Number", "type": "long"}
+]}`
+
+func checkErr(err error, t *testing.T) {
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadBoltMsg(t *testing.T) {
+	codec, err := goavro.NewCodec(testSchema)
+	checkErr(err, t)
+
+	buffer := new(bytes.Buffer)
+	output := NewAvroOutput(buffer)
+	input := NewAvroInput(buffer)
+
+	for i := 0; i < 100; i++ {
+		num := rand.Int63()
+		numStr := fmt.Sprintf("%d", num)
+		outRecord := map[string]interface{}{"Name": numStr, "Number": num}
+		encoded, err := codec.BinaryFromNative(nil, outRecord)
+		checkErr(err, t)
+
+		outTuple := &messages.BoltMsg{
+			BoltMsgJson: &messages.BoltMsgJson{
+				BoltMsgMeta: &messages.BoltMsgMeta{
+					Id:     numStr,
+					Comp:   numStr,
+					Stream: numStr,
+					Task:   num,
+				},
+				Contents: []interface{}{encoded},
+			},
+		}
+		output.SendMsg(outTuple)
+		output.Flush()
+
+		inDatum := &Datum{Codec: codec}
+		inMeta := &messages.BoltMsgMeta{}
+		err = input.ReadBoltMsg(inMeta, inDatum)
+		checkErr(err, t)
+
+		if !inMeta.Equal(outTuple.BoltMsgJson.BoltMsgMeta) {
+			t.Fatalf("Tuple metadata (%+v) does not equal read Tuple metadata (%+v)", outTuple.BoltMsgJson.BoltMsgMeta, inMeta)
+		}
+		if !reflect.DeepEqual(inDatum.Value, outRecord) {
+			t.Fatalf("Tuple data (%+v) does not equal read tuple data (%+v)", outRecord, inDatum.Value)
+		}
+	}
+}
+
+func TestEmitGeneric(t *testing.T) {
+	codec, err := goavro.NewCodec(testSchema)
+	checkErr(err, t)
+
+	buffer := new(bytes.Buffer)
+	output := NewAvroOutput(buffer)
+	input := NewAvroInput(buffer)
+
+	outRecord := map[string]interface{}{"Name": "avro", "Number": int64(42)}
+	output.EmitGeneric("emit", "", "", "", nil, 0, true, NewDatum(codec, outRecord))
+	output.Flush()
+
+	shellMsg := &messages.ShellMsg{
+		ShellMsgJson: &messages.ShellMsgJson{
+			Contents: []interface{}{&[]byte{}},
+		},
+	}
+	err = input.ReadMsg(shellMsg)
+	checkErr(err, t)
+
+	inRecord, _, err := codec.NativeFromBinary(*shellMsg.ShellMsgJson.Contents[0].(*[]byte))
+	checkErr(err, t)
+	if !reflect.DeepEqual(inRecord, outRecord) {
+		t.Fatalf("Emission data (%+v) does not equal read emission data (%+v)", outRecord, inRecord)
+	}
+}
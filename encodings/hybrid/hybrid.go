@@ -16,7 +16,6 @@ package hybrid
 
 import (
 	"bufio"
-	"bytes"
 	"code.google.com/p/gogoprotobuf/proto"
 	"container/list"
 	"encoding/json"
@@ -24,7 +23,6 @@ import (
 	"github.com/jsgilmore/gostorm/core"
 	"github.com/jsgilmore/gostorm/messages"
 	"io"
-	"log"
 )
 
 func NewHybridInputFactory() core.InputFactory {
@@ -38,35 +36,46 @@ func (this *hybridInputFactory) NewInput(reader io.Reader) core.Input {
 }
 
 func NewHybridInput(reader io.Reader) core.Input {
+	return NewHybridFramedInput(reader, core.NewLineFraming())
+}
+
+// NewHybridFramedInput returns an input that reads messages delimited
+// by the given framing
+func NewHybridFramedInput(reader io.Reader, framing core.Framing) core.Input {
 	return &hybridInput{
 		reader:      bufio.NewReader(reader),
 		tupleBuffer: list.New(),
+		framing:     framing,
 	}
 }
 
 type hybridInput struct {
-	reader      *bufio.Reader
-	tupleBuffer *list.List
+	reader         *bufio.Reader
+	tupleBuffer    *list.List
+	framing        core.Framing
+	maxMessageSize int
+	trace          *core.Trace
 }
 
-func (this *hybridInput) readData() (data []byte, err error) {
-	// Read a single json record from the input file
-	data, err = this.reader.ReadBytes('\n')
-	if err != nil {
-		return data, err
-	}
+// SetMaxMessageSize sets the maximum size of a message read from Storm,
+// after which reads return core.ErrMessageTooLarge. A size of zero,
+// which is the default, means that messages are unlimited.
+func (this *hybridInput) SetMaxMessageSize(n int) {
+	this.maxMessageSize = n
+}
 
-	//Read the end delimiter
-	_, err = this.reader.ReadBytes('\n')
-	if err == io.EOF {
-		panic("EOF received at end statement. Is there newline after every end statement (including the last one)?")
-	} else if err != nil {
-		panic(err)
-	}
+// SetTrace sets the trace to which the frames read from Storm are
+// written
+func (this *hybridInput) SetTrace(trace *core.Trace) {
+	this.trace = trace
+}
 
-	// Remove the newline character
-	data = bytes.Trim(data, "\n")
-	return data, nil
+func (this *hybridInput) readData() (data []byte, err error) {
+	data, err = this.framing.ReadFrame(this.reader, this.maxMessageSize)
+	if err == nil {
+		this.trace.WriteFrame(core.TraceIn, this.framing, data)
+	}
+	return data, err
 }
 
 // readBytes reads data from stdin into the struct provided.
@@ -86,7 +95,7 @@ func (this *hybridInput) ReadMsg(msg interface{}) (err error) {
 
 	err = json.Unmarshal(data, msg)
 	if err != nil {
-		log.Printf("core hybrid encoding: Unmarshalling: %s", data)
+		core.Logger().Printf("core hybrid encoding: Unmarshalling: %s", data)
 		return err
 	}
 	return nil
@@ -158,39 +167,88 @@ func (this *hybridOutputFactory) NewOutput(writer io.Writer) core.Output {
 }
 
 func NewHybridOutput(writer io.Writer) core.Output {
+	return NewHybridFramedOutput(writer, core.NewLineFraming())
+}
+
+// NewHybridFramedOutput returns an output that writes messages
+// delimited by the given framing
+func NewHybridFramedOutput(writer io.Writer, framing core.Framing) core.Output {
 	return &hybridOutput{
-		writer: bufio.NewWriter(writer),
+		dest:    writer,
+		writer:  bufio.NewWriter(writer),
+		framing: framing,
+		encoder: messages.NewShellMsgEncoder(),
 	}
 }
 
 type hybridOutput struct {
-	writer *bufio.Writer
+	dest    io.Writer
+	writer  *bufio.Writer
+	framing core.Framing
+	trace   *core.Trace
+	encoder *messages.ShellMsgEncoder
+}
+
+// SetTrace sets the trace to which the frames sent to Storm are written
+func (this *hybridOutput) SetTrace(trace *core.Trace) {
+	this.trace = trace
 }
 
-// sendMsg sends the contents of a known Storm message to Storm
+// sendMsg sends the contents of a known Storm message to Storm. Shell
+// messages are encoded with the output's reusable encoder.
 func (this *hybridOutput) SendMsg(msg interface{}) {
-	data, err := json.Marshal(msg)
-	if err != nil {
+	if err := this.sendMsg(msg); err != nil {
 		panic(err)
 	}
-	fmt.Fprintln(this.writer, string(data))
-	// Storm requires that every message be suffixed with an "end" string
-	fmt.Fprintln(this.writer, "end")
 }
 
-func (this *hybridOutput) constructOutput(contents ...interface{}) []interface{} {
+// sendMsg sends a message to Storm, or returns an error without writing
+// anything if the message cannot be encoded
+func (this *hybridOutput) sendMsg(msg interface{}) error {
+	var data []byte
+	var err error
+	if shellMsg, ok := msg.(*messages.ShellMsg); ok && shellMsg.ShellMsgJson != nil {
+		data, err = this.encoder.Encode(shellMsg)
+	} else {
+		data, err = json.Marshal(msg)
+	}
+	if err != nil {
+		return err
+	}
+	this.framing.WriteFrame(this.writer, data)
+	this.trace.WriteFrame(core.TraceOut, this.framing, data)
+	return nil
+}
+
+func (this *hybridOutput) constructOutput(contents ...interface{}) ([]interface{}, error) {
 	contentList := make([]interface{}, len(contents))
 	for i, content := range contents {
-		encoded, err := proto.Marshal(content.(proto.Message))
+		message, ok := content.(proto.Message)
+		if !ok {
+			return nil, fmt.Errorf("Field %d of type %T is not a protocol buffer message", i, content)
+		}
+		encoded, err := proto.Marshal(message)
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
 		contentList[i] = &encoded
 	}
-	return contentList
+	return contentList, nil
 }
 
 func (this *hybridOutput) EmitGeneric(command, id, stream, msg string, anchors []string, directTask int64, needTaskIds bool, contents ...interface{}) {
+	if err := this.TryEmitGeneric(command, id, stream, msg, anchors, directTask, needTaskIds, contents...); err != nil {
+		panic(err)
+	}
+}
+
+// TryEmitGeneric sends a shell message like EmitGeneric, but returns an
+// error instead of panicking if the contents cannot be marshalled
+func (this *hybridOutput) TryEmitGeneric(command, id, stream, msg string, anchors []string, directTask int64, needTaskIds bool, contents ...interface{}) error {
+	contentList, err := this.constructOutput(contents...)
+	if err != nil {
+		return err
+	}
 	shellMsg := &messages.ShellMsg{
 		ShellMsgJson: &messages.ShellMsgJson{
 			ShellMsgMeta: &messages.ShellMsgMeta{
@@ -202,16 +260,34 @@ func (this *hybridOutput) EmitGeneric(command, id, stream, msg string, anchors [
 				NeedTaskIds: &needTaskIds,
 				Msg:         &msg,
 			},
-			Contents: this.constructOutput(contents...),
+			Contents: contentList,
 		},
 	}
-	this.SendMsg(shellMsg)
+	return this.sendMsg(shellMsg)
+}
+
+// SendMetrics sends the parameters of a metric to Storm
+func (this *hybridOutput) SendMetrics(name string, params interface{}) {
+	this.SendMsg(&messages.MetricsMsg{
+		Command: "metrics",
+		Name:    name,
+		Params:  params,
+	})
 }
 
 func (this *hybridOutput) Flush() {
 	this.writer.Flush()
 }
 
+// Sync flushes the buffered messages and commits them to stable storage
+// if the underlying writer is a file
+func (this *hybridOutput) Sync() error {
+	if err := this.writer.Flush(); err != nil {
+		return err
+	}
+	return core.SyncWriter(this.dest)
+}
+
 func init() {
 	core.RegisterInput("hybrid", NewHybridInputFactory())
 	core.RegisterOutput("hybrid", NewHybridOutputFactory())
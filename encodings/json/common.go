@@ -16,110 +16,247 @@ package json
 
 import (
 	"bufio"
-	"bytes"
 	"container/list"
 	"encoding/json"
-	"fmt"
+	"github.com/jsgilmore/gostorm/core"
+	"github.com/jsgilmore/gostorm/messages"
 	"io"
-	"log"
 )
 
-func newJsonInput(reader io.Reader) *jsonInput {
+func newJsonInput(reader io.Reader, framing core.Framing) *jsonInput {
 	return &jsonInput{
 		reader:      bufio.NewReader(reader),
 		tupleBuffer: list.New(),
+		framing:     framing,
 	}
 }
 
 type jsonInput struct {
-	reader      *bufio.Reader
-	tupleBuffer *list.List
+	reader         *bufio.Reader
+	tupleBuffer    *list.List
+	framing        core.Framing
+	maxMessageSize int
+	trace          *core.Trace
+	autoResync     bool
 }
 
-func (this *jsonInput) readData() (data []byte, err error) {
-	// Read a single json record from the input file
-	data, err = this.reader.ReadBytes('\n')
-	if err != nil {
-		return data, err
-	}
+// SetMaxMessageSize sets the maximum size of a message read from Storm,
+// after which reads return core.ErrMessageTooLarge. A size of zero,
+// which is the default, means that messages are unlimited.
+func (this *jsonInput) SetMaxMessageSize(n int) {
+	this.maxMessageSize = n
+}
 
-	//Read the end delimiter
-	_, err = this.reader.ReadBytes('\n')
-	if err == io.EOF {
-		panic("EOF received at end statement. Is there newline after every end statement (including the last one)?")
-	} else if err != nil {
-		panic(err)
-	}
+// SetTrace sets the trace to which the frames read from Storm are
+// written
+func (this *jsonInput) SetTrace(trace *core.Trace) {
+	this.trace = trace
+}
 
-	// Remove the newline character
-	data = bytes.TrimRight(data, "\n")
-	return data, nil
+// SetAutoResync sets whether malformed messages from Storm are skipped,
+// as described at core.Resyncer. Messages that are not followed by
+// their delimiter can only be skipped with a framing that implements
+// core.FrameResyncer, such as the standard line framing.
+func (this *jsonInput) SetAutoResync(enabled bool) {
+	this.autoResync = enabled
 }
 
-// readBytes reads data from stdin into the struct provided.
-func (this *jsonInput) ReadMsg(msg interface{}) (err error) {
-	var data []byte
-	// Read data from the tuple buffer
-	if this.tupleBuffer.Len() > 0 {
-		e := this.tupleBuffer.Front()
-		data = this.tupleBuffer.Remove(e).([]byte)
-		// if the tuple buffer is empty, read data from storm
-	} else {
+// readMsgData reads the data of the next message from Storm. If auto
+// resync is enabled, frames that are out of sync are logged and skipped.
+func (this *jsonInput) readMsgData() (data []byte, err error) {
+	for {
 		data, err = this.readData()
+		syncErr, ok := err.(*core.FrameSyncError)
+		if !ok || !this.autoResync {
+			return data, err
+		}
+		resyncer, ok := this.framing.(core.FrameResyncer)
+		if !ok {
+			return nil, err
+		}
+		core.Logger().Printf("core json: Skipping frame that is out of sync: %q, followed by %q", syncErr.Frame, syncErr.Delimiter)
+		skipped, err := resyncer.Resync(this.reader, this.maxMessageSize)
+		for _, line := range skipped {
+			core.Logger().Printf("core json: Skipping data that is out of sync: %q", line)
+		}
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
+}
 
-	err = json.Unmarshal(data, msg)
-	if err != nil {
-		log.Printf("core json: Unmarshalling: %s", data)
-		return err
+func (this *jsonInput) readData() (data []byte, err error) {
+	data, err = this.framing.ReadFrame(this.reader, this.maxMessageSize)
+	if err == nil {
+		this.trace.WriteFrame(core.TraceIn, this.framing, data)
 	}
-	return nil
+	return data, err
 }
 
-func (this *jsonInput) ReadTaskIds() (taskIds []int32) {
-	// Read a single json record from the input file
-	data, err := this.readData()
-	if err != nil {
-		panic(err)
-	}
+// readBytes reads data from stdin into the struct provided.
+// If auto resync is enabled, messages that are not valid JSON are
+// logged and skipped.
+func (this *jsonInput) ReadMsg(msg interface{}) (err error) {
+	for {
+		var data []byte
+		// Read data from the tuple buffer
+		if this.tupleBuffer.Len() > 0 {
+			e := this.tupleBuffer.Front()
+			data = this.tupleBuffer.Remove(e).([]byte)
+			// if the tuple buffer is empty, read data from storm
+		} else {
+			data, err = this.readMsgData()
+			if err != nil {
+				return err
+			}
+		}
 
-	// If we didn't receive a json array, treat it as a tuple instead
-	if data[0] != '[' {
-		this.tupleBuffer.PushBack(data)
-		return this.ReadTaskIds()
+		err = json.Unmarshal(data, msg)
+		if err == nil {
+			return nil
+		}
+		core.Logger().Printf("core json: Unmarshalling: %s", data)
+		// A syntax error leaves msg untouched, so the next message can
+		// be read into it
+		if _, ok := err.(*json.SyntaxError); !ok || !this.autoResync {
+			return err
+		}
+		core.Logger().Printf("core json: Skipping malformed frame")
 	}
+}
 
-	err = json.Unmarshal(data, &taskIds)
+func (this *jsonInput) ReadTaskIds() (taskIds []int32) {
+	taskIds, err := this.TryReadTaskIds()
 	if err != nil {
 		panic(err)
 	}
 	return taskIds
 }
 
-func newJsonOutput(writer io.Writer) *jsonOutput {
-	return &jsonOutput{
-		writer: bufio.NewWriter(writer),
+// TryReadTaskIds reads task ids like ReadTaskIds, but returns an error
+// instead of panicking if they cannot be read or decoded
+func (this *jsonInput) TryReadTaskIds() (taskIds []int32, err error) {
+	for {
+		// Read a single json record from the input file
+		var data []byte
+		data, err = this.readData()
+		if err != nil {
+			return nil, err
+		}
+
+		// If we didn't receive a json array, treat it as a tuple instead
+		if len(data) > 0 && data[0] == '[' {
+			err = json.Unmarshal(data, &taskIds)
+			if err != nil {
+				return nil, err
+			}
+			return taskIds, nil
+		}
+		this.tupleBuffer.PushBack(data)
+	}
+}
+
+func newJsonOutput(writer io.Writer, framing core.Framing) *jsonOutput {
+	this := &jsonOutput{
+		dest:    writer,
+		writer:  bufio.NewWriter(writer),
+		framing: framing,
+		encoder: messages.NewShellMsgEncoder(),
 	}
+	this.shellMsgJson.ShellMsgMeta = &this.meta
+	this.shellMsg.ShellMsgJson = &this.shellMsgJson
+	return this
 }
 
 type jsonOutput struct {
-	writer *bufio.Writer
+	dest    io.Writer
+	writer  *bufio.Writer
+	framing core.Framing
+	trace   *core.Trace
+	encoder *messages.ShellMsgEncoder
+	// The shell message and the values that its metadata points to are
+	// reused by every emission, so that they are not allocated each time
+	shellMsg     messages.ShellMsg
+	shellMsgJson messages.ShellMsgJson
+	meta         messages.ShellMsgMeta
+	id           string
+	stream       string
+	msg          string
+	task         int64
+	needTaskIds  bool
+}
+
+// SetTrace sets the trace to which the frames sent to Storm are written
+func (this *jsonOutput) SetTrace(trace *core.Trace) {
+	this.trace = trace
 }
 
-// sendMsg sends the contents of a known Storm message to Storm
+// sendMsg sends the contents of a known Storm message to Storm. Shell
+// messages are encoded with the output's reusable encoder.
 func (this *jsonOutput) SendMsg(msg interface{}) {
-	data, err := json.Marshal(msg)
-	if err != nil {
+	if err := this.sendMsg(msg); err != nil {
 		panic(err)
 	}
-	fmt.Fprintln(this.writer, string(data))
-	// Storm requires that every message be suffixed with an "end" string
-	fmt.Fprintln(this.writer, "end")
+}
+
+// sendMsg sends a message to Storm, or returns an error without writing
+// anything if the message cannot be encoded
+func (this *jsonOutput) sendMsg(msg interface{}) error {
+	var data []byte
+	var err error
+	if shellMsg, ok := msg.(*messages.ShellMsg); ok && shellMsg.ShellMsgJson != nil {
+		data, err = this.encoder.Encode(shellMsg)
+	} else {
+		data, err = json.Marshal(msg)
+	}
+	if err != nil {
+		return err
+	}
+	this.framing.WriteFrame(this.writer, data)
+	this.trace.WriteFrame(core.TraceOut, this.framing, data)
+	return nil
+}
+
+// emitGeneric sends a shell message with the given values and already
+// constructed contents, reusing the shell message of the output
+func (this *jsonOutput) emitGeneric(command, id, stream, msg string, anchors []string, directTask int64, needTaskIds bool, contents []interface{}) error {
+	this.id, this.stream, this.msg = id, stream, msg
+	this.task, this.needTaskIds = directTask, needTaskIds
+	this.meta = messages.ShellMsgMeta{
+		Command:     command,
+		Anchors:     anchors,
+		Id:          &this.id,
+		Stream:      &this.stream,
+		Task:        &this.task,
+		NeedTaskIds: &this.needTaskIds,
+		Msg:         &this.msg,
+	}
+	this.shellMsgJson.Contents = contents
+	err := this.sendMsg(&this.shellMsg)
+	// Do not hold on to the contents after they have been sent
+	this.shellMsgJson.Contents = nil
+	this.meta.Anchors = nil
+	return err
+}
+
+// SendMetrics sends the parameters of a metric to Storm
+func (this *jsonOutput) SendMetrics(name string, params interface{}) {
+	this.SendMsg(&messages.MetricsMsg{
+		Command: "metrics",
+		Name:    name,
+		Params:  params,
+	})
 }
 
 func (this *jsonOutput) Flush() {
 	this.writer.Flush()
 }
+
+// Sync flushes the buffered messages and commits them to stable storage
+// if the underlying writer is a file
+func (this *jsonOutput) Sync() error {
+	if err := this.writer.Flush(); err != nil {
+		return err
+	}
+	return core.SyncWriter(this.dest)
+}
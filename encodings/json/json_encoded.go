@@ -22,18 +22,33 @@ import (
 )
 
 func NewJsonEncodedInputFactory() core.InputFactory {
-	return &jsonEncodedInputFactory{}
+	return &jsonEncodedInputFactory{core.NewLineFraming()}
 }
 
-type jsonEncodedInputFactory struct{}
+type jsonEncodedInputFactory struct {
+	framing core.Framing
+}
 
 func (this *jsonEncodedInputFactory) NewInput(reader io.Reader) core.Input {
-	return NewJsonEncodedInput(reader)
+	return NewJsonEncodedFramedInput(reader, this.framing)
 }
 
 func NewJsonEncodedInput(reader io.Reader) core.Input {
+	return NewJsonEncodedFramedInput(reader, core.NewLineFraming())
+}
+
+// NewJsonEncodedLengthPrefixedInput returns an input that reads messages
+// that are prefixed with their length instead of followed by an "end"
+// statement
+func NewJsonEncodedLengthPrefixedInput(reader io.Reader) core.Input {
+	return NewJsonEncodedFramedInput(reader, core.NewLengthPrefixedFraming())
+}
+
+// NewJsonEncodedFramedInput returns an input that reads messages
+// delimited by the given framing
+func NewJsonEncodedFramedInput(reader io.Reader, framing core.Framing) core.Input {
 	return &jsonEncodedInput{
-		jsonInput: newJsonInput(reader),
+		jsonInput: newJsonInput(reader, framing),
 	}
 }
 
@@ -78,18 +93,33 @@ func (this *jsonEncodedInput) ReadBoltMsg(metadata *messages.BoltMsgMeta, conten
 }
 
 func NewJsonEncodedOutputFactory() core.OutputFactory {
-	return &jsonEncodedOutputFactory{}
+	return &jsonEncodedOutputFactory{core.NewLineFraming()}
 }
 
-type jsonEncodedOutputFactory struct{}
+type jsonEncodedOutputFactory struct {
+	framing core.Framing
+}
 
 func (this *jsonEncodedOutputFactory) NewOutput(writer io.Writer) core.Output {
-	return NewJsonEncodedOutput(writer)
+	return NewJsonEncodedFramedOutput(writer, this.framing)
 }
 
 func NewJsonEncodedOutput(writer io.Writer) core.Output {
+	return NewJsonEncodedFramedOutput(writer, core.NewLineFraming())
+}
+
+// NewJsonEncodedLengthPrefixedOutput returns an output that prefixes
+// messages with their length instead of following them with an "end"
+// statement
+func NewJsonEncodedLengthPrefixedOutput(writer io.Writer) core.Output {
+	return NewJsonEncodedFramedOutput(writer, core.NewLengthPrefixedFraming())
+}
+
+// NewJsonEncodedFramedOutput returns an output that writes messages
+// delimited by the given framing
+func NewJsonEncodedFramedOutput(writer io.Writer, framing core.Framing) core.Output {
 	return &jsonEncodedOutput{
-		jsonOutput: newJsonOutput(writer),
+		jsonOutput: newJsonOutput(writer, framing),
 	}
 }
 
@@ -97,37 +127,37 @@ type jsonEncodedOutput struct {
 	*jsonOutput
 }
 
-func (this *jsonEncodedOutput) constructOutput(contents ...interface{}) []interface{} {
+func (this *jsonEncodedOutput) constructOutput(contents ...interface{}) ([]interface{}, error) {
 	contentList := make([]interface{}, len(contents))
 	for i, content := range contents {
 		encoded, err := json.Marshal(content)
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
 		contentList[i] = &encoded
 	}
-	return contentList
+	return contentList, nil
 }
 
 func (this *jsonEncodedOutput) EmitGeneric(command, id, stream, msg string, anchors []string, directTask int64, needTaskIds bool, contents ...interface{}) {
-	shellMsg := &messages.ShellMsg{
-		ShellMsgJson: &messages.ShellMsgJson{
-			ShellMsgMeta: &messages.ShellMsgMeta{
-				Command:     command,
-				Anchors:     anchors,
-				Id:          &id,
-				Stream:      &stream,
-				Task:        &directTask,
-				NeedTaskIds: &needTaskIds,
-				Msg:         &msg,
-			},
-			Contents: this.constructOutput(contents...),
-		},
+	if err := this.TryEmitGeneric(command, id, stream, msg, anchors, directTask, needTaskIds, contents...); err != nil {
+		panic(err)
+	}
+}
+
+// TryEmitGeneric sends a shell message like EmitGeneric, but returns an
+// error instead of panicking if the contents cannot be marshalled
+func (this *jsonEncodedOutput) TryEmitGeneric(command, id, stream, msg string, anchors []string, directTask int64, needTaskIds bool, contents ...interface{}) error {
+	contentList, err := this.constructOutput(contents...)
+	if err != nil {
+		return err
 	}
-	this.SendMsg(shellMsg)
+	return this.emitGeneric(command, id, stream, msg, anchors, directTask, needTaskIds, contentList)
 }
 
 func init() {
 	core.RegisterInput("jsonEncoded", NewJsonEncodedInputFactory())
 	core.RegisterOutput("jsonEncoded", NewJsonEncodedOutputFactory())
+	core.RegisterInput("jsonEncodedLengthPrefixed", &jsonEncodedInputFactory{core.NewLengthPrefixedFraming()})
+	core.RegisterOutput("jsonEncodedLengthPrefixed", &jsonEncodedOutputFactory{core.NewLengthPrefixedFraming()})
 }
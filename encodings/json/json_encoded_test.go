@@ -18,7 +18,9 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"github.com/jsgilmore/gostorm/core"
 	"github.com/jsgilmore/gostorm/messages"
+	"io"
 	"math/rand"
 	"testing"
 )
@@ -37,6 +39,28 @@ func TestEncodedOutput(t *testing.T) {
 	testSendMsg(buffer, output, t)
 }
 
+func TestEncodedTryEmitGeneric(t *testing.T) {
+	buffer := bytes.NewBuffer(nil)
+	output := NewJsonEncodedOutput(buffer)
+
+	checked := output.(core.CheckedOutput)
+	err := checked.TryEmitGeneric("emit", "", "", "", nil, 0, true, "valid", make(chan int))
+	if err == nil {
+		t.Fatal("Expected an error when emitting a channel")
+	}
+	output.Flush()
+	if buffer.Len() != 0 {
+		t.Fatalf("Unserializable emission was written: %s", buffer.String())
+	}
+	if err := checked.TryEmitGeneric("emit", "", "", "", nil, 0, true, "valid"); err != nil {
+		t.Fatal(err)
+	}
+	output.Flush()
+	if buffer.Len() == 0 {
+		t.Fatal("Valid emission was not written")
+	}
+}
+
 func TestEncodedEmitGeneric(t *testing.T) {
 	buffer := bytes.NewBuffer(nil)
 	output := NewJsonEncodedOutput(buffer)
@@ -117,3 +141,45 @@ func TestEncodedReadBoltMsg(t *testing.T) {
 		}
 	}
 }
+
+func TestEncodedInputEOF(t *testing.T) {
+	buffer := bytes.NewBufferString("\"complete\"\nend\n\"incomplete\"\n")
+	input := NewJsonEncodedInput(buffer)
+
+	var msg string
+	err := input.ReadMsg(&msg)
+	checkErr(err, t)
+
+	err = input.ReadMsg(&msg)
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("Expected unexpected EOF for a message without an end statement, received: %v", err)
+	}
+
+	input = NewJsonEncodedInput(bytes.NewBufferString("\"complete\"\nend\n"))
+	checkErr(input.ReadMsg(&msg), t)
+	if err = input.ReadMsg(&msg); err != io.EOF {
+		t.Fatalf("Expected EOF after the last message, received: %v", err)
+	}
+
+	// The end statement of the last message may lack its newline
+	input = NewJsonEncodedInput(bytes.NewBufferString("\"complete\"\nend\n\"last\"\nend"))
+	checkErr(input.ReadMsg(&msg), t)
+	checkErr(input.ReadMsg(&msg), t)
+	if msg != "last" {
+		t.Fatalf("Expected the last message, received: %s", msg)
+	}
+	if err = input.ReadMsg(&msg); err != io.EOF {
+		t.Fatalf("Expected EOF after the last message, received: %v", err)
+	}
+}
+
+func TestEncodedInputEndStatement(t *testing.T) {
+	buffer := bytes.NewBufferString("\"first\"\nend\n\"second\"\n\n\"third\"\nend\n")
+	input := NewJsonEncodedInput(buffer)
+
+	var msg string
+	checkErr(input.ReadMsg(&msg), t)
+	if err := input.ReadMsg(&msg); err == nil {
+		t.Fatalf("Expected an error for a message without an end statement, received: %s", msg)
+	}
+}
@@ -21,18 +21,33 @@ import (
 )
 
 func NewJsonObjectInputFactory() core.InputFactory {
-	return &jsonObjectInputFactory{}
+	return &jsonObjectInputFactory{core.NewLineFraming()}
 }
 
-type jsonObjectInputFactory struct{}
+type jsonObjectInputFactory struct {
+	framing core.Framing
+}
 
 func (this *jsonObjectInputFactory) NewInput(reader io.Reader) core.Input {
-	return NewJsonObjectInput(reader)
+	return NewJsonObjectFramedInput(reader, this.framing)
 }
 
 func NewJsonObjectInput(reader io.Reader) core.Input {
+	return NewJsonObjectFramedInput(reader, core.NewLineFraming())
+}
+
+// NewJsonObjectLengthPrefixedInput returns an input that reads messages
+// that are prefixed with their length instead of followed by an "end"
+// statement
+func NewJsonObjectLengthPrefixedInput(reader io.Reader) core.Input {
+	return NewJsonObjectFramedInput(reader, core.NewLengthPrefixedFraming())
+}
+
+// NewJsonObjectFramedInput returns an input that reads messages
+// delimited by the given framing
+func NewJsonObjectFramedInput(reader io.Reader, framing core.Framing) core.Input {
 	return &jsonObjectInput{
-		jsonInput: newJsonInput(reader),
+		jsonInput: newJsonInput(reader, framing),
 	}
 }
 
@@ -68,18 +83,33 @@ func (this *jsonObjectInput) ReadBoltMsg(metadata *messages.BoltMsgMeta, content
 }
 
 func NewJsonObjectOutputFactory() core.OutputFactory {
-	return &jsonObjectOutputFactory{}
+	return &jsonObjectOutputFactory{core.NewLineFraming()}
 }
 
-type jsonObjectOutputFactory struct{}
+type jsonObjectOutputFactory struct {
+	framing core.Framing
+}
 
 func (this *jsonObjectOutputFactory) NewOutput(writer io.Writer) core.Output {
-	return NewJsonObjectOutput(writer)
+	return NewJsonObjectFramedOutput(writer, this.framing)
 }
 
 func NewJsonObjectOutput(writer io.Writer) core.Output {
+	return NewJsonObjectFramedOutput(writer, core.NewLineFraming())
+}
+
+// NewJsonObjectLengthPrefixedOutput returns an output that prefixes
+// messages with their length instead of following them with an "end"
+// statement
+func NewJsonObjectLengthPrefixedOutput(writer io.Writer) core.Output {
+	return NewJsonObjectFramedOutput(writer, core.NewLengthPrefixedFraming())
+}
+
+// NewJsonObjectFramedOutput returns an output that writes messages
+// delimited by the given framing
+func NewJsonObjectFramedOutput(writer io.Writer, framing core.Framing) core.Output {
 	return &jsonObjectOutput{
-		jsonOutput: newJsonOutput(writer),
+		jsonOutput: newJsonOutput(writer, framing),
 	}
 }
 
@@ -87,33 +117,28 @@ type jsonObjectOutput struct {
 	*jsonOutput
 }
 
+// constructOutput returns the contents unchanged, since object json
+// encodes them as they are. They are not copied, since they are encoded
+// before EmitGeneric returns.
 func (this *jsonObjectOutput) constructOutput(contents ...interface{}) []interface{} {
-	contentList := make([]interface{}, len(contents))
-	for i, content := range contents {
-		contentList[i] = content
-	}
-	return contentList
+	return contents
 }
 
 func (this *jsonObjectOutput) EmitGeneric(command, id, stream, msg string, anchors []string, directTask int64, needTaskIds bool, contents ...interface{}) {
-	shellMsg := &messages.ShellMsg{
-		ShellMsgJson: &messages.ShellMsgJson{
-			ShellMsgMeta: &messages.ShellMsgMeta{
-				Command:     command,
-				Anchors:     anchors,
-				Id:          &id,
-				Stream:      &stream,
-				Task:        &directTask,
-				NeedTaskIds: &needTaskIds,
-				Msg:         &msg,
-			},
-			Contents: this.constructOutput(contents...),
-		},
+	if err := this.TryEmitGeneric(command, id, stream, msg, anchors, directTask, needTaskIds, contents...); err != nil {
+		panic(err)
 	}
-	this.SendMsg(shellMsg)
+}
+
+// TryEmitGeneric sends a shell message like EmitGeneric, but returns an
+// error instead of panicking if the contents cannot be marshalled
+func (this *jsonObjectOutput) TryEmitGeneric(command, id, stream, msg string, anchors []string, directTask int64, needTaskIds bool, contents ...interface{}) error {
+	return this.emitGeneric(command, id, stream, msg, anchors, directTask, needTaskIds, this.constructOutput(contents...))
 }
 
 func init() {
 	core.RegisterInput("jsonObject", NewJsonObjectInputFactory())
 	core.RegisterOutput("jsonObject", NewJsonObjectOutputFactory())
+	core.RegisterInput("jsonObjectLengthPrefixed", &jsonObjectInputFactory{core.NewLengthPrefixedFraming()})
+	core.RegisterOutput("jsonObjectLengthPrefixed", &jsonObjectOutputFactory{core.NewLengthPrefixedFraming()})
 }
@@ -15,10 +15,16 @@
 package json
 
 import (
+	"bufio"
 	"bytes"
 	"fmt"
+	"github.com/jsgilmore/gostorm/core"
 	"github.com/jsgilmore/gostorm/messages"
+	"io"
+	"io/ioutil"
+	"log"
 	"math/rand"
+	"strings"
 	"testing"
 )
 
@@ -112,3 +118,204 @@ func TestObjectReadBoltMsg(t *testing.T) {
 		}
 	}
 }
+
+func TestObjectLengthPrefixed(t *testing.T) {
+	buffer := bytes.NewBuffer(nil)
+	output := NewJsonObjectLengthPrefixedOutput(buffer)
+	input := NewJsonObjectLengthPrefixedInput(buffer)
+
+	for i := int64(0); i < 100; i++ {
+		name := fmt.Sprintf("%d\nend\n", i)
+		outMsg := NewTestObj(name, i, []byte(name))
+		output.SendMsg(outMsg)
+		output.Flush()
+
+		inMsg := &testObj{}
+		err := input.ReadMsg(inMsg)
+		checkErr(err, t)
+		if !inMsg.Equal(outMsg) {
+			t.Fatalf("Written message (%+v) does not equal read message (%+v)", outMsg, inMsg)
+		}
+	}
+
+	if err := input.ReadMsg(&testObj{}); err != io.EOF {
+		t.Fatalf("Expected EOF, received: %v", err)
+	}
+}
+
+// newlineFraming terminates messages with a newline, without an "end"
+// statement
+type newlineFraming struct{}
+
+func (this newlineFraming) ReadFrame(reader *bufio.Reader, maxSize int) (data []byte, err error) {
+	data, err = core.ReadLine(reader, maxSize)
+	if err == io.EOF && len(data) > 0 {
+		return nil, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(data, "\n"), nil
+}
+
+func (this newlineFraming) WriteFrame(writer *bufio.Writer, data []byte) {
+	writer.Write(data)
+	writer.WriteByte('\n')
+}
+
+func TestObjectCustomFraming(t *testing.T) {
+	buffer := bytes.NewBuffer(nil)
+	output := NewJsonObjectFramedOutput(buffer, newlineFraming{})
+	input := NewJsonObjectFramedInput(buffer, newlineFraming{})
+
+	outMsg := NewTestObj("test", 1, []byte("test"))
+	output.SendMsg(outMsg)
+	output.Flush()
+	if !bytes.HasSuffix(buffer.Bytes(), []byte("}\n")) {
+		t.Fatalf("Unexpected framing: %q", buffer.Bytes())
+	}
+
+	inMsg := &testObj{}
+	checkErr(input.ReadMsg(inMsg), t)
+	if !inMsg.Equal(outMsg) {
+		t.Fatalf("Written message (%+v) does not equal read message (%+v)", outMsg, inMsg)
+	}
+	if err := input.ReadMsg(&testObj{}); err != io.EOF {
+		t.Fatalf("Expected EOF, received: %v", err)
+	}
+}
+
+func TestObjectMaxMessageSize(t *testing.T) {
+	for _, lengthPrefixed := range []bool{false, true} {
+		buffer := bytes.NewBuffer(nil)
+		var output core.Output
+		var input core.Input
+		if lengthPrefixed {
+			output = NewJsonObjectLengthPrefixedOutput(buffer)
+			input = NewJsonObjectLengthPrefixedInput(buffer)
+		} else {
+			output = NewJsonObjectOutput(buffer)
+			input = NewJsonObjectInput(buffer)
+		}
+		input.(core.MessageSizeLimiter).SetMaxMessageSize(100)
+
+		// Messages of exactly the maximum size are allowed
+		name := strings.Repeat("a", 100-len(`{"Name":"","Number":0,"Data":null}`))
+		output.SendMsg(NewTestObj(name, 0, nil))
+		output.SendMsg(NewTestObj(name+"a", 0, nil))
+		output.Flush()
+
+		checkErr(input.ReadMsg(&testObj{}), t)
+		if err := input.ReadMsg(&testObj{}); err != core.ErrMessageTooLarge {
+			t.Fatalf("Expected message too large, received: %v", err)
+		}
+	}
+}
+
+func TestObjectAutoResync(t *testing.T) {
+	stream := `{"Name":"a"}` + "\nend\n" +
+		// The end statement of this message was lost, so the first
+		// line of the next message is read in its place
+		`{"Name":"b"}` + "\n" + `{"Name":"c"}` + "\nmore\nend\n" +
+		"{not json}\nend\n" +
+		`{"Name":"d"}` + "\nend\n"
+
+	defer core.SetLogger(core.Logger())
+	logs := bytes.NewBuffer(nil)
+	core.SetLogger(log.New(logs, "", 0))
+
+	input := NewJsonObjectInput(strings.NewReader(stream))
+	obj := &testObj{}
+	checkErr(input.ReadMsg(obj), t)
+	if _, ok := input.ReadMsg(obj).(*core.FrameSyncError); !ok {
+		t.Fatalf("Expected a frame sync error without auto resync")
+	}
+
+	input = NewJsonObjectInput(strings.NewReader(stream))
+	input.(core.Resyncer).SetAutoResync(true)
+	for _, name := range []string{"a", "d"} {
+		obj := &testObj{}
+		checkErr(input.ReadMsg(obj), t)
+		if obj.Name != name {
+			t.Fatalf("Read message %q, expected %q", obj.Name, name)
+		}
+	}
+	if err := input.ReadMsg(obj); err != io.EOF {
+		t.Fatalf("Expected EOF, received: %v", err)
+	}
+	for _, skipped := range []string{`{\"Name\":\"b\"}`, `{\"Name\":\"c\"}`, "more", "{not json}"} {
+		if !strings.Contains(logs.String(), skipped) {
+			t.Fatalf("Skipped data %s was not logged in %s", skipped, logs.String())
+		}
+	}
+
+	// The last boundary may lack its newline
+	input = NewJsonObjectInput(strings.NewReader(`{"Name":"a"}` + "\nnot end\nend"))
+	input.(core.Resyncer).SetAutoResync(true)
+	if err := input.ReadMsg(obj); err != io.EOF {
+		t.Fatalf("Expected EOF, received: %v", err)
+	}
+
+	// A stream that ends before the next boundary cannot be resynced
+	input = NewJsonObjectInput(strings.NewReader(`{"Name":"a"}` + "\nnot end\n"))
+	input.(core.Resyncer).SetAutoResync(true)
+	if err := input.ReadMsg(obj); err != io.ErrUnexpectedEOF {
+		t.Fatalf("Expected unexpected EOF, received: %v", err)
+	}
+}
+
+// FuzzObjectReadMsg reads every kind of message from arbitrary input,
+// which must return errors instead of panicking
+func FuzzObjectReadMsg(f *testing.F) {
+	for _, seed := range []string{
+		`{"pidDir":"/tmp","context":{"task->component":{"1":"spout"},"taskid":1},"conf":{"topology.name":"test"}}` + "\nend\n",
+		`{"id":"1","comp":"spout","stream":"default","task":1,"tuple":["a",{"Name":"b"}]}` + "\nend\n",
+		`{"command":"ack","id":-6955786537413359385}` + "\nend\n",
+		"[1,2]\nend\n{\"command\":\"next\"}\nend\n",
+		"\nend\n",
+		"{}\n",
+		"{}\nnot end\n",
+		"\xff\xfe\nend\n",
+		"[1,\nend\n",
+	} {
+		f.Add([]byte(seed))
+	}
+	// Malformed messages are logged
+	defer core.SetLogger(core.Logger())
+	core.SetLogger(log.New(ioutil.Discard, "", 0))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		input := NewJsonObjectInput(bytes.NewReader(data))
+		input.(core.MessageSizeLimiter).SetMaxMessageSize(1 << 16)
+		// Every read consumes at least one frame, or fails once the
+		// input is exhausted
+		for i := 0; i <= len(data); i++ {
+			var err error
+			switch i % 5 {
+			case 0:
+				err = input.ReadMsg(&messages.Context{})
+			case 1:
+				var name string
+				obj := &testObj{}
+				err = input.ReadBoltMsg(&messages.BoltMsgMeta{}, &name, obj)
+			case 2:
+				err = input.ReadMsg(&messages.SpoutMsg{})
+			case 3:
+				_, err = input.(core.CheckedInput).TryReadTaskIds()
+			case 4:
+				err = input.ReadMsg(&messages.ShellMsg{ShellMsgJson: &messages.ShellMsgJson{}})
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkObjectEmitGeneric(b *testing.B) {
+	output := NewJsonObjectOutput(ioutil.Discard)
+	anchors := []string{"-6955786537413359385"}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		output.EmitGeneric("emit", "", "default", "", anchors, 0, false, "snow white and the seven dwarfs", 7)
+	}
+	output.Flush()
+}
@@ -45,9 +45,24 @@ func NewProtobufInput(reader io.Reader) core.Input {
 }
 
 type protobufInput struct {
-	reader      *bufio.Reader
-	tupleBuffer *list.List
-	bufferPool  BufferPool
+	reader         *bufio.Reader
+	tupleBuffer    *list.List
+	bufferPool     BufferPool
+	maxMessageSize int
+	trace          *core.Trace
+}
+
+// SetTrace sets the trace to which the frames read from Storm are
+// written
+func (this *protobufInput) SetTrace(trace *core.Trace) {
+	this.trace = trace
+}
+
+// SetMaxMessageSize sets the maximum size of a message read from Storm,
+// after which reads return core.ErrMessageTooLarge. A size of zero,
+// which is the default, means that messages are unlimited.
+func (this *protobufInput) SetMaxMessageSize(n int) {
+	this.maxMessageSize = n
 }
 
 func (this *protobufInput) readData() (data []byte, err error) {
@@ -55,6 +70,9 @@ func (this *protobufInput) readData() (data []byte, err error) {
 	if err != nil {
 		return nil, err
 	}
+	if this.maxMessageSize > 0 && msgLen > uint64(this.maxMessageSize) {
+		return nil, core.ErrMessageTooLarge
+	}
 	data = this.bufferPool.New(int(msgLen))
 	// ReadFull is required since a bufio reader can return less data
 	// than required in a single read
@@ -62,6 +80,9 @@ func (this *protobufInput) readData() (data []byte, err error) {
 	if err != nil {
 		return nil, err
 	}
+	// Messages are delimited in the same way as the length prefixed
+	// framing of the text based encodings
+	this.trace.WriteFrame(core.TraceIn, core.NewLengthPrefixedFraming(), data)
 	return data, nil
 }
 
@@ -91,9 +112,12 @@ func (this *protobufInput) ReadMsg(msg interface{}) (err error) {
 	return err
 }
 
-// TODO This asynchronous behaviour should still be added to protobuf
+// isTuple determines whether a received message is a tuple or a list of
+// task ids. The first field of a tuple (BoltMsgProto) is always length
+// delimited, while the task ids of a TaskIds message are varint encoded.
+// An empty message can only be an empty list of task ids.
 func isTuple(data []byte) bool {
-	return false
+	return len(data) > 0 && data[0]&0x7 == proto.WireBytes
 }
 
 func (this *protobufInput) ReadTaskIds() (taskIds []int32) {
@@ -110,6 +134,7 @@ func (this *protobufInput) ReadTaskIds() (taskIds []int32) {
 		// when we actually read the data.
 		bufferedData := make([]byte, len(data))
 		copy(bufferedData, data)
+		this.bufferPool.Dispose(data)
 		this.tupleBuffer.PushBack(bufferedData)
 		return this.ReadTaskIds()
 	}
@@ -177,6 +202,7 @@ func NewProtobufOutput(writer io.Writer) core.Output {
 	}
 
 	return &protobufOutput{
+		dest:       writer,
 		writer:     bufio.NewWriter(writer),
 		bufferPool: NewBufferPoolSingle(NewAllocatorHeap()),
 		shellMsg:   shellMsg,
@@ -184,9 +210,16 @@ func NewProtobufOutput(writer io.Writer) core.Output {
 }
 
 type protobufOutput struct {
+	dest       io.Writer
 	writer     *bufio.Writer
 	bufferPool BufferPool
 	shellMsg   *messages.ShellMsg
+	trace      *core.Trace
+}
+
+// SetTrace sets the trace to which the frames sent to Storm are written
+func (this *protobufOutput) SetTrace(trace *core.Trace) {
+	this.trace = trace
 }
 
 func varintSize(x uint64) (n int) {
@@ -232,6 +265,7 @@ func (this *protobufOutput) SendMsg(msg interface{}) {
 	if err != nil {
 		panic(err)
 	}
+	this.trace.Frame(core.TraceOut, buffer)
 	this.bufferPool.Dispose(buffer)
 }
 
@@ -264,6 +298,15 @@ func (this *protobufOutput) Flush() {
 	this.writer.Flush()
 }
 
+// Sync flushes the buffered messages and commits them to stable storage
+// if the underlying writer is a file
+func (this *protobufOutput) Sync() error {
+	if err := this.writer.Flush(); err != nil {
+		return err
+	}
+	return core.SyncWriter(this.dest)
+}
+
 func init() {
 	core.RegisterInput("protobuf", NewProtobufInputFactory())
 	core.RegisterOutput("protobuf", NewProtobufOutputFactory())
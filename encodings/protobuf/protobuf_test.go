@@ -167,3 +167,48 @@ func TestReadBoltMsg(t *testing.T) {
 		}
 	}
 }
+
+func TestInterleavedTaskIds(t *testing.T) {
+	buffer := new(bytes.Buffer)
+	output := NewProtobufOutput(buffer)
+	input := NewProtobufInput(buffer)
+
+	outMsg := newTestObj("test", 1, []byte("test"))
+	outProto, err := proto.Marshal(outMsg)
+	checkErr(err, t)
+	outTuple := &messages.BoltMsg{
+		BoltMsgProto: &messages.BoltMsgProto{
+			BoltMsgMeta: &messages.BoltMsgMeta{
+				Id:     "1",
+				Comp:   "comp",
+				Stream: "default",
+				Task:   1,
+			},
+			Contents: [][]byte{outProto},
+		},
+	}
+
+	// Storm may send a tuple before the task ids of an emission
+	output.SendMsg(outTuple)
+	output.SendMsg(&messages.TaskIds{TaskIds: []int32{2, 3}})
+	output.SendMsg(&messages.TaskIds{})
+	output.Flush()
+
+	taskIds := input.ReadTaskIds()
+	if len(taskIds) != 2 || taskIds[0] != 2 || taskIds[1] != 3 {
+		t.Fatalf("Unexpected task ids: %v", taskIds)
+	}
+	if taskIds = input.ReadTaskIds(); len(taskIds) != 0 {
+		t.Fatalf("Expected no task ids, got: %v", taskIds)
+	}
+
+	inMsg := &messages.Test{}
+	inMeta := &messages.BoltMsgMeta{}
+	checkErr(input.ReadBoltMsg(inMeta, inMsg), t)
+	if !inMeta.Equal(outTuple.BoltMsgProto.BoltMsgMeta) {
+		t.Fatalf("Tuple metadata (%+v) does not equal read Tuple metadata (%+v)", outTuple.BoltMsgProto.BoltMsgMeta, inMeta)
+	}
+	if !inMsg.Equal(outMsg) {
+		t.Fatalf("Tuple data (%+v) does not equal read tuple data (%+v)", outMsg, inMsg)
+	}
+}
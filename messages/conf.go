@@ -0,0 +1,199 @@
+//   Copyright 2013 Vastech SA (PTY) LTD
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package messages
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// MessageTimeoutKey is the configuration key of the time after which
+// Storm fails a tuple that has not been acked
+const MessageTimeoutKey = "topology.message.timeout.secs"
+
+// TickFrequencyKey is the configuration key of the interval at which
+// Storm sends tick tuples to a component
+const TickFrequencyKey = "topology.tick.tuple.freq.secs"
+
+// confKind is the JSON type of a configuration value, which is lost
+// when the value is converted to a string
+type confKind byte
+
+const (
+	// confUnknown is the kind of values that were not decoded from JSON,
+	// such as those received through the protobuf encoding
+	confUnknown confKind = iota
+	confString
+	confNumber
+	confBool
+	confNull
+	confOther
+)
+
+// jsonConfKind returns the kind of a value decoded from JSON
+func jsonConfKind(value interface{}) confKind {
+	switch value.(type) {
+	case string:
+		return confString
+	case float64:
+		return confNumber
+	case bool:
+		return confBool
+	case nil:
+		return confNull
+	default:
+		return confOther
+	}
+}
+
+func (this *Conf) setKind(kind confKind) {
+	k := int32(kind)
+	this.Kind = &k
+}
+
+func (this *Conf) kind() confKind {
+	return confKind(this.GetKind())
+}
+
+// conf returns the configuration value with the given key, if it is of
+// the given kind or its kind is unknown
+func (this *Context) conf(key string, kind confKind) (string, bool) {
+	for _, conf := range this.GetConfs() {
+		if conf.GetKey() == key {
+			if conf.kind() != kind && conf.kind() != confUnknown {
+				return "", false
+			}
+			return conf.GetValue(), true
+		}
+	}
+	return "", false
+}
+
+// ConfString returns the configuration value with the given key. The
+// boolean is false if the key is not present or its value is not a
+// string, such as a number or null.
+func (this *Context) ConfString(key string) (string, bool) {
+	return this.conf(key, confString)
+}
+
+// ConfInt returns the configuration value with the given key as an
+// integer. JSON numbers are decoded as floats, so integral floats, also
+// those in exponent notation, are converted. The boolean is false if the
+// key is not present or its value is not an integer.
+func (this *Context) ConfInt(key string) (int64, bool) {
+	value, ok := this.conf(key, confNumber)
+	if !ok {
+		return 0, false
+	}
+	if i, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return i, true
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil || f != float64(int64(f)) {
+		return 0, false
+	}
+	return int64(f), true
+}
+
+// ConfBool returns the configuration value with the given key as a
+// boolean. The second boolean is false if the key is not present or its
+// value is not a boolean.
+func (this *Context) ConfBool(key string) (bool, bool) {
+	value, ok := this.conf(key, confBool)
+	if !ok {
+		return false, false
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, false
+	}
+	return b, true
+}
+
+// MessageTimeout returns the time after which Storm fails a tuple that
+// has not been acked, as configured by topology.message.timeout.secs.
+func (this *Context) MessageTimeout() (time.Duration, bool) {
+	secs, ok := this.ConfInt(MessageTimeoutKey)
+	if !ok {
+		return 0, false
+	}
+	return time.Duration(secs) * time.Second, true
+}
+
+// TickFrequency returns the interval at which Storm sends tick tuples to
+// the component, as configured by topology.tick.tuple.freq.secs. The
+// boolean is false if tick tuples are not enabled, which is the case
+// when the key is not present or its value is not a positive integer.
+func (this *Context) TickFrequency() (time.Duration, bool) {
+	secs, ok := this.ConfInt(TickFrequencyKey)
+	if !ok || secs <= 0 {
+		return 0, false
+	}
+	return time.Duration(secs) * time.Second, true
+}
+
+// setRawConf keeps the configuration as it was received in the handshake
+func (this *Context) setRawConf(data []byte) {
+	this.RawConf = data
+}
+
+// rawConf returns the configuration as it was received in the
+// handshake, if it was kept
+func (this *Context) rawConf() ([]byte, bool) {
+	return this.RawConf, this.RawConf != nil
+}
+
+// UnpackConf decodes the whole configuration into the given value, as
+// json.Unmarshal does, which gives typed access to the configuration,
+// including nested values:
+//
+//	var conf struct {
+//		Name    string `json:"topology.name"`
+//		Servers []string `json:"myapp.servers"`
+//	}
+//	err := context.UnpackConf(&conf)
+//
+// The configuration is decoded from the JSON that was received in the
+// handshake, so large integers keep their precision. A context that was
+// not read from a JSON handshake, such as one that was built by hand,
+// only holds the configuration values as text. In that case, strings,
+// numbers, booleans and nulls are still decoded, but an error is
+// returned if the configuration holds a list or a map.
+func (this *Context) UnpackConf(dest interface{}) error {
+	data, ok := this.rawConf()
+	if !ok {
+		values := make(map[string]json.RawMessage)
+		for _, conf := range this.GetConfs() {
+			switch conf.kind() {
+			case confNumber, confBool:
+				values[conf.GetKey()] = json.RawMessage(conf.GetValue())
+			case confNull:
+				values[conf.GetKey()] = json.RawMessage("null")
+			case confString, confUnknown:
+				value, _ := json.Marshal(conf.GetValue())
+				values[conf.GetKey()] = value
+			default:
+				return fmt.Errorf("GoStorm: the value of configuration %s cannot be unpacked, since the handshake was not kept", conf.GetKey())
+			}
+		}
+		var err error
+		if data, err = json.Marshal(values); err != nil {
+			return err
+		}
+	}
+	return json.Unmarshal(data, dest)
+}
@@ -0,0 +1,134 @@
+//   Copyright 2013 Vastech SA (PTY) LTD
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package messages
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+)
+
+// ShellMsgEncoder encodes shell messages as JSON into a buffer that is
+// reused from message to message. It produces the same encoding as
+// MarshalJSON, but writes the fields of the message directly instead of
+// building a map and marshalling it, which saves most of the allocations
+// of an emission. Only the tuple fields are encoded with encoding/json.
+// A ShellMsgEncoder is not safe for concurrent use.
+type ShellMsgEncoder struct {
+	buffer  bytes.Buffer
+	encoder *json.Encoder
+	scratch [20]byte
+}
+
+// NewShellMsgEncoder returns an encoder for shell messages
+func NewShellMsgEncoder() *ShellMsgEncoder {
+	this := &ShellMsgEncoder{}
+	this.encoder = json.NewEncoder(&this.buffer)
+	return this
+}
+
+// Encode returns the JSON encoding of the message. The returned slice
+// is only valid until the next call to Encode.
+func (this *ShellMsgEncoder) Encode(msg *ShellMsg) ([]byte, error) {
+	this.buffer.Reset()
+	meta := msg.ShellMsgJson.ShellMsgMeta
+	command := meta.Command
+
+	// The fields are written in the sorted order in which json.Marshal
+	// writes the keys of a map
+	this.buffer.WriteByte('{')
+	if anchors := meta.GetAnchors(); len(anchors) > 0 {
+		this.buffer.WriteString(`"anchors":[`)
+		for i, anchor := range anchors {
+			if i > 0 {
+				this.buffer.WriteByte(',')
+			}
+			if err := this.writeString(anchor); err != nil {
+				return nil, err
+			}
+		}
+		this.buffer.WriteString("],")
+	}
+	this.buffer.WriteString(`"command":`)
+	if err := this.writeString(command); err != nil {
+		return nil, err
+	}
+	if id := meta.GetId(); len(id) > 0 {
+		this.buffer.WriteString(`,"id":`)
+		if err := this.writeString(id); err != nil {
+			return nil, err
+		}
+	}
+	if text := meta.GetMsg(); len(text) > 0 {
+		this.buffer.WriteString(`,"msg":`)
+		if err := this.writeString(text); err != nil {
+			return nil, err
+		}
+	}
+	if command == "emit" && !meta.GetNeedTaskIds() {
+		this.buffer.WriteString(`,"need_task_ids":false`)
+	}
+	if stream := meta.GetStream(); len(stream) > 0 {
+		this.buffer.WriteString(`,"stream":`)
+		if err := this.writeString(stream); err != nil {
+			return nil, err
+		}
+	}
+	if task := meta.GetTask(); task != 0 {
+		this.buffer.WriteString(`,"task":`)
+		this.buffer.Write(strconv.AppendInt(this.scratch[:0], task, 10))
+	}
+	// Emissions always contain a tuple, even if it has no fields,
+	// since Storm rejects emissions without one
+	if contents := msg.ShellMsgJson.Contents; len(contents) > 0 || command == "emit" {
+		this.buffer.WriteString(`,"tuple":[`)
+		for i, content := range contents {
+			if i > 0 {
+				this.buffer.WriteByte(',')
+			}
+			if err := this.writeValue(content); err != nil {
+				return nil, err
+			}
+		}
+		this.buffer.WriteByte(']')
+	}
+	this.buffer.WriteByte('}')
+	return this.buffer.Bytes(), nil
+}
+
+// writeString writes a string as a JSON string. Strings that do not need
+// to be escaped are written directly, while others are escaped by
+// encoding/json, so that they are escaped exactly as by json.Marshal.
+func (this *ShellMsgEncoder) writeString(s string) error {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < 0x20 || c >= 0x80 || c == '"' || c == '\\' || c == '<' || c == '>' || c == '&' {
+			return this.writeValue(s)
+		}
+	}
+	this.buffer.WriteByte('"')
+	this.buffer.WriteString(s)
+	this.buffer.WriteByte('"')
+	return nil
+}
+
+// writeValue writes a value with encoding/json, without the newline
+// that the encoder writes after every value
+func (this *ShellMsgEncoder) writeValue(value interface{}) error {
+	if err := this.encoder.Encode(value); err != nil {
+		return err
+	}
+	this.buffer.Truncate(this.buffer.Len() - 1)
+	return nil
+}
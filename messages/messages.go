@@ -27,7 +27,7 @@ type topologyContextJson struct {
 type contextJson struct {
 	Conf     map[string]interface{} `json:"conf"`
 	Topology *topologyContextJson   `json:"context"`
-	PidDir   string                 `json:"pidDir"`
+	PidDir   *string                `json:"pidDir"`
 }
 
 // Multilang message definition:
@@ -53,10 +53,19 @@ func (this *Context) UnmarshalJSON(data []byte) error {
 	msg := &contextJson{}
 	err := json.Unmarshal(data, msg)
 	if err != nil {
-		return err
+		return fmt.Errorf("GoStorm: first message from Storm is not a valid handshake: %v", err)
 	}
 
-	this.PidDir = msg.PidDir
+	// A message without these fields is not a handshake, which usually
+	// means that we are reading from the wrong file descriptor
+	if msg.PidDir == nil {
+		return fmt.Errorf("GoStorm: handshake is missing the pidDir field: %s", data)
+	}
+	if msg.Topology == nil {
+		return fmt.Errorf("GoStorm: handshake is missing the context field: %s", data)
+	}
+
+	this.PidDir = *msg.PidDir
 
 	// Convert the topology mapping from a map to a list
 	this.Topology = &Topology{
@@ -76,8 +85,21 @@ func (this *Context) UnmarshalJSON(data []byte) error {
 			Key:   key,
 			Value: fmt.Sprintf("%v", value),
 		}
+		// Keep the JSON type of the value for the typed accessors
+		conf.setKind(jsonConfKind(value))
 		this.Confs = append(this.Confs, conf)
 	}
+
+	// Keep the configuration as it was received for UnpackConf
+	raw := &struct {
+		Conf json.RawMessage `json:"conf"`
+	}{}
+	if err = json.Unmarshal(data, raw); err != nil {
+		return err
+	}
+	if raw.Conf != nil {
+		this.setRawConf(raw.Conf)
+	}
 	return nil
 }
 
@@ -137,10 +159,13 @@ func (this *BoltMsg) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
-// Multilang message definitions:
+// SpoutMsg is a command that Storm sends to a spout. Multilang message
+// definitions:
 // {"command": "next"}
 // {"command": "ack", "id": "1231231"}
 // {"command": "fail", "id": "1231231"}
+// {"command": "activate"}
+// {"command": "deactivate"}
 
 func (this *SpoutMsg) MarshalJSON() ([]byte, error) {
 	if len(this.Id) > 0 {
@@ -151,12 +176,62 @@ func (this *SpoutMsg) MarshalJSON() ([]byte, error) {
 			return []byte(`{"command": "next"}`), nil
 		case "sync":
 			return []byte(`{"command": "sync"}`), nil
+		case "activate", "deactivate":
+			return []byte(fmt.Sprintf(`{"command": "%s"}`, this.Command)), nil
 		default:
 			panic("GoStorm: unknown spout command specified")
 		}
 	}
 }
 
+// spoutMsgJson is the form in which Storm sends commands to a spout. The
+// id is kept raw, since Storm sends back the id that the spout emitted,
+// which components written in other languages may emit as a number.
+type spoutMsgJson struct {
+	Command string          `json:"command"`
+	Id      json.RawMessage `json:"id"`
+}
+
+// UnmarshalJSON reads a spout command. An id sent as a JSON number is
+// kept as its decimal text, so that ids are always strings.
+func (this *SpoutMsg) UnmarshalJSON(data []byte) error {
+	msg := &spoutMsgJson{}
+	err := json.Unmarshal(data, msg)
+	if err != nil {
+		return err
+	}
+	this.Command = msg.Command
+	this.Id = ""
+	if len(msg.Id) == 0 || string(msg.Id) == "null" {
+		return nil
+	}
+	if msg.Id[0] == '"' {
+		return json.Unmarshal(msg.Id, &this.Id)
+	}
+	var number json.Number
+	err = json.Unmarshal(msg.Id, &number)
+	if err != nil {
+		return fmt.Errorf("GoStorm: spout command %s has an id that is neither a string nor a number: %s", msg.Command, msg.Id)
+	}
+	this.Id = number.String()
+	return nil
+}
+
+// Multilang metrics message definition:
+//  {
+//	"command": "metrics",
+//	// The name of the metric, which has to be registered as an
+//	// IShellMetric of the shell component
+//	"name": "metric_name",
+//	// The parameters passed to the updateMetricFromRPC method of the metric
+//	"params": 42
+//  }
+type MetricsMsg struct {
+	Command string      `json:"command"`
+	Name    string      `json:"name"`
+	Params  interface{} `json:"params"`
+}
+
 // Multilang bolt emission message definition:
 //  {
 //	"command": "emit",
@@ -197,32 +272,7 @@ type ShellMsg struct {
 }
 
 func (this *ShellMsg) MarshalJSON() ([]byte, error) {
-	command := this.ShellMsgJson.ShellMsgMeta.Command
-	result := map[string]interface{}{
-		"command": command,
-	}
-	if id := this.ShellMsgJson.ShellMsgMeta.GetId(); len(id) > 0 {
-		result["id"] = id
-	}
-	if anchors := this.ShellMsgJson.ShellMsgMeta.GetAnchors(); len(anchors) > 0 {
-		result["anchors"] = anchors
-	}
-	if stream := this.ShellMsgJson.ShellMsgMeta.GetStream(); len(stream) > 0 {
-		result["stream"] = stream
-	}
-	if task := this.ShellMsgJson.ShellMsgMeta.GetTask(); task != 0 {
-		result["task"] = task
-	}
-	if msg := this.ShellMsgJson.ShellMsgMeta.GetMsg(); len(msg) > 0 {
-		result["msg"] = msg
-	}
-	if contents := this.ShellMsgJson.Contents; len(contents) > 0 {
-		result["tuple"] = contents
-	}
-	if command == "emit" && !this.ShellMsgJson.ShellMsgMeta.GetNeedTaskIds() {
-		result["need_task_ids"] = false
-	}
-	return json.Marshal(result)
+	return NewShellMsgEncoder().Encode(this)
 }
 
 func (this *ShellMsg) UnmarshalJSON(data []byte) error {
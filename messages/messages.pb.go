@@ -93,6 +93,7 @@ func (m *Topology) GetTaskComponentMappings() []*TaskComponentMapping {
 type Conf struct {
 	Key              string `protobuf:"bytes,1,opt" json:"Key"`
 	Value            string `protobuf:"bytes,2,opt" json:"Value"`
+	Kind             *int32 `protobuf:"varint,3,opt" json:"Kind,omitempty"`
 	XXX_unrecognized []byte `json:"-"`
 }
 
@@ -113,10 +114,18 @@ func (m *Conf) GetValue() string {
 	return ""
 }
 
+func (m *Conf) GetKind() int32 {
+	if m != nil && m.Kind != nil {
+		return *m.Kind
+	}
+	return 0
+}
+
 type Context struct {
 	PidDir           string    `protobuf:"bytes,1,opt" json:"PidDir"`
 	Topology         *Topology `protobuf:"bytes,2,opt" json:"Topology,omitempty"`
 	Confs            []*Conf   `protobuf:"bytes,3,rep" json:"Confs,omitempty"`
+	RawConf          []byte    `protobuf:"bytes,4,opt" json:"RawConf,omitempty"`
 	XXX_unrecognized []byte    `json:"-"`
 }
 
@@ -144,6 +153,13 @@ func (m *Context) GetConfs() []*Conf {
 	return nil
 }
 
+func (m *Context) GetRawConf() []byte {
+	if m != nil {
+		return m.RawConf
+	}
+	return nil
+}
+
 type Pid struct {
 	Pid              int32  `protobuf:"varint,1,opt" json:"Pid"`
 	XXX_unrecognized []byte `json:"-"`
@@ -607,6 +623,23 @@ func (m *Conf) Unmarshal(data []byte) error {
 			}
 			m.Value = string(data[index:postIndex])
 			index = postIndex
+		case 3:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Kind", wireType)
+			}
+			var v int32
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				v |= (int32(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.Kind = &v
 		default:
 			var sizeOfWire int
 			for {
@@ -721,6 +754,28 @@ func (m *Context) Unmarshal(data []byte) error {
 			m.Confs = append(m.Confs, &Conf{})
 			m.Confs[len(m.Confs)-1].Unmarshal(data[index:postIndex])
 			index = postIndex
+		case 4:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field RawConf", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				byteLen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			postIndex := index + byteLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.RawConf = append(m.RawConf, data[index:postIndex]...)
+			index = postIndex
 		default:
 			var sizeOfWire int
 			for {
@@ -1575,6 +1630,7 @@ func (this *Conf) String() string {
 	s := strings.Join([]string{`&Conf{`,
 		`Key:` + fmt1.Sprintf("%v", this.Key) + `,`,
 		`Value:` + fmt1.Sprintf("%v", this.Value) + `,`,
+		`Kind:` + valueToStringMessages(this.Kind) + `,`,
 		`XXX_unrecognized:` + fmt1.Sprintf("%v", this.XXX_unrecognized) + `,`,
 		`}`,
 	}, "")
@@ -1588,6 +1644,7 @@ func (this *Context) String() string {
 		`PidDir:` + fmt1.Sprintf("%v", this.PidDir) + `,`,
 		`Topology:` + strings.Replace(fmt1.Sprintf("%v", this.Topology), "Topology", "Topology", 1) + `,`,
 		`Confs:` + strings.Replace(fmt1.Sprintf("%v", this.Confs), "Conf", "Conf", 1) + `,`,
+		`RawConf:` + fmt1.Sprintf("%v", this.RawConf) + `,`,
 		`XXX_unrecognized:` + fmt1.Sprintf("%v", this.XXX_unrecognized) + `,`,
 		`}`,
 	}, "")
@@ -1737,6 +1794,9 @@ func (m *Conf) Size() (n int) {
 	n += 1 + l + sovMessages(uint64(l))
 	l = len(m.Value)
 	n += 1 + l + sovMessages(uint64(l))
+	if m.Kind != nil {
+		n += 1 + sovMessages(uint64(*m.Kind))
+	}
 	if m.XXX_unrecognized != nil {
 		n += len(m.XXX_unrecognized)
 	}
@@ -1757,6 +1817,10 @@ func (m *Context) Size() (n int) {
 			n += 1 + l + sovMessages(uint64(l))
 		}
 	}
+	if m.RawConf != nil {
+		l = len(m.RawConf)
+		n += 1 + l + sovMessages(uint64(l))
+	}
 	if m.XXX_unrecognized != nil {
 		n += len(m.XXX_unrecognized)
 	}
@@ -1941,8 +2005,15 @@ func NewPopulatedConf(r randyMessages, easy bool) *Conf {
 	this := &Conf{}
 	this.Key = randStringMessages(r)
 	this.Value = randStringMessages(r)
+	if r.Intn(10) != 0 {
+		v2 := r.Int31()
+		if r.Intn(2) == 0 {
+			v2 *= -1
+		}
+		this.Kind = &v2
+	}
 	if !easy && r.Intn(10) != 0 {
-		this.XXX_unrecognized = randUnrecognizedMessages(r, 3)
+		this.XXX_unrecognized = randUnrecognizedMessages(r, 4)
 	}
 	return this
 }
@@ -1954,14 +2025,21 @@ func NewPopulatedContext(r randyMessages, easy bool) *Context {
 		this.Topology = NewPopulatedTopology(r, easy)
 	}
 	if r.Intn(10) != 0 {
-		v2 := r.Intn(10)
-		this.Confs = make([]*Conf, v2)
-		for i := 0; i < v2; i++ {
+		v3 := r.Intn(10)
+		this.Confs = make([]*Conf, v3)
+		for i := 0; i < v3; i++ {
 			this.Confs[i] = NewPopulatedConf(r, easy)
 		}
 	}
+	if r.Intn(10) != 0 {
+		v4 := r.Intn(100)
+		this.RawConf = make([]byte, v4)
+		for i := 0; i < v4; i++ {
+			this.RawConf[i] = byte(r.Intn(256))
+		}
+	}
 	if !easy && r.Intn(10) != 0 {
-		this.XXX_unrecognized = randUnrecognizedMessages(r, 4)
+		this.XXX_unrecognized = randUnrecognizedMessages(r, 5)
 	}
 	return this
 }
@@ -1999,12 +2077,12 @@ func NewPopulatedBoltMsgProto(r randyMessages, easy bool) *BoltMsgProto {
 		this.BoltMsgMeta = NewPopulatedBoltMsgMeta(r, easy)
 	}
 	if r.Intn(10) != 0 {
-		v3 := r.Intn(100)
-		this.Contents = make([][]byte, v3)
-		for i := 0; i < v3; i++ {
-			v4 := r.Intn(100)
-			this.Contents[i] = make([]byte, v4)
-			for j := 0; j < v4; j++ {
+		v5 := r.Intn(100)
+		this.Contents = make([][]byte, v5)
+		for i := 0; i < v5; i++ {
+			v6 := r.Intn(100)
+			this.Contents[i] = make([]byte, v6)
+			for j := 0; j < v6; j++ {
 				this.Contents[i][j] = byte(r.Intn(256))
 			}
 		}
@@ -2018,9 +2096,9 @@ func NewPopulatedBoltMsgProto(r randyMessages, easy bool) *BoltMsgProto {
 func NewPopulatedTaskIds(r randyMessages, easy bool) *TaskIds {
 	this := &TaskIds{}
 	if r.Intn(10) != 0 {
-		v5 := r.Intn(100)
-		this.TaskIds = make([]int32, v5)
-		for i := 0; i < v5; i++ {
+		v7 := r.Intn(100)
+		this.TaskIds = make([]int32, v7)
+		for i := 0; i < v7; i++ {
 			this.TaskIds[i] = r.Int31()
 			if r.Intn(2) == 0 {
 				this.TaskIds[i] *= -1
@@ -2047,34 +2125,34 @@ func NewPopulatedShellMsgMeta(r randyMessages, easy bool) *ShellMsgMeta {
 	this := &ShellMsgMeta{}
 	this.Command = randStringMessages(r)
 	if r.Intn(10) != 0 {
-		v6 := randStringMessages(r)
-		this.Id = &v6
+		v8 := randStringMessages(r)
+		this.Id = &v8
 	}
 	if r.Intn(10) != 0 {
-		v7 := r.Intn(10)
-		this.Anchors = make([]string, v7)
-		for i := 0; i < v7; i++ {
+		v9 := r.Intn(10)
+		this.Anchors = make([]string, v9)
+		for i := 0; i < v9; i++ {
 			this.Anchors[i] = randStringMessages(r)
 		}
 	}
 	if r.Intn(10) != 0 {
-		v8 := randStringMessages(r)
-		this.Stream = &v8
+		v10 := randStringMessages(r)
+		this.Stream = &v10
 	}
 	if r.Intn(10) != 0 {
-		v9 := r.Int63()
+		v11 := r.Int63()
 		if r.Intn(2) == 0 {
-			v9 *= -1
+			v11 *= -1
 		}
-		this.Task = &v9
+		this.Task = &v11
 	}
 	if r.Intn(10) != 0 {
-		v10 := bool(r.Intn(2) == 0)
-		this.NeedTaskIds = &v10
+		v12 := bool(r.Intn(2) == 0)
+		this.NeedTaskIds = &v12
 	}
 	if r.Intn(10) != 0 {
-		v11 := randStringMessages(r)
-		this.Msg = &v11
+		v13 := randStringMessages(r)
+		this.Msg = &v13
 	}
 	if !easy && r.Intn(10) != 0 {
 		this.XXX_unrecognized = randUnrecognizedMessages(r, 8)
@@ -2088,12 +2166,12 @@ func NewPopulatedShellMsgProto(r randyMessages, easy bool) *ShellMsgProto {
 		this.ShellMsgMeta = NewPopulatedShellMsgMeta(r, easy)
 	}
 	if r.Intn(10) != 0 {
-		v12 := r.Intn(100)
-		this.Contents = make([][]byte, v12)
-		for i := 0; i < v12; i++ {
-			v13 := r.Intn(100)
-			this.Contents[i] = make([]byte, v13)
-			for j := 0; j < v13; j++ {
+		v14 := r.Intn(100)
+		this.Contents = make([][]byte, v14)
+		for i := 0; i < v14; i++ {
+			v15 := r.Intn(100)
+			this.Contents[i] = make([]byte, v15)
+			for j := 0; j < v15; j++ {
 				this.Contents[i][j] = byte(r.Intn(256))
 			}
 		}
@@ -2111,9 +2189,9 @@ func NewPopulatedTest(r randyMessages, easy bool) *Test {
 	if r.Intn(2) == 0 {
 		this.Number *= -1
 	}
-	v14 := r.Intn(100)
-	this.Data = make([]byte, v14)
-	for i := 0; i < v14; i++ {
+	v16 := r.Intn(100)
+	this.Data = make([]byte, v16)
+	for i := 0; i < v16; i++ {
 		this.Data[i] = byte(r.Intn(256))
 	}
 	if !easy && r.Intn(10) != 0 {
@@ -2139,9 +2217,9 @@ func randUTF8RuneMessages(r randyMessages) rune {
 	return res
 }
 func randStringMessages(r randyMessages) string {
-	v15 := r.Intn(100)
-	tmps := make([]rune, v15)
-	for i := 0; i < v15; i++ {
+	v17 := r.Intn(100)
+	tmps := make([]rune, v17)
+	for i := 0; i < v17; i++ {
 		tmps[i] = randUTF8RuneMessages(r)
 	}
 	return string(tmps)
@@ -2163,11 +2241,11 @@ func randFieldMessages(data []byte, r randyMessages, fieldNumber int, wire int)
 	switch wire {
 	case 0:
 		data = encodeVarintPopulateMessages(data, uint64(key))
-		v16 := r.Int63()
+		v18 := r.Int63()
 		if r.Intn(2) == 0 {
-			v16 *= -1
+			v18 *= -1
 		}
-		data = encodeVarintPopulateMessages(data, uint64(v16))
+		data = encodeVarintPopulateMessages(data, uint64(v18))
 	case 1:
 		data = encodeVarintPopulateMessages(data, uint64(key))
 		data = append(data, byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)))
@@ -2278,6 +2356,11 @@ func (m *Conf) MarshalTo(data []byte) (n int, err error) {
 	i++
 	i = encodeVarintMessages(data, i, uint64(len(m.Value)))
 	i += copy(data[i:], m.Value)
+	if m.Kind != nil {
+		data[i] = 0x18
+		i++
+		i = encodeVarintMessages(data, i, uint64(*m.Kind))
+	}
 	if m.XXX_unrecognized != nil {
 		i += copy(data[i:], m.XXX_unrecognized)
 	}
@@ -2324,6 +2407,12 @@ func (m *Context) MarshalTo(data []byte) (n int, err error) {
 			i += n
 		}
 	}
+	if m.RawConf != nil {
+		data[i] = 0x22
+		i++
+		i = encodeVarintMessages(data, i, uint64(len(m.RawConf)))
+		i += copy(data[i:], m.RawConf)
+	}
 	if m.XXX_unrecognized != nil {
 		i += copy(data[i:], m.XXX_unrecognized)
 	}
@@ -2808,6 +2897,15 @@ func (this *Conf) VerboseEqual(that interface{}) error {
 	if this.Value != that1.Value {
 		return fmt2.Errorf("Value this(%v) Not Equal that(%v)", this.Value, that1.Value)
 	}
+	if this.Kind != nil && that1.Kind != nil {
+		if *this.Kind != *that1.Kind {
+			return fmt2.Errorf("Kind this(%v) Not Equal that(%v)", *this.Kind, *that1.Kind)
+		}
+	} else if this.Kind != nil {
+		return fmt2.Errorf("this.Kind == nil && that.Kind != nil")
+	} else if that1.Kind != nil {
+		return fmt2.Errorf("Kind this(%v) Not Equal that(%v)", this.Kind, that1.Kind)
+	}
 	if !bytes.Equal(this.XXX_unrecognized, that1.XXX_unrecognized) {
 		return fmt2.Errorf("XXX_unrecognized this(%v) Not Equal that(%v)", this.XXX_unrecognized, that1.XXX_unrecognized)
 	}
@@ -2839,6 +2937,15 @@ func (this *Conf) Equal(that interface{}) bool {
 	if this.Value != that1.Value {
 		return false
 	}
+	if this.Kind != nil && that1.Kind != nil {
+		if *this.Kind != *that1.Kind {
+			return false
+		}
+	} else if this.Kind != nil {
+		return false
+	} else if that1.Kind != nil {
+		return false
+	}
 	if !bytes.Equal(this.XXX_unrecognized, that1.XXX_unrecognized) {
 		return false
 	}
@@ -2878,6 +2985,9 @@ func (this *Context) VerboseEqual(that interface{}) error {
 			return fmt2.Errorf("Confs this[%v](%v) Not Equal that[%v](%v)", i, this.Confs[i], i, that1.Confs[i])
 		}
 	}
+	if !bytes.Equal(this.RawConf, that1.RawConf) {
+		return fmt2.Errorf("RawConf this(%v) Not Equal that(%v)", this.RawConf, that1.RawConf)
+	}
 	if !bytes.Equal(this.XXX_unrecognized, that1.XXX_unrecognized) {
 		return fmt2.Errorf("XXX_unrecognized this(%v) Not Equal that(%v)", this.XXX_unrecognized, that1.XXX_unrecognized)
 	}
@@ -2917,6 +3027,9 @@ func (this *Context) Equal(that interface{}) bool {
 			return false
 		}
 	}
+	if !bytes.Equal(this.RawConf, that1.RawConf) {
+		return false
+	}
 	if !bytes.Equal(this.XXX_unrecognized, that1.XXX_unrecognized) {
 		return false
 	}
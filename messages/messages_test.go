@@ -17,13 +17,18 @@ package messages
 import (
 	"encoding/json"
 	"testing"
+	"time"
 )
 
 func TestMarshalShellMsg(t *testing.T) {
 	msg := getMessage()
 
 	// Verifies that excluded fields (stream) aren't marshaled
-	expected := []byte(`{"anchors":["anchor1, anchor2"],"command":"emit","id":"id","msg":"{\"hello\":\"there\"}","need_task_ids":false,"task":123}`)
+	expected := []byte(`{"anchors":["anchor1, anchor2"],"command":"emit","id":"id","msg":"{\"hello\":\"there\"}","need_task_ids":false,"task":123,"tuple":[]}`)
+	verifyJsonOutput(t, msg, expected)
+
+	// Verifies that a nil tuple is marshaled as an empty tuple
+	msg.ShellMsgJson.Contents = nil
 	verifyJsonOutput(t, msg, expected)
 
 	// Verfies that complex tuples are json marshaled just once.
@@ -44,6 +49,97 @@ func verifyJsonOutput(t *testing.T, msg interface{}, expected []byte) {
 	}
 }
 
+// marshalShellMsgMap marshals a shell message the way MarshalJSON did
+// before ShellMsgEncoder, by building a map of its fields
+func marshalShellMsgMap(msg *ShellMsg) ([]byte, error) {
+	meta := msg.ShellMsgJson.ShellMsgMeta
+	result := map[string]interface{}{
+		"command": meta.Command,
+	}
+	if id := meta.GetId(); len(id) > 0 {
+		result["id"] = id
+	}
+	if anchors := meta.GetAnchors(); len(anchors) > 0 {
+		result["anchors"] = anchors
+	}
+	if stream := meta.GetStream(); len(stream) > 0 {
+		result["stream"] = stream
+	}
+	if task := meta.GetTask(); task != 0 {
+		result["task"] = task
+	}
+	if text := meta.GetMsg(); len(text) > 0 {
+		result["msg"] = text
+	}
+	if contents := msg.ShellMsgJson.Contents; len(contents) > 0 {
+		result["tuple"] = contents
+	} else if meta.Command == "emit" {
+		result["tuple"] = []interface{}{}
+	}
+	if meta.Command == "emit" && !meta.GetNeedTaskIds() {
+		result["need_task_ids"] = false
+	}
+	return json.Marshal(result)
+}
+
+func TestShellMsgEncoder(t *testing.T) {
+	encoder := NewShellMsgEncoder()
+	escaped, stream, empty := "<\"quoted\" & \u00e9\u2028\n>", "default", ""
+	negative, needTaskIds := int64(-1), true
+	msgs := []*ShellMsg{
+		getMessage(),
+		{ShellMsgJson: &ShellMsgJson{ShellMsgMeta: &ShellMsgMeta{Command: "sync"}}},
+		{ShellMsgJson: &ShellMsgJson{ShellMsgMeta: &ShellMsgMeta{Command: "log", Msg: &escaped}}},
+		{ShellMsgJson: &ShellMsgJson{ShellMsgMeta: &ShellMsgMeta{Command: "ack", Id: &escaped, Stream: &empty}}},
+		{ShellMsgJson: &ShellMsgJson{
+			ShellMsgMeta: &ShellMsgMeta{Command: "emit", Anchors: []string{"1", escaped}, Stream: &stream, Task: &negative, NeedTaskIds: &needTaskIds},
+			Contents:     []interface{}{escaped, 1.5, nil, map[string]int{"b": 2, "a": 1}, getTestTuple()},
+		}},
+	}
+	for _, msg := range msgs {
+		expected, err := marshalShellMsgMap(msg)
+		if err != nil {
+			t.Fatalf("Error marshaling msg: %v", err)
+		}
+		encoded, err := encoder.Encode(msg)
+		if err != nil {
+			t.Fatalf("Error encoding msg: %v", err)
+		}
+		if string(encoded) != string(expected) {
+			t.Errorf("Unexpected encoding: %s\nExpected: %s", encoded, expected)
+		}
+	}
+
+	unsupported := getMessage()
+	unsupported.ShellMsgJson.Contents = []interface{}{make(chan int)}
+	if _, err := encoder.Encode(unsupported); err == nil {
+		t.Errorf("Expected an error for an unsupported field")
+	}
+}
+
+func BenchmarkMarshalMap(b *testing.B) {
+	msg := getMessage()
+	msg.ShellMsgJson.Contents = getTestTuple()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := marshalShellMsgMap(msg); err != nil {
+			b.Fatal("Error: ", err)
+		}
+	}
+}
+
+func BenchmarkShellMsgEncoder(b *testing.B) {
+	msg := getMessage()
+	msg.ShellMsgJson.Contents = getTestTuple()
+	encoder := NewShellMsgEncoder()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := encoder.Encode(msg); err != nil {
+			b.Fatal("Error: ", err)
+		}
+	}
+}
+
 func BenchmarkMarshalJSON(b *testing.B) {
 	msg := getMessage()
 	msg.ShellMsgJson.Contents = getTestTuple()
@@ -98,3 +194,181 @@ func getTestTuple() []interface{} {
 		},
 	}
 }
+
+func TestUnmarshalSpoutMsg(t *testing.T) {
+	for data, expected := range map[string]SpoutMsg{
+		`{"command":"next"}`:                           {Command: "next"},
+		`{"command":"ack","id":"1231231"}`:             {Command: "ack", Id: "1231231"},
+		`{"command":"fail","id":-6955786537413359385}`: {Command: "fail", Id: "-6955786537413359385"},
+		`{"command":"ack","id":null}`:                  {Command: "ack"},
+	} {
+		msg := &SpoutMsg{}
+		if err := json.Unmarshal([]byte(data), msg); err != nil {
+			t.Fatalf("Unmarshalling %s: %v", data, err)
+		}
+		if msg.Command != expected.Command || msg.Id != expected.Id {
+			t.Errorf("Unmarshalled %s into command %s with id %q", data, msg.Command, msg.Id)
+		}
+	}
+	if err := json.Unmarshal([]byte(`{"command":"ack","id":[1]}`), &SpoutMsg{}); err == nil {
+		t.Errorf("Expected an error for an id that is neither a string nor a number")
+	}
+}
+
+func TestUnmarshalContext(t *testing.T) {
+	context := &Context{}
+	err := json.Unmarshal([]byte(`{"pidDir":"/tmp","context":{"task->component":{"1":"spout"},"taskid":1},"conf":{"topology.name":"test"}}`), context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if context.PidDir != "/tmp" || context.Topology.TaskId != 1 || len(context.Confs) != 1 {
+		t.Fatalf("Unexpected context: %v", context)
+	}
+
+	invalid := []string{
+		`{"context":{"taskid":1},"conf":{}}`,
+		`{"pidDir":"/tmp","conf":{}}`,
+		`{"id":"1","comp":"spout","stream":"default","task":1,"tuple":[]}`,
+		`["not","a","handshake"]`,
+	}
+	for _, data := range invalid {
+		err := json.Unmarshal([]byte(data), &Context{})
+		if err == nil {
+			t.Errorf("Expected an error for invalid handshake: %s", data)
+		}
+	}
+}
+
+func TestUnpackConf(t *testing.T) {
+	context := &Context{}
+	err := json.Unmarshal([]byte(`{"pidDir":"/tmp","context":{"task->component":{"1":"spout"},"taskid":1},"conf":{"topology.name":"test","topology.debug":true,"offset":9007199254740993,"servers":["a","b"],"limits":{"rate":0.5}}}`), context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type conf struct {
+		Name    string             `json:"topology.name"`
+		Debug   bool               `json:"topology.debug"`
+		Offset  int64              `json:"offset"`
+		Servers []string           `json:"servers"`
+		Limits  map[string]float64 `json:"limits"`
+	}
+	expected := conf{"test", true, 9007199254740993, []string{"a", "b"}, map[string]float64{"rate": 0.5}}
+	check := func(context *Context) {
+		unpacked := conf{}
+		if err := context.UnpackConf(&unpacked); err != nil {
+			t.Fatal(err)
+		}
+		if unpacked.Name != expected.Name || unpacked.Debug != expected.Debug || unpacked.Offset != expected.Offset ||
+			len(unpacked.Servers) != 2 || unpacked.Servers[1] != "b" || unpacked.Limits["rate"] != 0.5 {
+			t.Errorf("Unexpected configuration: %+v", unpacked)
+		}
+	}
+	check(context)
+
+	// The configuration is kept when the context is sent through protobuf
+	data, err := context.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := &Context{}
+	if err = decoded.Unmarshal(data); err != nil {
+		t.Fatal(err)
+	}
+	check(decoded)
+
+	// Without the handshake, only plain values can be unpacked
+	built := &Context{Confs: []*Conf{{Key: "topology.name", Value: "test"}}}
+	unpacked := conf{}
+	if err = built.UnpackConf(&unpacked); err != nil || unpacked.Name != "test" {
+		t.Errorf("Unexpected configuration: %+v, %v", unpacked, err)
+	}
+	built = &Context{Confs: context.Confs}
+	if err = built.UnpackConf(&unpacked); err == nil {
+		t.Errorf("Expected an error for nested values without the handshake")
+	}
+}
+
+func TestConfAccessors(t *testing.T) {
+	context := &Context{}
+	err := json.Unmarshal([]byte(`{"pidDir":"/tmp","context":{"task->component":{"1":"spout"},"taskid":1},"conf":{"topology.name":"test","topology.message.timeout.secs":30,"topology.max.spout.pending":null,"topology.debug":true,"large":1000000,"ratio":0.5,"one":1,"numeric":"30","nil":"<nil>"}}`), context)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if name, ok := context.ConfString("topology.name"); !ok || name != "test" {
+		t.Errorf("Unexpected topology name: %q, %v", name, ok)
+	}
+	if _, ok := context.ConfString("topology.max.spout.pending"); ok {
+		t.Errorf("Expected a null value to be missing")
+	}
+	if _, ok := context.ConfString("missing"); ok {
+		t.Errorf("Expected a missing value to be missing")
+	}
+	if large, ok := context.ConfInt("large"); !ok || large != 1000000 {
+		t.Errorf("Unexpected integer: %d, %v", large, ok)
+	}
+	if _, ok := context.ConfInt("ratio"); ok {
+		t.Errorf("Expected a fraction not to be an integer")
+	}
+	if _, ok := context.ConfInt("topology.name"); ok {
+		t.Errorf("Expected a string not to be an integer")
+	}
+	if debug, ok := context.ConfBool("topology.debug"); !ok || !debug {
+		t.Errorf("Unexpected boolean: %v, %v", debug, ok)
+	}
+	if _, ok := context.ConfBool("topology.name"); ok {
+		t.Errorf("Expected a string not to be a boolean")
+	}
+	// Values of the wrong JSON type are not converted
+	if _, ok := context.ConfBool("one"); ok {
+		t.Errorf("Expected a number not to be a boolean")
+	}
+	if _, ok := context.ConfString("large"); ok {
+		t.Errorf("Expected a number not to be a string")
+	}
+	if _, ok := context.ConfInt("numeric"); ok {
+		t.Errorf("Expected a numeric string not to be an integer")
+	}
+	if value, ok := context.ConfString("nil"); !ok || value != "<nil>" {
+		t.Errorf("Unexpected string: %q, %v", value, ok)
+	}
+
+	// The types are kept when the context is sent through protobuf
+	data, err := context.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := &Context{}
+	if err = decoded.Unmarshal(data); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := decoded.ConfBool("one"); ok {
+		t.Errorf("Expected a decoded number not to be a boolean")
+	}
+	if large, ok := decoded.ConfInt("large"); !ok || large != 1000000 {
+		t.Errorf("Unexpected decoded integer: %d, %v", large, ok)
+	}
+
+	// Values without a type, such as those of other protobuf peers, are
+	// parsed
+	untyped := &Context{Confs: []*Conf{{Key: "flag", Value: "true"}}}
+	if flag, ok := untyped.ConfBool("flag"); !ok || !flag {
+		t.Errorf("Unexpected untyped boolean: %v, %v", flag, ok)
+	}
+
+	if timeout, ok := context.MessageTimeout(); !ok || timeout != 30*time.Second {
+		t.Errorf("Unexpected message timeout: %v, %v", timeout, ok)
+	}
+
+	if _, ok := context.TickFrequency(); ok {
+		t.Errorf("Expected tick tuples to be disabled")
+	}
+	ticking := &Context{Confs: []*Conf{{Key: TickFrequencyKey, Value: "5"}}}
+	if frequency, ok := ticking.TickFrequency(); !ok || frequency != 5*time.Second {
+		t.Errorf("Unexpected tick frequency: %v, %v", frequency, ok)
+	}
+	ticking.Confs[0].Value = "0"
+	if _, ok := ticking.TickFrequency(); ok {
+		t.Errorf("Expected a tick frequency of zero to disable tick tuples")
+	}
+}
@@ -0,0 +1,39 @@
+//   Copyright 2013 Vastech SA (PTY) LTD
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package messages
+
+import (
+	"sort"
+	"strconv"
+)
+
+// ComponentTasks returns the ids of the tasks of the given component, in
+// ascending order, as listed in the task to component mapping of the
+// topology context. It returns nil if the component is unknown.
+func (this *Context) ComponentTasks(component string) []int64 {
+	var tasks []int64
+	for _, mapping := range this.GetTopology().GetTaskComponentMappings() {
+		if mapping.GetComponent() != component {
+			continue
+		}
+		task, err := strconv.ParseInt(mapping.GetTask(), 10, 64)
+		if err != nil {
+			continue
+		}
+		tasks = append(tasks, task)
+	}
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i] < tasks[j] })
+	return tasks
+}
@@ -17,6 +17,7 @@ package gostorm
 import (
 	"fmt"
 	"github.com/jsgilmore/gostorm"
+	"github.com/jsgilmore/gostorm/core"
 	stormmsg "github.com/jsgilmore/gostorm/messages"
 )
 
@@ -59,6 +60,15 @@ type mockOutputCollectorImpl struct {
 func (this *mockOutputCollectorImpl) Log(msg string) {
 }
 
+func (this *mockOutputCollectorImpl) LogFields(msg string, fields map[string]interface{}) {
+}
+
+// Emit1 emits the tuple on the default stream. Since the mock does not
+// track the tuple that is being executed, it is unanchored.
+func (this *mockOutputCollectorImpl) Emit1(contents ...interface{}) (taskIds []int32) {
+	return this.Emit(nil, "", contents...)
+}
+
 func (this *mockOutputCollectorImpl) SendAck(id string) {
 	this.EmitDirect(nil, "", 0, "Ack:"+id)
 }
@@ -72,6 +82,26 @@ func (this *mockOutputCollectorImpl) Emit(anchors []string, stream string, conte
 	return []int32{1}
 }
 
+// TryEmit passes the tuple to the bolt like Emit and never returns an
+// error
+func (this *mockOutputCollectorImpl) TryEmit(anchors []string, stream string, contents ...interface{}) (taskIds []int32, err error) {
+	return this.Emit(anchors, stream, contents...), nil
+}
+
+// TryEmitDirect passes the tuple to the bolt like EmitDirect and never
+// returns an error
+func (this *mockOutputCollectorImpl) TryEmitDirect(anchors []string, stream string, directTask int64, contents ...interface{}) error {
+	this.EmitDirect(anchors, stream, directTask, contents...)
+	return nil
+}
+
+// EmitDirectToComponent passes the tuple to the bolt like EmitDirect.
+// Since there is no topology, the task is always zero.
+func (this *mockOutputCollectorImpl) EmitDirectToComponent(anchors []string, stream string, component string, contents ...interface{}) (task int64, err error) {
+	this.EmitDirect(anchors, stream, 0, contents...)
+	return 0, nil
+}
+
 func (this *mockOutputCollectorImpl) EmitDirect(anchors []string, stream string, directTask int64, contents ...interface{}) {
 	meta := stormmsg.BoltMsgMeta{
 		Stream: stream,
@@ -88,17 +118,62 @@ func NewMockSpoutOutputCollector(bolt gostorm.Bolt) gostorm.SpoutOutputCollector
 }
 
 type mockSpoutSpoutOutputCollectorImpl struct {
-	bolt gostorm.Bolt
+	bolt    gostorm.Bolt
+	tracked int
 }
 
 func (this *mockSpoutSpoutOutputCollectorImpl) Log(msg string) {
 }
 
+func (this *mockSpoutSpoutOutputCollectorImpl) LogFields(msg string, fields map[string]interface{}) {
+}
+
 func (this *mockSpoutSpoutOutputCollectorImpl) Emit(id string, stream string, contents ...interface{}) (taskIds []int32) {
 	this.EmitDirect(id, stream, 0, contents...)
 	return []int32{1}
 }
 
+// Emit1 emits the tuple on the default stream
+func (this *mockSpoutSpoutOutputCollectorImpl) Emit1(id string, contents ...interface{}) (taskIds []int32) {
+	return this.Emit(id, "", contents...)
+}
+
+func (this *mockSpoutSpoutOutputCollectorImpl) EmitUnreliable(stream string, contents ...interface{}) (taskIds []int32) {
+	return this.Emit("", stream, contents...)
+}
+
+// EmitTracked emits the tuple with a generated id. Since there is no
+// Storm to ack the tuple, the callbacks are never called.
+func (this *mockSpoutSpoutOutputCollectorImpl) EmitTracked(stream string, onAck, onFail func(), contents ...interface{}) (id string) {
+	this.tracked++
+	id = fmt.Sprintf("%s%d", core.TrackedIdPrefix, this.tracked)
+	this.Emit(id, stream, contents...)
+	return id
+}
+
+// EmitWithKey emits the tuple with an id derived from the key. Since
+// there is no Storm to ack the tuple, the key is never returned.
+func (this *mockSpoutSpoutOutputCollectorImpl) EmitWithKey(key string, stream string, contents ...interface{}) (taskIds []int32) {
+	return this.Emit(core.KeyedIdPrefix+key, stream, contents...)
+}
+
+// EmitDelivered emits the tuple like Emit and always reports it as
+// delivered
+func (this *mockSpoutSpoutOutputCollectorImpl) EmitDelivered(id string, stream string, contents ...interface{}) (taskIds []int32, delivered bool) {
+	return this.Emit(id, stream, contents...), true
+}
+
+// TryEmit emits the tuple like Emit and never returns an error
+func (this *mockSpoutSpoutOutputCollectorImpl) TryEmit(id string, stream string, contents ...interface{}) (taskIds []int32, err error) {
+	return this.Emit(id, stream, contents...), nil
+}
+
+// TryEmitDirect emits the tuple like EmitDirect and never returns an error
+func (this *mockSpoutSpoutOutputCollectorImpl) TryEmitDirect(id string, stream string, directTask int64, contents ...interface{}) error {
+	this.EmitDirect(id, stream, directTask, contents...)
+	return nil
+}
+
 func (this *mockSpoutSpoutOutputCollectorImpl) EmitDirect(id string, stream string, directTask int64, contents ...interface{}) {
 	meta := stormmsg.BoltMsgMeta{
 		Id:     id,
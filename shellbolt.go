@@ -15,9 +15,11 @@
 package gostorm
 
 import (
+	"fmt"
 	"github.com/jsgilmore/gostorm/core"
 	"github.com/jsgilmore/gostorm/messages"
 	"io"
+	"runtime/debug"
 	"sync"
 )
 
@@ -25,6 +27,7 @@ type ShellBolt interface {
 	Go()
 	Exit()
 	Initialise(boltConn core.BoltConn)
+	SetRecoverPanics(enabled bool)
 }
 
 type shellBoltImpl struct {
@@ -34,6 +37,7 @@ type shellBoltImpl struct {
 	meta     *messages.BoltMsgMeta
 	cleaned  bool
 	sent     int
+	recover  bool
 }
 
 func NewShellBolt(bolt Bolt) ShellBolt {
@@ -54,6 +58,7 @@ func (this *shellBoltImpl) Go() {
 		fields := this.bolt.Fields()
 		err := this.boltConn.ReadBoltMsg(this.meta, fields...)
 		if err == io.EOF {
+			this.complete()
 			this.Exit()
 			return
 		}
@@ -65,16 +70,81 @@ func (this *shellBoltImpl) Go() {
 			panic("ShellBolt: Cleaned up bolt expected to execute")
 		}
 
-		if this.meta.GetStream() == "__heartbeat" {
+		if this.meta.GetStream() == core.HeartbeatStream {
 			this.boltConn.SendSync()
 			continue
 		}
 
-		this.bolt.Execute(*this.meta, fields...)
+		if tickBolt, ok := this.bolt.(TickBolt); ok && core.IsTick(this.meta) {
+			if this.call(func() { tickBolt.Tick(*this.meta) }) {
+				this.boltConn.SendAck(this.meta.Id)
+			}
+			continue
+		}
+
+		this.call(func() { this.bolt.Execute(*this.meta, fields...) })
 		this.sent++
 	}
 }
 
+// SetRecoverPanics sets whether panics in Execute and Tick are
+// recovered. By default, a panic kills the worker, after which Storm
+// restarts it and replays the tuples that were not acked. With recovery
+// enabled, the panic is reported to Storm as an error, the tuple that
+// caused it is failed, and the bolt continues with the next tuple. Since
+// the tuple may have been acked or partially processed before the
+// panic, recovery should only be enabled for bolts whose state cannot
+// be corrupted by an interrupted Execute. Panics in Prepare, Cleanup and
+// OnComplete are never recovered.
+func (this *shellBoltImpl) SetRecoverPanics(enabled bool) {
+	this.recover = enabled
+}
+
+// call calls a handler of the bolt for the current tuple and returns
+// whether it returned normally. If panics are recovered, a panic is
+// reported to Storm and the tuple is failed.
+func (this *shellBoltImpl) call(handler func()) (ok bool) {
+	if !this.recover {
+		handler()
+		return true
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			reportPanic(this.boltConn, fmt.Sprintf("tuple %s", this.meta.Id), r)
+			this.boltConn.SendFail(this.meta.Id)
+			ok = false
+		}
+	}()
+	handler()
+	return true
+}
+
+// reportPanic reports a recovered panic to Storm as an error, if the
+// connection supports it, and logs it otherwise
+func reportPanic(conn interface{}, cause string, r interface{}) {
+	msg := fmt.Sprintf("Recovered from a panic while handling %s: %v\n%s", cause, r, debug.Stack())
+	if reporter, ok := conn.(core.ErrorReporter); ok {
+		reporter.ReportError(msg)
+		return
+	}
+	core.Logger().Print(msg)
+}
+
+// complete calls OnComplete on a bolt that implements CompletingBolt,
+// after writing everything that was sent for the earlier tuples
+func (this *shellBoltImpl) complete() {
+	completingBolt, ok := this.bolt.(CompletingBolt)
+	if !ok {
+		return
+	}
+	if syncer, ok := this.boltConn.(core.Syncer); ok {
+		if err := syncer.Sync(); err != nil {
+			core.Logger().Printf("ShellBolt: Syncing the output before OnComplete failed: %v", err)
+		}
+	}
+	completingBolt.OnComplete()
+}
+
 func (this *shellBoltImpl) Exit() {
 	this.Lock()
 	defer this.Unlock()
@@ -15,16 +15,22 @@
 package gostorm
 
 import (
+	"context"
 	"fmt"
 	"github.com/jsgilmore/gostorm/core"
 	"io"
 	"sync"
+	"time"
 )
 
 type ShellSpout interface {
 	Go()
 	Exit()
 	Initialise(spoutConn core.SpoutConn)
+	SetAckConcurrency(n int)
+	SetUnresponsiveThreshold(threshold time.Duration)
+	SetMaxPending(n int)
+	SetRecoverPanics(enabled bool)
 }
 
 type shellSpoutImpl struct {
@@ -32,6 +38,14 @@ type shellSpoutImpl struct {
 	spoutConn core.SpoutConn
 	spout     Spout
 	cleaned   bool
+	ackSlots  chan struct{}
+	acking    sync.WaitGroup
+	threshold time.Duration
+	timeout   time.Duration
+	// maxPending is the number of pending tracked emissions at which
+	// NextTuple is no longer called, or zero if it is unlimited
+	maxPending int
+	recover    bool
 }
 
 func NewShellSpout(spout Spout) ShellSpout {
@@ -43,9 +57,179 @@ func NewShellSpout(spout Spout) ShellSpout {
 func (this *shellSpoutImpl) Initialise(spoutConn core.SpoutConn) {
 	this.spoutConn = spoutConn
 	this.spoutConn.Connect()
+	if context := this.spoutConn.Context(); context != nil {
+		this.timeout, _ = context.MessageTimeout()
+	}
 	this.spout.Open(this.spoutConn.Context(), this.spoutConn)
 }
 
+// nextTuple calls NextTupleContext with a context that carries the
+// deadline for the next command if the spout is a ContextSpout, and
+// NextTuple otherwise
+func (this *shellSpoutImpl) nextTuple() {
+	spout, ok := this.spout.(ContextSpout)
+	if !ok {
+		this.spout.NextTuple()
+		return
+	}
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if this.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, this.timeout)
+	}
+	defer cancel()
+	spout.NextTupleContext(ctx)
+}
+
+// SetAckConcurrency sets the maximum number of Acked and Failed calls
+// that may run concurrently. By default, acks and fails are processed
+// one at a time on the same goroutine as NextTuple. With a concurrency
+// larger than one, Acked and Failed are called from separate goroutines
+// while the spout continues to receive commands from Storm. They may
+// then run concurrently with each other and with NextTuple, in no
+// particular order, and must not emit tuples. Exit is only called once
+// all outstanding acks and fails have been processed.
+func (this *shellSpoutImpl) SetAckConcurrency(n int) {
+	if n > 1 {
+		this.ackSlots = make(chan struct{}, n)
+	} else {
+		this.ackSlots = nil
+	}
+}
+
+// SetUnresponsiveThreshold sets the time that a spout may take to handle
+// a command from Storm before a warning is logged. Storm kills workers
+// that do not respond to its commands in time, which is usually caused
+// by a NextTuple, Acked or Failed call that blocks. The warning is
+// logged while the call is still blocking, so it is logged even if
+// Storm kills the worker. A threshold of zero, which is the default,
+// disables the warning.
+func (this *shellSpoutImpl) SetUnresponsiveThreshold(threshold time.Duration) {
+	this.threshold = threshold
+}
+
+// SetMaxPending sets the maximum number of tuples emitted with
+// EmitTracked that may be pending, which means that they have not been
+// acked or failed yet. While this many tuples are pending, the spout is
+// not asked for more tuples: next commands from Storm are answered
+// without calling NextTuple, until enough of the pending tuples have
+// been acked or failed. This limits the tuples in flight for a single
+// spout, independently of topology.max.spout.pending, which is set for
+// the whole topology when it is submitted. The number of pending tuples can be read with
+// the Pending function of core.PendingCounter. A maximum of zero, which
+// is the default, means that the pending tuples are unlimited. It has no
+// effect if the connection does not count pending tuples.
+func (this *shellSpoutImpl) SetMaxPending(n int) {
+	this.maxPending = n
+}
+
+// throttled returns whether the maximum number of pending tracked
+// emissions has been reached
+func (this *shellSpoutImpl) throttled() bool {
+	if this.maxPending <= 0 {
+		return false
+	}
+	counter, ok := this.spoutConn.(core.PendingCounter)
+	return ok && counter.Pending() >= this.maxPending
+}
+
+// SetRecoverPanics sets whether panics in NextTuple, Acked and Failed
+// are recovered. By default, a panic kills the worker. With recovery
+// enabled, the panic is reported to Storm as an error and the spout
+// continues with the next command, as if the call had returned. Tuples
+// that were emitted before the panic are still tracked by Storm, so a
+// panic in NextTuple does not lose them. Panics in Open and Exit are
+// never recovered.
+func (this *shellSpoutImpl) SetRecoverPanics(enabled bool) {
+	this.recover = enabled
+}
+
+// call calls a handler of the spout for a command from Storm and, if
+// panics are recovered, reports a panic to Storm
+func (this *shellSpoutImpl) call(command, id string, handler func()) {
+	if this.recover {
+		defer func() {
+			if r := recover(); r != nil {
+				cause := command + " command"
+				if id != "" {
+					cause = fmt.Sprintf("%s command for tuple %s", command, id)
+				}
+				reportPanic(this.spoutConn, cause, r)
+			}
+		}()
+	}
+	handler()
+}
+
+// watch logs a warning if the handling of a command from Storm has not
+// completed within the unresponsive threshold. The returned timer has to
+// be stopped once the command has been handled.
+func (this *shellSpoutImpl) watch(command string) *time.Timer {
+	if this.threshold <= 0 {
+		return nil
+	}
+	received := time.Now()
+	return time.AfterFunc(this.threshold, func() {
+		core.Logger().Printf("ShellSpout: %s command not handled %v after it was received, Storm may consider the worker unresponsive", command, time.Since(received))
+	})
+}
+
+// dispatchTracked calls the callback of a tracked emission, if the
+// connection supports tracked emissions, and returns whether the id
+// belonged to one
+func (this *shellSpoutImpl) dispatchTracked(command, id string) bool {
+	tracker, ok := this.spoutConn.(core.TrackedEmitter)
+	if !ok {
+		return false
+	}
+	// A callback that panics has still handled the command
+	handled := true
+	this.call(command, id, func() { handled = tracker.Dispatch(command, id) })
+	return handled
+}
+
+// completer returns the function that handles an ack or fail command
+// for the given id. Keyed emissions are passed to AckedKey or FailedKey
+// if the spout is a KeyedSpout.
+func (this *shellSpoutImpl) completer(command string) func(id string) {
+	complete := this.spout.Acked
+	if command == core.CommandFail {
+		complete = this.spout.Failed
+	}
+	spout, ok := this.spout.(KeyedSpout)
+	if !ok {
+		return complete
+	}
+	completeKey := spout.AckedKey
+	if command == core.CommandFail {
+		completeKey = spout.FailedKey
+	}
+	return func(id string) {
+		if key, ok := core.ParseKey(id); ok {
+			completeKey(key)
+		} else {
+			complete(id)
+		}
+	}
+}
+
+// dispatchAck runs an Acked or Failed call, either directly or on a
+// separate goroutine if ack concurrency has been enabled
+func (this *shellSpoutImpl) dispatchAck(command string, ack func(id string), id string) {
+	if this.ackSlots == nil {
+		this.call(command, id, func() { ack(id) })
+		return
+	}
+	this.ackSlots <- struct{}{}
+	this.acking.Add(1)
+	go func() {
+		defer func() {
+			<-this.ackSlots
+			this.acking.Done()
+		}()
+		this.call(command, id, func() { ack(id) })
+	}()
+}
+
 func (this *shellSpoutImpl) Go() {
 	for {
 		// This lock prevents the spout exit function being called
@@ -61,26 +245,55 @@ func (this *shellSpoutImpl) Go() {
 			panic(err)
 		}
 		this.Lock()
-		if this.cleaned && command != "next" {
+		if this.cleaned && command != core.CommandNext {
 			panic(fmt.Sprintf("ShellSpout: %s message sent to cleaned up spout", command))
 		}
 
+		timer := this.watch(command)
 		switch command {
-		case "next":
-			this.spout.NextTuple()
-		case "ack":
-			this.spout.Acked(id)
-		case "fail":
-			this.spout.Failed(id)
+		case core.CommandNext:
+			if !this.throttled() {
+				this.call(command, "", this.nextTuple)
+			}
+		case core.CommandAck, core.CommandFail:
+			if !this.dispatchTracked(command, id) {
+				this.dispatchAck(command, this.completer(command), id)
+			}
+		case core.CommandActivate, core.CommandDeactivate:
+			if spout, ok := this.spout.(ActivatingSpout); ok {
+				handler := spout.OnActivate
+				if command == core.CommandDeactivate {
+					handler = spout.OnDeactivate
+				}
+				this.call(command, "", handler)
+			}
 		default:
 			panic(fmt.Sprintf("ShellSpout: Unknown command received from Storm: %s", command))
 		}
-		this.spoutConn.SendSync()
+		this.sendSync()
+		if timer != nil {
+			timer.Stop()
+		}
 		this.Unlock()
 	}
 }
 
+// sendSync ends the turn of the spout. A sync that is out of sequence
+// would desynchronise the spout from Storm, so it is checked if the
+// connection supports it.
+func (this *shellSpoutImpl) sendSync() {
+	syncer, ok := this.spoutConn.(core.CheckedSyncer)
+	if !ok {
+		this.spoutConn.SendSync()
+		return
+	}
+	if err := syncer.TrySendSync(); err != nil {
+		panic(err)
+	}
+}
+
 func (this *shellSpoutImpl) Exit() {
+	this.acking.Wait()
 	this.Lock()
 	defer this.Unlock()
 	if !this.cleaned {
@@ -0,0 +1,151 @@
+//   Copyright 2013 Vastech SA (PTY) LTD
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+// Package standalone runs bolts outside of Storm, which is useful for
+// trying out a bolt's logic on sample data from the command line.
+package standalone
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/jsgilmore/gostorm"
+	"github.com/jsgilmore/gostorm/messages"
+	"io"
+	"strconv"
+)
+
+// MaxLineSize is the maximum size in bytes of a line of input, which
+// holds a single tuple
+const MaxLineSize = 64 * 1024 * 1024
+
+// RunBolt reads tuples from the reader and executes the bolt on each of
+// them. Every line of input should contain a single tuple in the form
+// of a JSON array, of which the elements are unmarshalled into the
+// fields returned by the bolt's Fields function. Tuples are given ids
+// that match their line numbers and are received on the default stream.
+// An error is returned if a line holds more or fewer fields than the
+// bolt's Fields function returns, or is longer than MaxLineSize.
+//
+// Everything the bolt sends to Storm (emissions, acks, fails and logs)
+// is written to the writer as a JSON multilang command, one per line.
+// No Storm handshake or "end" delimiters are used.
+func RunBolt(bolt gostorm.Bolt, reader io.Reader, writer io.Writer) error {
+	collector := newCollector(writer)
+	bolt.Prepare(&messages.Context{Topology: &messages.Topology{}}, collector)
+	defer bolt.Cleanup()
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(nil, MaxLineSize)
+	line := 1
+	for ; scanner.Scan(); line++ {
+		data := bytes.TrimSpace(scanner.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+
+		fields := bolt.Fields()
+		tuple := make([]interface{}, len(fields))
+		copy(tuple, fields)
+		err := json.Unmarshal(data, &tuple)
+		if err != nil {
+			return fmt.Errorf("standalone: line %d: %v", line, err)
+		}
+		if len(fields) == 0 {
+			fields = tuple
+		} else if len(tuple) != len(fields) {
+			return fmt.Errorf("standalone: line %d: expected %d fields, received %d", line, len(fields), len(tuple))
+		}
+
+		meta := messages.BoltMsgMeta{
+			Id:     strconv.Itoa(line),
+			Stream: "default",
+		}
+		bolt.Execute(meta, fields...)
+		err = collector.Flush()
+		if err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("standalone: line %d: %v", line, err)
+	}
+	return nil
+}
+
+func newCollector(writer io.Writer) *collector {
+	return &collector{
+		writer: bufio.NewWriter(writer),
+	}
+}
+
+// collector is an output collector that writes the commands it
+// receives to a writer instead of sending them to Storm
+type collector struct {
+	writer *bufio.Writer
+}
+
+func (this *collector) send(command, id, stream, msg string, anchors []string, directTask int64, contents ...interface{}) {
+	// The need_task_ids field is meaningless outside of Storm, so we
+	// set it to the multilang default to have it omitted
+	needTaskIds := true
+	shellMsg := &messages.ShellMsg{
+		ShellMsgJson: &messages.ShellMsgJson{
+			ShellMsgMeta: &messages.ShellMsgMeta{
+				Command:     command,
+				Anchors:     anchors,
+				Id:          &id,
+				Stream:      &stream,
+				Task:        &directTask,
+				NeedTaskIds: &needTaskIds,
+				Msg:         &msg,
+			},
+			Contents: contents,
+		},
+	}
+	data, err := json.Marshal(shellMsg)
+	if err != nil {
+		panic(err)
+	}
+	this.writer.Write(data)
+	this.writer.WriteByte('\n')
+}
+
+func (this *collector) Flush() error {
+	return this.writer.Flush()
+}
+
+func (this *collector) Log(msg string) {
+	this.send("log", "", "", msg, nil, 0)
+}
+
+func (this *collector) SendAck(id string) {
+	this.send("ack", id, "", "", nil, 0)
+}
+
+func (this *collector) SendFail(id string) {
+	this.send("fail", id, "", "", nil, 0)
+}
+
+// Emit writes the emission and returns nil, since there are no tasks
+// that receive the tuple
+func (this *collector) Emit(anchors []string, stream string, contents ...interface{}) (taskIds []int32) {
+	this.EmitDirect(anchors, stream, 0, contents...)
+	return nil
+}
+
+func (this *collector) EmitDirect(anchors []string, stream string, directTask int64, contents ...interface{}) {
+	this.send("emit", "", stream, "", anchors, directTask, contents...)
+}
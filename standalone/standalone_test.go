@@ -0,0 +1,97 @@
+//   Copyright 2013 Vastech SA (PTY) LTD
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package standalone
+
+import (
+	"bytes"
+	"github.com/jsgilmore/gostorm"
+	"github.com/jsgilmore/gostorm/messages"
+	"strings"
+	"testing"
+)
+
+type splitBolt struct {
+	collector gostorm.OutputCollector
+}
+
+func (this *splitBolt) Fields() []interface{} {
+	var sentence string
+	var count int64
+	return []interface{}{&sentence, &count}
+}
+
+func (this *splitBolt) Prepare(context *messages.Context, collector gostorm.OutputCollector) {
+	this.collector = collector
+}
+
+func (this *splitBolt) Execute(meta messages.BoltMsgMeta, fields ...interface{}) {
+	sentence := *fields[0].(*string)
+	count := *fields[1].(*int64)
+	for _, word := range strings.Split(sentence, " ")[:count] {
+		this.collector.Emit([]string{meta.Id}, "", word)
+	}
+	this.collector.SendAck(meta.Id)
+}
+
+func (this *splitBolt) Cleanup() {}
+
+func TestRunBolt(t *testing.T) {
+	input := strings.NewReader("[\"Call me Ishmael\", 2]\n\n[\"It was the best of times\", 1]\n")
+	output := bytes.NewBuffer(nil)
+
+	err := RunBolt(&splitBolt{}, input, output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"anchors":["1"],"command":"emit","tuple":["Call"]}
+{"anchors":["1"],"command":"emit","tuple":["me"]}
+{"command":"ack","id":"1"}
+{"anchors":["3"],"command":"emit","tuple":["It"]}
+{"command":"ack","id":"3"}
+`
+	if output.String() != expected {
+		t.Fatalf("Expected output:\n%s\nreceived:\n%s", expected, output.String())
+	}
+}
+
+func TestRunBoltInvalidTuple(t *testing.T) {
+	input := strings.NewReader("[\"Call me Ishmael\", 2]\n{\"not\": \"a tuple\"}\n")
+	err := RunBolt(&splitBolt{}, input, bytes.NewBuffer(nil))
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Fatalf("Expected an error for line 2, received: %v", err)
+	}
+}
+
+func TestRunBoltFieldCount(t *testing.T) {
+	input := strings.NewReader("[\"Call me Ishmael\", 2]\n[\"It was the best of times\"]\n")
+	err := RunBolt(&splitBolt{}, input, bytes.NewBuffer(nil))
+	if err == nil || !strings.Contains(err.Error(), "line 2: expected 2 fields, received 1") {
+		t.Fatalf("Expected a field count error for line 2, received: %v", err)
+	}
+}
+
+func TestRunBoltLongLine(t *testing.T) {
+	sentence := strings.Repeat("a", 100*1024)
+	input := strings.NewReader("[\"" + sentence + " b\", 1]\n")
+	output := bytes.NewBuffer(nil)
+	err := RunBolt(&splitBolt{}, input, output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(output.String(), sentence) {
+		t.Fatalf("Long tuple was not executed: %.100s", output.String())
+	}
+}
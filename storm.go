@@ -13,12 +13,20 @@
 //   limitations under the License.
 
 // GoStorm is a library that allows you to write Storm spouts and bolts in Go
+//
+// OutputCollector and SpoutOutputCollector only hold the functions that
+// every collector needs. Further features are described by optional
+// interfaces that embed them, such as CheckedOutputCollector. The
+// collectors passed to Prepare and Open implement those that their
+// connection supports, which can be checked with a type assertion.
 package gostorm
 
 import (
+	"context"
 	"github.com/jsgilmore/gostorm/core"
 	_ "github.com/jsgilmore/gostorm/encodings"
 	stormmsg "github.com/jsgilmore/gostorm/messages"
+	"io"
 	"os"
 )
 
@@ -29,6 +37,27 @@ type Bolt interface {
 	Cleanup()
 }
 
+// TickBolt is a bolt that handles tick tuples separately from other
+// tuples. ShellBolt calls Tick instead of Execute for tick tuples and
+// acks them once Tick returns.
+type TickBolt interface {
+	Bolt
+	Tick(meta stormmsg.BoltMsgMeta)
+}
+
+// CompletingBolt is a bolt that is notified when its input ends, such
+// as when it processes a file instead of a live stream from Storm.
+// ShellBolt calls OnComplete once it reads the end of the input, after
+// every earlier tuple has been executed and the acks sent for them have
+// been written, and before it calls Cleanup. Storm never ends the input
+// of a running topology: it kills the process instead, in which case
+// OnComplete is not called. It is only called in a topology when the
+// input is ended deliberately, such as by core.HandleSignals.
+type CompletingBolt interface {
+	Bolt
+	OnComplete()
+}
+
 type Spout interface {
 	NextTuple()
 	Acked(id string)
@@ -37,12 +66,100 @@ type Spout interface {
 	Open(context *stormmsg.Context, collector SpoutOutputCollector)
 }
 
+// ActivatingSpout is a spout that is notified when the topology is
+// activated or deactivated. ShellSpout calls OnActivate and OnDeactivate
+// when Storm sends the activate and deactivate commands, which only
+// Storm versions that support them do. Like NextTuple, they may emit
+// tuples. Other spouts ignore these commands.
+type ActivatingSpout interface {
+	Spout
+	OnActivate()
+	OnDeactivate()
+}
+
+// KeyedSpout is a spout that receives the keys of tuples emitted with
+// EmitWithKey when they are acked or failed. ShellSpout calls AckedKey
+// and FailedKey instead of Acked and Failed for those tuples, and Acked
+// and Failed for all other tuples.
+type KeyedSpout interface {
+	Spout
+	AckedKey(key core.TupleKey)
+	FailedKey(key core.TupleKey)
+}
+
+// ContextSpout is a spout whose NextTuple takes a context with a
+// deadline. When a spout implements it, the shell spout calls
+// NextTupleContext instead of NextTuple, so NextTuple is never called
+// but still has to be implemented to satisfy Spout.
+//
+// The deadline is topology.message.timeout.secs after the next command
+// was received, which allows a spout that polls a slow source to give
+// up before the tuples it is waiting for could time out. The context
+// has no deadline if the message timeout is not configured, and it is
+// cancelled once NextTupleContext returns. The deadline is advisory:
+// if NextTupleContext ignores it, the call is not interrupted and the
+// sync is only sent to Storm once it returns. Tuples emitted after the
+// deadline are still sent, and Storm may kill the worker if it does not
+// respond in time.
+type ContextSpout interface {
+	Spout
+	NextTupleContext(ctx context.Context)
+}
+
 type SpoutOutputCollector interface {
 	Log(msg string)
 	Emit(id string, stream string, fields ...interface{}) (taskIds []int32)
 	EmitDirect(id string, stream string, directTask int64, fields ...interface{})
 }
 
+// UnreliableSpoutOutputCollector is a spout output collector that can
+// emit tuples without an id, which Storm does not track.
+type UnreliableSpoutOutputCollector interface {
+	SpoutOutputCollector
+	EmitUnreliable(stream string, fields ...interface{}) (taskIds []int32)
+}
+
+// TrackedSpoutOutputCollector is a spout output collector that can emit
+// tuples with ack and fail callbacks.
+type TrackedSpoutOutputCollector interface {
+	SpoutOutputCollector
+	EmitTracked(stream string, onAck, onFail func(), fields ...interface{}) (id string)
+}
+
+// DefaultStreamSpoutOutputCollector is a spout output collector that
+// emits tuples with the given id on the default stream with a single
+// call.
+type DefaultStreamSpoutOutputCollector interface {
+	SpoutOutputCollector
+	Emit1(id string, fields ...interface{}) (taskIds []int32)
+}
+
+// KeyedSpoutOutputCollector is a spout output collector that can emit
+// tuples with a key, such as an offset in a log, which is returned to
+// the spout when the tuple is acked or failed, as described at
+// KeyedSpout.
+type KeyedSpoutOutputCollector interface {
+	SpoutOutputCollector
+	EmitWithKey(key string, stream string, fields ...interface{}) (taskIds []int32)
+}
+
+// CheckedSpoutOutputCollector is a spout output collector that returns
+// an error instead of panicking when a tuple cannot be emitted, such as
+// when a spout emits after its NextTuple, Acked or Failed has returned.
+type CheckedSpoutOutputCollector interface {
+	SpoutOutputCollector
+	TryEmit(id string, stream string, fields ...interface{}) (taskIds []int32, err error)
+	TryEmitDirect(id string, stream string, directTask int64, fields ...interface{}) error
+}
+
+// DeliverySpoutOutputCollector is a spout output collector that reports
+// whether an emitted tuple was sent to any task, so that a tuple that
+// went nowhere can be failed or retried.
+type DeliverySpoutOutputCollector interface {
+	SpoutOutputCollector
+	EmitDelivered(id string, stream string, fields ...interface{}) (taskIds []int32, delivered bool)
+}
+
 type OutputCollector interface {
 	Log(msg string)
 	SendAck(id string)
@@ -51,22 +168,85 @@ type OutputCollector interface {
 	EmitDirect(anchors []string, stream string, directTask int64, fields ...interface{})
 }
 
+// DefaultStreamOutputCollector is an output collector that emits tuples
+// on the default stream, anchored to the tuple that is being executed,
+// with a single call.
+type DefaultStreamOutputCollector interface {
+	OutputCollector
+	Emit1(fields ...interface{}) (taskIds []int32)
+}
+
+// ComponentOutputCollector is an output collector that can emit tuples
+// directly to a task of a component given by name, instead of by task
+// id.
+type ComponentOutputCollector interface {
+	OutputCollector
+	EmitDirectToComponent(anchors []string, stream string, component string, fields ...interface{}) (task int64, err error)
+}
+
+// CheckedOutputCollector is an output collector that returns an error
+// instead of panicking when a tuple cannot be emitted, such as when a
+// field cannot be encoded.
+type CheckedOutputCollector interface {
+	OutputCollector
+	TryEmit(anchors []string, stream string, fields ...interface{}) (taskIds []int32, err error)
+	TryEmitDirect(anchors []string, stream string, directTask int64, fields ...interface{}) error
+}
+
+// Tuple is a tuple received from Storm along with its metadata, as
+// returned by core.ReadTuples and passed to a BatchFlusher. It is an
+// alias of core.Tuple, so that functions that handle tuples can be
+// written without importing core.
+type Tuple = core.Tuple
+
 type FieldsFactory interface {
 	Fields() []interface{}
 }
 
 func RunBolt(bolt Bolt, encoding string) {
-	boltConn := core.LookupBoltConn(encoding, os.Stdin, os.Stdout)
+	runBolt(bolt, encoding, os.Stdin)
+}
+
+// RunBoltWithSignals runs a bolt like RunBolt, but shuts it down cleanly
+// when the process receives SIGTERM or SIGINT, or when the context is
+// cancelled, as described by core.HandleSignals
+func RunBoltWithSignals(ctx context.Context, bolt Bolt, encoding string) {
+	runBolt(bolt, encoding, core.HandleSignals(ctx, os.Stdin))
+}
+
+func runBolt(bolt Bolt, encoding string, reader io.Reader) {
+	boltConn := core.LookupBoltConn(encoding, reader, os.Stdout)
 	shellBolt := NewShellBolt(bolt)
 	shellBolt.Initialise(boltConn)
 	shellBolt.Go()
 	shellBolt.Exit()
+	closeConn(boltConn)
 }
 
 func RunSpout(spout Spout, encoding string) {
-	spoutConn := core.LookupSpoutConn(encoding, os.Stdin, os.Stdout)
+	runSpout(spout, encoding, os.Stdin)
+}
+
+// RunSpoutWithSignals runs a spout like RunSpout, but shuts it down
+// cleanly when the process receives SIGTERM or SIGINT, or when the
+// context is cancelled, as described by core.HandleSignals
+func RunSpoutWithSignals(ctx context.Context, spout Spout, encoding string) {
+	runSpout(spout, encoding, core.HandleSignals(ctx, os.Stdin))
+}
+
+func runSpout(spout Spout, encoding string, reader io.Reader) {
+	spoutConn := core.LookupSpoutConn(encoding, reader, os.Stdout)
 	shellSpout := NewShellSpout(spout)
 	shellSpout.Initialise(spoutConn)
 	shellSpout.Go()
 	shellSpout.Exit()
+	closeConn(spoutConn)
+}
+
+// closeConn closes a bolt or spout connection if it can be closed, which
+// flushes its output and removes its pid file
+func closeConn(conn interface{}) {
+	if closer, ok := conn.(io.Closer); ok {
+		closer.Close()
+	}
 }
@@ -15,16 +15,31 @@
 package test
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/jsgilmore/gostorm"
 	stormcore "github.com/jsgilmore/gostorm/core"
 	stormenc "github.com/jsgilmore/gostorm/encodings/json"
+	stormproto "github.com/jsgilmore/gostorm/encodings/protobuf"
 	"github.com/jsgilmore/gostorm/messages"
 	"io"
+	"io/ioutil"
+	"log"
+	"math"
 	"math/rand"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 var (
@@ -71,6 +86,61 @@ func testBoltMsg(index int) *messages.BoltMsg {
 	return genBoltMsg(ids[index], contents[index])
 }
 
+// testBoltConn is a bolt connection along with the optional interfaces
+// that the bolt connections of core implement
+type testBoltConn interface {
+	stormcore.BoltConn
+	io.Closer
+	stormcore.PidConfigurer
+	stormcore.InitialisedNotifier
+	stormcore.MessageSizeLimiter
+	stormcore.HooksSetter
+	stormcore.TraceRecorder
+	stormcore.TestModeSetter
+	stormcore.EmptyTupleRejecter
+	stormcore.OutputFieldsDeclarer
+	stormcore.InputFieldsDeclarer
+	stormcore.ZeroTasksNotifier
+	stormcore.AnchorDeduplicator
+	stormcore.AckValidator
+	stormcore.LatencyTracker
+	stormcore.MarshalHookSetter
+	stormcore.DecodeHookSetter
+	stormcore.FieldSizeLimiter
+	stormcore.StatsReporter
+	stormcore.StructEmitter
+	stormcore.RawEmitter
+	stormcore.AsyncEmitter
+}
+
+func newBoltConn(in stormcore.Input, out stormcore.Output, needTaskIds bool) testBoltConn {
+	return stormcore.NewBoltConn(in, out, needTaskIds).(testBoltConn)
+}
+
+// testSpoutConn is a spout connection along with the optional interfaces
+// that the spout connections of core implement
+type testSpoutConn interface {
+	stormcore.SpoutConn
+	io.Closer
+	stormcore.PidConfigurer
+	stormcore.InitialisedNotifier
+	stormcore.MessageSizeLimiter
+	stormcore.HooksSetter
+	stormcore.TraceRecorder
+	stormcore.TestModeSetter
+	stormcore.EmptyTupleRejecter
+	stormcore.OutputFieldsDeclarer
+	stormcore.ZeroTasksNotifier
+	stormcore.MarshalHookSetter
+	stormcore.FieldSizeLimiter
+	stormcore.StatsReporter
+	stormcore.SpoutWaiter
+}
+
+func newSpoutConn(in stormcore.Input, out stormcore.Output, needTaskIds bool) testSpoutConn {
+	return stormcore.NewSpoutConn(in, out, needTaskIds).(testSpoutConn)
+}
+
 func genTaskIdsMsg() (taskIds []int32) {
 	for i := 0; i < rand.Intn(10)+1; i++ {
 		taskIds = append(taskIds, rand.Int31()+1)
@@ -145,7 +215,7 @@ func TestInit(t *testing.T) {
 
 	input := stormenc.NewJsonObjectInput(inBuffer)
 	output := stormenc.NewJsonObjectOutput(outBuffer)
-	boltConn := stormcore.NewBoltConn(input, output, true)
+	boltConn := newBoltConn(input, output, true)
 	boltConn.Connect()
 
 	expectPid(outBuffer, t)
@@ -160,7 +230,7 @@ func TestLog(t *testing.T) {
 	outBuffer := bytes.NewBuffer(nil)
 	input := stormenc.NewJsonObjectInput(inBuffer)
 	output := stormenc.NewJsonObjectOutput(outBuffer)
-	spoutConn := stormcore.NewSpoutConn(input, output, true)
+	spoutConn := newSpoutConn(input, output, true)
 	spoutConn.Connect()
 
 	expectPid(outBuffer, t)
@@ -176,6 +246,38 @@ func TestLog(t *testing.T) {
 	checkPidFile(t)
 }
 
+func TestLogFields(t *testing.T) {
+	inBuffer := bytes.NewBuffer(nil)
+	feedConf(inBuffer, t)
+	outBuffer := bytes.NewBuffer(nil)
+	input := stormenc.NewJsonObjectInput(inBuffer)
+	output := stormenc.NewJsonObjectOutput(outBuffer)
+	spoutConn := newSpoutConn(input, output, true)
+	spoutConn.Connect()
+
+	expectPid(outBuffer, t)
+
+	logger := spoutConn.(stormcore.FieldLogger)
+	logger.LogFields("connection\tlost", map[string]interface{}{"retries": 3, "host": "db1", "done": make(chan bool)})
+	var msg map[string]string
+	line, err := outBuffer.ReadBytes('\n')
+	checkErr(err, t)
+	checkErr(json.Unmarshal(line, &msg), t)
+	expect("end", outBuffer, t)
+
+	text, fields, ok := stormcore.ParseLogFields(msg["msg"])
+	if !ok || text != "connection\tlost" || fields["host"] != "db1" || fields["retries"] != float64(3) || !strings.HasPrefix(fields["done"].(string), "0x") {
+		t.Fatalf("Unexpected structured log: %q", msg["msg"])
+	}
+
+	if text := stormcore.FormatLogFields("no fields", nil); text != "no fields" {
+		t.Fatalf("Unexpected log without fields: %q", text)
+	}
+	if _, _, ok := stormcore.ParseLogFields("plain\tmessage"); ok {
+		t.Fatalf("Parsed fields from a plain message")
+	}
+}
+
 func feedReadBoltMsg(buffer io.Writer, t *testing.T) {
 	feedConf(buffer, t)
 	writeMsg(testBoltMsg(0), buffer, t)
@@ -193,7 +295,7 @@ func TestReadTuple(t *testing.T) {
 
 	input := stormenc.NewJsonObjectInput(buffer)
 	output := stormenc.NewJsonObjectOutput(os.Stdout)
-	boltConn := stormcore.NewBoltConn(input, output, true)
+	boltConn := newBoltConn(input, output, true)
 	boltConn.Connect()
 
 	var msg string
@@ -208,6 +310,65 @@ func TestReadTuple(t *testing.T) {
 	checkPidFile(t)
 }
 
+func TestInputSchema(t *testing.T) {
+	inBuffer := bytes.NewBuffer(nil)
+	feedConf(inBuffer, t)
+	for _, tuple := range []string{
+		`{"id":"1","comp":"spout","stream":"default","task":4,"tuple":["a",1]}`,
+		// The count is not an integer
+		`{"id":"2","comp":"spout","stream":"default","task":4,"tuple":["b",1.5]}`,
+		// The count is missing
+		`{"id":"3","comp":"spout","stream":"default","task":4,"tuple":["c"]}`,
+		// Other streams are not checked
+		`{"id":"4","comp":"spout","stream":"other","task":4,"tuple":[true]}`,
+		`{"id":"5","comp":"spout","stream":"default","task":4,"tuple":["e",2]}`,
+	} {
+		inBuffer.WriteString(tuple + "\nend\n")
+	}
+	outBuffer := bytes.NewBuffer(nil)
+	input := stormenc.NewJsonObjectInput(inBuffer)
+	output := stormenc.NewJsonObjectOutput(outBuffer)
+	boltConn := newBoltConn(input, output, false)
+	boltConn.(stormcore.SchemaValidator).RegisterInputSchema("", []reflect.Kind{reflect.String, reflect.Int})
+	boltConn.Connect()
+	expectPid(outBuffer, t)
+
+	var read []string
+	for {
+		var word, count interface{}
+		meta := &messages.BoltMsgMeta{}
+		if err := boltConn.ReadBoltMsg(meta, &word, &count); err == io.EOF {
+			break
+		} else {
+			checkErr(err, t)
+		}
+		read = append(read, meta.Id)
+	}
+	if !reflect.DeepEqual(read, []string{"1", "4", "5"}) {
+		t.Fatalf("Unexpected tuples read: %v", read)
+	}
+
+	// Rejected tuples are reported and failed
+	for _, id := range []string{"2", "3"} {
+		var report map[string]interface{}
+		line, err := outBuffer.ReadBytes('\n')
+		checkErr(err, t)
+		checkErr(json.Unmarshal(line, &report), t)
+		if report["command"] != "error" || !strings.Contains(report["msg"].(string), "Tuple "+id+" from spout on stream default does not match its schema: field 1 is not a int") {
+			t.Fatalf("Unexpected error report: %s", line)
+		}
+		expect("end", outBuffer, t)
+		output.Flush()
+		expect(fmt.Sprintf(`{"command":"fail","id":"%s"}`, id), outBuffer, t)
+		expect("end", outBuffer, t)
+	}
+	if stats := boltConn.Stats(); stats.Read != 5 || stats.Failed != 2 {
+		t.Fatalf("Unexpected stats: %+v", stats)
+	}
+
+	checkPidFile(t)
+}
+
 func TestSendAck(t *testing.T) {
 	inBuffer := bytes.NewBuffer(nil)
 	feedConf(inBuffer, t)
@@ -216,7 +377,7 @@ func TestSendAck(t *testing.T) {
 
 	input := stormenc.NewJsonObjectInput(inBuffer)
 	output := stormenc.NewJsonObjectOutput(outBuffer)
-	boltConn := stormcore.NewBoltConn(input, output, true)
+	boltConn := newBoltConn(input, output, true)
 	boltConn.Connect()
 
 	var ids []string
@@ -246,7 +407,7 @@ func TestSendFail(t *testing.T) {
 
 	input := stormenc.NewJsonObjectInput(inBuffer)
 	output := stormenc.NewJsonObjectOutput(outBuffer)
-	boltConn := stormcore.NewBoltConn(input, output, true)
+	boltConn := newBoltConn(input, output, true)
 	boltConn.Connect()
 
 	var ids []string
@@ -307,7 +468,7 @@ func testBoltEmit(taskIdsList [][]int32, inBuffer io.Reader, t *testing.T) {
 	outBuffer := bytes.NewBuffer(nil)
 	input := stormenc.NewJsonObjectInput(inBuffer)
 	output := stormenc.NewJsonObjectOutput(outBuffer)
-	boltConn := stormcore.NewBoltConn(input, output, true)
+	boltConn := newBoltConn(input, output, true)
 	boltConn.Connect()
 
 	expectPid(outBuffer, t)
@@ -425,7 +586,7 @@ func TestReadMsg(t *testing.T) {
 
 	input := stormenc.NewJsonObjectInput(buffer)
 	output := stormenc.NewJsonObjectOutput(os.Stdout)
-	spoutConn := stormcore.NewSpoutConn(input, output, true)
+	spoutConn := newSpoutConn(input, output, true)
 	spoutConn.Connect()
 
 	for i := 0; i < 6; i++ {
@@ -448,7 +609,7 @@ func TestSendSync(t *testing.T) {
 	outBuffer := bytes.NewBuffer(nil)
 	input := stormenc.NewJsonObjectInput(inBuffer)
 	output := stormenc.NewJsonObjectOutput(outBuffer)
-	spoutConn := stormcore.NewSpoutConn(input, output, true)
+	spoutConn := newSpoutConn(input, output, true)
 	spoutConn.Connect()
 
 	expectPid(outBuffer, t)
@@ -462,3 +623,3283 @@ func TestSendSync(t *testing.T) {
 
 	checkPidFile(t)
 }
+
+func TestSyncSleep(t *testing.T) {
+	inBuffer := bytes.NewBuffer(nil)
+	feedConf(inBuffer, t)
+	writeMsg(newSpoutMsg("next", ""), inBuffer, t)
+	writeMsg(newSpoutMsg("next", ""), inBuffer, t)
+	input := stormenc.NewJsonObjectInput(inBuffer)
+	output := stormenc.NewJsonObjectOutput(bytes.NewBuffer(nil))
+	spoutConn := newSpoutConn(input, output, false)
+	spoutConn.Connect()
+
+	sleep := 50 * time.Millisecond
+	spoutConn.SetSyncSleep(sleep)
+
+	// An idle next should sleep before syncing
+	_, _, err := spoutConn.ReadSpoutMsg()
+	checkErr(err, t)
+	start := time.Now()
+	spoutConn.SendSync()
+	if elapsed := time.Since(start); elapsed < sleep {
+		t.Fatalf("Idle spout synced after %v, expected at least %v", elapsed, sleep)
+	}
+
+	// A next during which a tuple was emitted should sync immediately
+	_, _, err = spoutConn.ReadSpoutMsg()
+	checkErr(err, t)
+	start = time.Now()
+	spoutConn.Emit("1", "", "Msg")
+	spoutConn.SendSync()
+	if elapsed := time.Since(start); elapsed >= sleep {
+		t.Fatalf("Busy spout synced after %v, expected no sleep", elapsed)
+	}
+
+	checkPidFile(t)
+}
+
+func TestNoSyncSleep(t *testing.T) {
+	inBuffer := bytes.NewBuffer(nil)
+	feedConf(inBuffer, t)
+	for i := 0; i < 100; i++ {
+		writeMsg(newSpoutMsg("next", ""), inBuffer, t)
+	}
+	input := stormenc.NewJsonObjectInput(inBuffer)
+	outBuffer := bytes.NewBuffer(nil)
+	output := stormenc.NewJsonObjectOutput(outBuffer)
+	spoutConn := newSpoutConn(input, output, false)
+	spoutConn.Connect()
+	expectPid(outBuffer, t)
+
+	spoutConn.SetSyncSleep(50 * time.Millisecond)
+	spoutConn.SetSyncSleep(0)
+
+	// Idle nexts are answered immediately with a sync
+	start := time.Now()
+	for i := 0; i < 100; i++ {
+		command, _, err := spoutConn.ReadSpoutMsg()
+		checkErr(err, t)
+		if command != stormcore.CommandNext {
+			t.Fatalf("Unexpected command: %s", command)
+		}
+		spoutConn.SendSync()
+		expect(`{"command":"sync"}`, outBuffer, t)
+		expect("end", outBuffer, t)
+	}
+	if elapsed := time.Since(start); elapsed >= 50*time.Millisecond {
+		t.Fatalf("Idle spout without sync sleep took %v to sync 100 times", elapsed)
+	}
+	if _, _, err := spoutConn.ReadSpoutMsg(); err != io.EOF {
+		t.Fatalf("Expected EOF, received: %v", err)
+	}
+
+	checkPidFile(t)
+}
+
+func TestDedupAnchors(t *testing.T) {
+	inBuffer := bytes.NewBuffer(nil)
+	feedConf(inBuffer, t)
+	outBuffer := bytes.NewBuffer(nil)
+	input := stormenc.NewJsonObjectInput(inBuffer)
+	output := stormenc.NewJsonObjectOutput(outBuffer)
+	boltConn := newBoltConn(input, output, false)
+	boltConn.Connect()
+
+	expectPid(outBuffer, t)
+
+	anchors := []string{"1", "2", "1", "3", "2"}
+	boltConn.Emit(anchors, "", "Msg")
+	expect(`{"anchors":["1","2","1","3","2"],"command":"emit","need_task_ids":false,"tuple":["Msg"]}`, outBuffer, t)
+	expect("end", outBuffer, t)
+
+	boltConn.SetDedupAnchors(true)
+	boltConn.Emit(anchors, "", "Msg")
+	expect(`{"anchors":["1","2","3"],"command":"emit","need_task_ids":false,"tuple":["Msg"]}`, outBuffer, t)
+	expect("end", outBuffer, t)
+
+	checkPidFile(t)
+}
+
+func TestReadTimeout(t *testing.T) {
+	pipeReader, pipeWriter := io.Pipe()
+	reader := stormcore.NewTimeoutReader(pipeReader)
+	reader.SetReadTimeout(20 * time.Millisecond)
+	input := stormenc.NewJsonObjectInput(reader)
+
+	var msg string
+	err := input.ReadMsg(&msg)
+	if err != stormcore.ErrReadTimeout {
+		t.Fatalf("Expected read timeout, received: %v", err)
+	}
+
+	// A timeout is fatal, so data that arrives later is not read
+	go func() {
+		pipeWriter.Write([]byte("\"Msg\"\nend\n"))
+		pipeWriter.Close()
+	}()
+	err = input.ReadMsg(&msg)
+	if err != stormcore.ErrReadTimeout {
+		t.Fatalf("Expected read timeout after a timeout, received: %v", err)
+	}
+
+	liveReader, liveWriter := io.Pipe()
+	reader = stormcore.NewTimeoutReader(liveReader)
+	reader.SetReadTimeout(time.Second)
+	input = stormenc.NewJsonObjectInput(reader)
+	go func() {
+		writeMsg(contents[0], liveWriter, t)
+		liveWriter.Close()
+	}()
+	err = input.ReadMsg(&msg)
+	checkErr(err, t)
+	msgCheck(msg, contents[0], t)
+
+	err = input.ReadMsg(&msg)
+	if err != io.EOF {
+		t.Fatalf("Expected EOF, received: %v", err)
+	}
+}
+
+func TestZeroTasks(t *testing.T) {
+	inBuffer := bytes.NewBuffer(nil)
+	feedConf(inBuffer, t)
+	writeMsg([]int32{1}, inBuffer, t)
+	writeMsg([]int32{}, inBuffer, t)
+	input := stormenc.NewJsonObjectInput(inBuffer)
+	output := stormenc.NewJsonObjectOutput(bytes.NewBuffer(nil))
+	boltConn := newBoltConn(input, output, true)
+	boltConn.Connect()
+
+	var dropped []string
+	boltConn.OnZeroTasks(func(stream string, contents []interface{}) {
+		dropped = append(dropped, fmt.Sprintf("%s:%v", stream, contents[0]))
+	})
+
+	boltConn.Emit(nil, "delivered", "Msg0")
+	boltConn.Emit(nil, "dropped", "Msg1")
+	if len(dropped) != 1 || dropped[0] != "dropped:Msg1" {
+		t.Fatalf("Expected a single dropped emission, received: %v", dropped)
+	}
+
+	checkPidFile(t)
+}
+
+func TestEmitUnreliable(t *testing.T) {
+	inBuffer := bytes.NewBuffer(nil)
+	feedConf(inBuffer, t)
+	writeMsg(newSpoutMsg("next", ""), inBuffer, t)
+	outBuffer := bytes.NewBuffer(nil)
+	input := stormenc.NewJsonObjectInput(inBuffer)
+	output := stormenc.NewJsonObjectOutput(outBuffer)
+	spoutConn := newSpoutConn(input, output, false)
+	spoutConn.Connect()
+
+	expectPid(outBuffer, t)
+
+	_, _, err := spoutConn.ReadSpoutMsg()
+	checkErr(err, t)
+	spoutConn.(stormcore.UnreliableEmitter).EmitUnreliable("", "Msg")
+	expect(`{"command":"emit","need_task_ids":false,"tuple":["Msg"]}`, outBuffer, t)
+	expect("end", outBuffer, t)
+
+	checkPidFile(t)
+}
+
+func expectPanic(t *testing.T, f func()) {
+	defer func() {
+		if r := recover(); r == nil {
+			t.Fatal("Expected a panic")
+		}
+	}()
+	f()
+}
+
+func TestDeclareOutputFields(t *testing.T) {
+	inBuffer := bytes.NewBuffer(nil)
+	feedConf(inBuffer, t)
+	outBuffer := bytes.NewBuffer(nil)
+	input := stormenc.NewJsonObjectInput(inBuffer)
+	output := stormenc.NewJsonObjectOutput(outBuffer)
+	boltConn := newBoltConn(input, output, false)
+	boltConn.Connect()
+
+	expectPid(outBuffer, t)
+
+	boltConn.DeclareOutputFields("default", []string{"word", "count"})
+	boltConn.Emit(nil, "", "word", 1)
+	expect(`{"command":"emit","need_task_ids":false,"tuple":["word",1]}`, outBuffer, t)
+	expect("end", outBuffer, t)
+
+	expectPanic(t, func() { boltConn.Emit(nil, "default", "word") })
+	expectPanic(t, func() { boltConn.EmitDirect(nil, "", 2, "word", 1, "extra") })
+
+	// Undeclared streams are not checked
+	boltConn.Emit(nil, "other", "word")
+	expect(`{"command":"emit","need_task_ids":false,"stream":"other","tuple":["word"]}`, outBuffer, t)
+	expect("end", outBuffer, t)
+
+	checkPidFile(t)
+}
+
+func TestStdioBoltConn(t *testing.T) {
+	stdin, err := ioutil.TempFile("", "gostorm-stdin")
+	checkErr(err, t)
+	defer os.Remove(stdin.Name())
+	defer stdin.Close()
+	stdout, err := ioutil.TempFile("", "gostorm-stdout")
+	checkErr(err, t)
+	defer os.Remove(stdout.Name())
+	defer stdout.Close()
+	feedConf(stdin, t)
+	_, err = stdin.Seek(0, io.SeekStart)
+	checkErr(err, t)
+
+	defaultStdin, defaultStdout := os.Stdin, os.Stdout
+	os.Stdin, os.Stdout = stdin, stdout
+	boltConn := stormcore.StdioBoltConn("jsonObject")
+	boltConn.Connect()
+	checkErr(boltConn.(io.Closer).Close(), t)
+	os.Stdin, os.Stdout = defaultStdin, defaultStdout
+
+	written, err := ioutil.ReadFile(stdout.Name())
+	checkErr(err, t)
+	if expected := fmt.Sprintf("{\"pid\":%d}\nend\n", os.Getpid()); string(written) != expected {
+		t.Fatalf("Unexpected output on stdout: %q", written)
+	}
+}
+
+func TestClose(t *testing.T) {
+	inBuffer := bytes.NewBuffer(nil)
+	feedConf(inBuffer, t)
+	outBuffer := bytes.NewBuffer(nil)
+	input := stormenc.NewJsonObjectInput(inBuffer)
+	output := stormenc.NewJsonObjectOutput(outBuffer)
+	boltConn := newBoltConn(input, output, false)
+	boltConn.Connect()
+
+	expectPid(outBuffer, t)
+
+	boltConn.SendAck("1")
+	checkErr(boltConn.Close(), t)
+
+	// Close should flush the ack and remove the pid file
+	expect(`{"command":"ack","id":"1"}`, outBuffer, t)
+	expect("end", outBuffer, t)
+	_, err := os.Stat(fmt.Sprintf("%d", os.Getpid()))
+	if !os.IsNotExist(err) {
+		t.Fatalf("Expected the pid file to be removed, received: %v", err)
+	}
+
+	checkErr(boltConn.Close(), t)
+}
+
+type countingSpout struct {
+	acked  int32
+	failed int32
+	exited bool
+	counts string
+}
+
+func (this *countingSpout) NextTuple() {}
+
+func (this *countingSpout) Acked(id string) {
+	time.Sleep(time.Millisecond)
+	atomic.AddInt32(&this.acked, 1)
+}
+
+func (this *countingSpout) Failed(id string) {
+	time.Sleep(time.Millisecond)
+	atomic.AddInt32(&this.failed, 1)
+}
+
+func (this *countingSpout) Exit() {
+	this.exited = true
+	this.counts = fmt.Sprintf("%d/%d", atomic.LoadInt32(&this.acked), atomic.LoadInt32(&this.failed))
+}
+
+func (this *countingSpout) Open(context *messages.Context, collector gostorm.SpoutOutputCollector) {}
+
+func TestAckConcurrency(t *testing.T) {
+	inBuffer := bytes.NewBuffer(nil)
+	feedConf(inBuffer, t)
+	writeMsg(newSpoutMsg("next", ""), inBuffer, t)
+	for i := 0; i < 20; i++ {
+		writeMsg(newSpoutMsg("ack", fmt.Sprintf("%d", i)), inBuffer, t)
+		writeMsg(newSpoutMsg("fail", fmt.Sprintf("%d", i)), inBuffer, t)
+	}
+	input := stormenc.NewJsonObjectInput(inBuffer)
+	output := stormenc.NewJsonObjectOutput(bytes.NewBuffer(nil))
+	spoutConn := newSpoutConn(input, output, false)
+
+	spout := &countingSpout{}
+	shellSpout := gostorm.NewShellSpout(spout)
+	shellSpout.SetAckConcurrency(4)
+	shellSpout.Initialise(spoutConn)
+	shellSpout.Go()
+
+	// All acks and fails should have been processed before Exit
+	if !spout.exited || spout.counts != "20/20" {
+		t.Fatalf("Expected 20 acks and fails before exit, received: %s", spout.counts)
+	}
+
+	checkPidFile(t)
+}
+
+type trackingSpout struct {
+	collector gostorm.TrackedSpoutOutputCollector
+	calls     int
+	pending   []int
+}
+
+func (this *trackingSpout) NextTuple() {
+	this.calls++
+	this.collector.EmitTracked("", nil, nil, this.calls)
+	this.pending = append(this.pending, this.collector.(stormcore.PendingCounter).Pending())
+}
+
+func (this *trackingSpout) Acked(id string)  {}
+func (this *trackingSpout) Failed(id string) {}
+func (this *trackingSpout) Exit()            {}
+
+func (this *trackingSpout) Open(context *messages.Context, collector gostorm.SpoutOutputCollector) {
+	this.collector = collector.(gostorm.TrackedSpoutOutputCollector)
+}
+
+func TestMaxPending(t *testing.T) {
+	inBuffer := bytes.NewBuffer(nil)
+	feedConf(inBuffer, t)
+	for _, msg := range []*messages.SpoutMsg{
+		newSpoutMsg("next", ""),
+		newSpoutMsg("next", ""),
+		// Two tuples are pending, so the spout is not asked for more
+		newSpoutMsg("next", ""),
+		newSpoutMsg("ack", stormcore.TrackedIdPrefix+"1"),
+		newSpoutMsg("next", ""),
+		newSpoutMsg("next", ""),
+	} {
+		writeMsg(msg, inBuffer, t)
+	}
+	input := stormenc.NewJsonObjectInput(inBuffer)
+	outBuffer := bytes.NewBuffer(nil)
+	output := stormenc.NewJsonObjectOutput(outBuffer)
+	spoutConn := newSpoutConn(input, output, false)
+
+	spout := &trackingSpout{}
+	shellSpout := gostorm.NewShellSpout(spout)
+	shellSpout.SetMaxPending(2)
+	shellSpout.Initialise(spoutConn)
+	shellSpout.Go()
+	spoutConn.Close()
+
+	if spout.calls != 3 || !reflect.DeepEqual(spout.pending, []int{1, 2, 2}) {
+		t.Fatalf("Unexpected NextTuple calls: %d, pending: %v", spout.calls, spout.pending)
+	}
+	// Every command is still answered with a sync
+	if syncs := strings.Count(outBuffer.String(), `"command":"sync"`); syncs != 6 {
+		t.Fatalf("Expected 6 syncs, found %d", syncs)
+	}
+}
+
+// offsetSpout emits the next offset of a log with every NextTuple and
+// records the offsets that are acked and failed
+type offsetSpout struct {
+	collector gostorm.KeyedSpoutOutputCollector
+	offset    int64
+	acked     []int64
+	failed    []int64
+	ids       []string
+}
+
+func (this *offsetSpout) NextTuple() {
+	this.offset++
+	this.collector.EmitWithKey(strconv.FormatInt(this.offset, 10), "", this.offset)
+}
+
+func (this *offsetSpout) AckedKey(key stormcore.TupleKey) {
+	offset, _ := key.Int64()
+	this.acked = append(this.acked, offset)
+}
+
+func (this *offsetSpout) FailedKey(key stormcore.TupleKey) {
+	offset, _ := key.Int64()
+	this.failed = append(this.failed, offset)
+}
+
+func (this *offsetSpout) Acked(id string)  { this.ids = append(this.ids, id) }
+func (this *offsetSpout) Failed(id string) { this.ids = append(this.ids, id) }
+func (this *offsetSpout) Exit()            {}
+
+func (this *offsetSpout) Open(context *messages.Context, collector gostorm.SpoutOutputCollector) {
+	this.collector = collector.(gostorm.KeyedSpoutOutputCollector)
+}
+
+func TestEmitWithKey(t *testing.T) {
+	inBuffer := bytes.NewBuffer(nil)
+	feedConf(inBuffer, t)
+	for _, msg := range []*messages.SpoutMsg{
+		newSpoutMsg("next", ""),
+		newSpoutMsg("next", ""),
+		newSpoutMsg("fail", stormcore.KeyedIdPrefix+"1"),
+		newSpoutMsg("ack", stormcore.KeyedIdPrefix+"2"),
+		// Ids that are not keys are passed to Acked
+		newSpoutMsg("ack", "3"),
+	} {
+		writeMsg(msg, inBuffer, t)
+	}
+	input := stormenc.NewJsonObjectInput(inBuffer)
+	outBuffer := bytes.NewBuffer(nil)
+	output := stormenc.NewJsonObjectOutput(outBuffer)
+	spoutConn := newSpoutConn(input, output, false)
+
+	spout := &offsetSpout{}
+	shellSpout := gostorm.NewShellSpout(spout)
+	shellSpout.Initialise(spoutConn)
+	shellSpout.Go()
+	spoutConn.Close()
+
+	if !reflect.DeepEqual(spout.acked, []int64{2}) || !reflect.DeepEqual(spout.failed, []int64{1}) || !reflect.DeepEqual(spout.ids, []string{"3"}) {
+		t.Fatalf("Unexpected completions: acked %v, failed %v, ids %v", spout.acked, spout.failed, spout.ids)
+	}
+	if !strings.Contains(outBuffer.String(), `"id":"`+stormcore.KeyedIdPrefix+`2"`) {
+		t.Fatalf("Keyed id not emitted: %s", outBuffer.String())
+	}
+	if key, ok := stormcore.ParseKey("2"); ok {
+		t.Fatalf("Parsed key %s from a plain id", key)
+	}
+
+	spoutConn = newSpoutConn(input, output, false)
+	expectPanic(t, func() { spoutConn.Emit(stormcore.KeyedIdPrefix+"1", "", "a") })
+}
+
+// droppingSpout emits a tracked tuple with every NextTuple and records
+// the callbacks that were called
+type droppingSpout struct {
+	collector gostorm.TrackedSpoutOutputCollector
+	calls     int
+	events    []string
+}
+
+func (this *droppingSpout) NextTuple() {
+	this.calls++
+	call := this.calls
+	this.collector.EmitTracked("", func() {
+		this.events = append(this.events, fmt.Sprintf("acked %d", call))
+	}, func() {
+		this.events = append(this.events, fmt.Sprintf("failed %d", call))
+	}, call)
+	this.events = append(this.events, fmt.Sprintf("emitted %d", call))
+}
+
+func (this *droppingSpout) Acked(id string)  { this.events = append(this.events, "Acked "+id) }
+func (this *droppingSpout) Failed(id string) { this.events = append(this.events, "Failed "+id) }
+func (this *droppingSpout) Exit()            {}
+
+func (this *droppingSpout) Open(context *messages.Context, collector gostorm.SpoutOutputCollector) {
+	this.collector = collector.(gostorm.TrackedSpoutOutputCollector)
+}
+
+func TestFailDropped(t *testing.T) {
+	inBuffer := bytes.NewBuffer(nil)
+	feedConf(inBuffer, t)
+	writeMsg(newSpoutMsg("next", ""), inBuffer, t)
+	// The first tuple is not sent to any task, which Storm acks right away
+	writeMsg([]int32{}, inBuffer, t)
+	writeMsg(newSpoutMsg("ack", stormcore.TrackedIdPrefix+"1"), inBuffer, t)
+	writeMsg(newSpoutMsg("next", ""), inBuffer, t)
+	writeMsg([]int32{3}, inBuffer, t)
+	writeMsg(newSpoutMsg("ack", stormcore.TrackedIdPrefix+"2"), inBuffer, t)
+	input := stormenc.NewJsonObjectInput(inBuffer)
+	outBuffer := bytes.NewBuffer(nil)
+	output := stormenc.NewJsonObjectOutput(outBuffer)
+	// Task ids are requested for tracked emissions, even though the
+	// connection does not request them
+	spoutConn := newSpoutConn(input, output, false)
+	spoutConn.(stormcore.DroppedFailer).SetFailDropped(true)
+
+	spout := &droppingSpout{}
+	shellSpout := gostorm.NewShellSpout(spout)
+	shellSpout.Initialise(spoutConn)
+	shellSpout.Go()
+	spoutConn.Close()
+
+	expected := []string{"failed 1", "emitted 1", "emitted 2", "acked 2"}
+	if !reflect.DeepEqual(spout.events, expected) {
+		t.Fatalf("Expected %v, received %v", expected, spout.events)
+	}
+	if strings.Contains(outBuffer.String(), `"need_task_ids":false`) {
+		t.Fatalf("Task ids not requested for tracked emissions: %s", outBuffer.String())
+	}
+}
+
+// activatingSpout records its lifecycle and emits a tuple when it is
+// activated
+type activatingSpout struct {
+	countingSpout
+	collector gostorm.SpoutOutputCollector
+	events    []string
+}
+
+func (this *activatingSpout) OnActivate() {
+	this.events = append(this.events, "activated")
+	this.collector.(gostorm.UnreliableSpoutOutputCollector).EmitUnreliable("", "active")
+}
+
+func (this *activatingSpout) OnDeactivate() {
+	this.events = append(this.events, "deactivated")
+}
+
+func (this *activatingSpout) Open(context *messages.Context, collector gostorm.SpoutOutputCollector) {
+	this.collector = collector
+}
+
+func TestSpoutActivation(t *testing.T) {
+	newInput := func() io.Reader {
+		inBuffer := bytes.NewBuffer(nil)
+		feedConf(inBuffer, t)
+		for _, command := range []string{"activate", "next", "deactivate"} {
+			writeMsg(newSpoutMsg(command, ""), inBuffer, t)
+		}
+		return inBuffer
+	}
+
+	outBuffer := bytes.NewBuffer(nil)
+	spoutConn := newSpoutConn(stormenc.NewJsonObjectInput(newInput()), stormenc.NewJsonObjectOutput(outBuffer), false)
+	spout := &activatingSpout{}
+	shellSpout := gostorm.NewShellSpout(spout)
+	shellSpout.Initialise(spoutConn)
+	shellSpout.Go()
+	spoutConn.Close()
+
+	if !reflect.DeepEqual(spout.events, []string{"activated", "deactivated"}) {
+		t.Fatalf("Unexpected lifecycle: %v", spout.events)
+	}
+	expectPid(outBuffer, t)
+	expect(`{"command":"emit","need_task_ids":false,"tuple":["active"]}`, outBuffer, t)
+	expect("end", outBuffer, t)
+	for i := 0; i < 3; i++ {
+		expect(`{"command":"sync"}`, outBuffer, t)
+		expect("end", outBuffer, t)
+	}
+
+	// Spouts that do not handle the lifecycle only reply to the commands
+	outBuffer = bytes.NewBuffer(nil)
+	spoutConn = newSpoutConn(stormenc.NewJsonObjectInput(newInput()), stormenc.NewJsonObjectOutput(outBuffer), false)
+	shellSpout = gostorm.NewShellSpout(&countingSpout{})
+	shellSpout.Initialise(spoutConn)
+	shellSpout.Go()
+	spoutConn.Close()
+	if syncs := strings.Count(outBuffer.String(), `"command":"sync"`); syncs != 3 {
+		t.Fatalf("Expected 3 syncs, found %d", syncs)
+	}
+}
+
+// panicBolt panics when it executes the tuple with the given id and acks
+// every other tuple
+type panicBolt struct {
+	splitBolt
+	panicId string
+}
+
+func (this *panicBolt) Execute(meta messages.BoltMsgMeta, fields ...interface{}) {
+	if meta.Id == this.panicId {
+		panic("bad tuple")
+	}
+	this.collector.SendAck(meta.Id)
+}
+
+func TestBoltRecoverPanics(t *testing.T) {
+	newConn := func(outBuffer *bytes.Buffer) testBoltConn {
+		inBuffer := bytes.NewBuffer(nil)
+		feedConf(inBuffer, t)
+		writeMsg(testBoltMsg(0), inBuffer, t)
+		writeMsg(testBoltMsg(1), inBuffer, t)
+		return newBoltConn(stormenc.NewJsonObjectInput(inBuffer), stormenc.NewJsonObjectOutput(outBuffer), false)
+	}
+
+	// Panics are not recovered by default
+	boltConn := newConn(bytes.NewBuffer(nil))
+	shellBolt := gostorm.NewShellBolt(&panicBolt{panicId: ids[0]})
+	shellBolt.Initialise(boltConn)
+	expectPanic(t, shellBolt.Go)
+	boltConn.Close()
+
+	outBuffer := bytes.NewBuffer(nil)
+	boltConn = newConn(outBuffer)
+	shellBolt = gostorm.NewShellBolt(&panicBolt{panicId: ids[0]})
+	shellBolt.SetRecoverPanics(true)
+	shellBolt.Initialise(boltConn)
+	shellBolt.Go()
+	boltConn.Close()
+
+	expectPid(outBuffer, t)
+	var reported map[string]interface{}
+	line, err := outBuffer.ReadBytes('\n')
+	checkErr(err, t)
+	checkErr(json.Unmarshal(line, &reported), t)
+	if reported["command"] != "error" || !strings.Contains(reported["msg"].(string), "tuple "+ids[0]+": bad tuple") {
+		t.Fatalf("Unexpected error report: %s", line)
+	}
+	expect("end", outBuffer, t)
+	expect(fmt.Sprintf(`{"command":"fail","id":"%s"}`, ids[0]), outBuffer, t)
+	expect("end", outBuffer, t)
+	expect(fmt.Sprintf(`{"command":"ack","id":"%s"}`, ids[1]), outBuffer, t)
+	expect("end", outBuffer, t)
+}
+
+type panicSpout struct {
+	countingSpout
+	nexts int
+}
+
+func (this *panicSpout) NextTuple() {
+	this.nexts++
+	panic("no tuples")
+}
+
+func (this *panicSpout) Acked(id string) {
+	panic("ack for " + id)
+}
+
+func TestSpoutRecoverPanics(t *testing.T) {
+	inBuffer := bytes.NewBuffer(nil)
+	feedConf(inBuffer, t)
+	writeMsg(newSpoutMsg("next", ""), inBuffer, t)
+	writeMsg(newSpoutMsg("ack", "1"), inBuffer, t)
+	writeMsg(newSpoutMsg("next", ""), inBuffer, t)
+	outBuffer := bytes.NewBuffer(nil)
+	spoutConn := newSpoutConn(stormenc.NewJsonObjectInput(inBuffer), stormenc.NewJsonObjectOutput(outBuffer), false)
+
+	spout := &panicSpout{}
+	shellSpout := gostorm.NewShellSpout(spout)
+	shellSpout.SetRecoverPanics(true)
+	shellSpout.Initialise(spoutConn)
+	shellSpout.Go()
+	spoutConn.Close()
+
+	if spout.nexts != 2 || !spout.exited {
+		t.Fatalf("Spout did not continue after panics: %d nexts, exited: %v", spout.nexts, spout.exited)
+	}
+	output := outBuffer.String()
+	if errors := strings.Count(output, `"command":"error"`); errors != 3 {
+		t.Fatalf("Expected 3 error reports, found %d: %s", errors, output)
+	}
+	if !strings.Contains(output, "ack command for tuple 1: ack for 1") {
+		t.Fatalf("Panic in Acked not reported: %s", output)
+	}
+	if syncs := strings.Count(output, `"command":"sync"`); syncs != 3 {
+		t.Fatalf("Expected 3 syncs, found %d", syncs)
+	}
+}
+
+// tupleId takes a gostorm.Tuple, which is the same type as core.Tuple
+func tupleId(tuple *gostorm.Tuple) string {
+	return tuple.Meta.Id
+}
+
+func TestReadTuples(t *testing.T) {
+	buffer := bytes.NewBuffer(nil)
+	feedReadBoltMsg(buffer, t)
+
+	input := stormenc.NewJsonObjectInput(buffer)
+	output := stormenc.NewJsonObjectOutput(bytes.NewBuffer(nil))
+	boltConn := newBoltConn(input, output, false)
+	boltConn.DeclareInputFields("spout", "", []string{"sentence"})
+	// Tuples are read on a separate goroutine, while they are acked on
+	// this one
+	boltConn.SetTrackLatency(true)
+	boltConn.SetValidateAcks(len(contents))
+	boltConn.Connect()
+
+	fields := func() []interface{} {
+		var msg string
+		return []interface{}{&msg}
+	}
+	tuples, errs := stormcore.ReadTuples(boltConn, fields)
+
+	i := 0
+	for tuple := range tuples {
+		msgCheck(*tuple.Fields[0].(*string), contents[i], t)
+		if tuple.Get("sentence") != tuple.Fields[0] || tuple.Get("word") != nil {
+			t.Fatalf("Unexpected fields by name for names %v", tuple.Names)
+		}
+		metaTest(&tuple.Meta, i, t)
+		if tuple.ReadTime().IsZero() || tuple.Latency() < 0 {
+			t.Fatalf("Unexpected read time: %v", tuple.ReadTime())
+		}
+		boltConn.SendAck(tupleId(tuple))
+		i++
+	}
+	if i != len(contents) {
+		t.Fatalf("Expected %d tuples, received %d", len(contents), i)
+	}
+	checkErr(<-errs, t)
+
+	checkPidFile(t)
+}
+
+func TestEmitDelivered(t *testing.T) {
+	inBuffer := bytes.NewBuffer(nil)
+	feedConf(inBuffer, t)
+	writeMsg(newSpoutMsg("next", ""), inBuffer, t)
+	writeMsg([]int32{}, inBuffer, t)
+	writeMsg([]int32{3}, inBuffer, t)
+	outBuffer := bytes.NewBuffer(nil)
+	input := stormenc.NewJsonObjectInput(inBuffer)
+	output := stormenc.NewJsonObjectOutput(outBuffer)
+	spoutConn := newSpoutConn(input, output, false)
+	spoutConn.Connect()
+	expectPid(outBuffer, t)
+	_, _, err := spoutConn.ReadSpoutMsg()
+	checkErr(err, t)
+
+	var collector gostorm.SpoutOutputCollector = spoutConn
+	delivery, ok := collector.(gostorm.DeliverySpoutOutputCollector)
+	if !ok {
+		t.Fatalf("Spout collector does not report deliveries")
+	}
+	// Task ids are requested, even though the connection does not
+	// request them for other emissions
+	taskIds, delivered := delivery.EmitDelivered("1", "default", "a")
+	if delivered || taskIds == nil || len(taskIds) != 0 {
+		t.Fatalf("Expected an undelivered tuple with empty task ids, got %v (delivered: %v)", taskIds, delivered)
+	}
+	expect(`{"command":"emit","id":"1","tuple":["a"]}`, outBuffer, t)
+	expect("end", outBuffer, t)
+	taskIds, delivered = delivery.EmitDelivered("2", "default", "a")
+	if !delivered || len(taskIds) != 1 || taskIds[0] != 3 {
+		t.Fatalf("Expected a tuple delivered to task 3, got %v (delivered: %v)", taskIds, delivered)
+	}
+	if taskIds := spoutConn.Emit("3", "default", "a"); taskIds != nil {
+		t.Fatalf("Expected nil task ids when they are not requested, got %v", taskIds)
+	}
+}
+
+func TestEmitToNoTasks(t *testing.T) {
+	inBuffer := bytes.NewBuffer(nil)
+	feedConf(inBuffer, t)
+	writeMsg([]int32{}, inBuffer, t)
+	input := stormenc.NewJsonObjectInput(inBuffer)
+	output := stormenc.NewJsonObjectOutput(bytes.NewBuffer(nil))
+	boltConn := newBoltConn(input, output, true)
+	boltConn.Connect()
+
+	if taskIds := boltConn.Emit(nil, "", "a"); taskIds == nil || len(taskIds) != 0 {
+		t.Fatalf("Expected empty task ids for a tuple sent to no tasks, got %#v", taskIds)
+	}
+}
+
+// frameReader returns a single frame for every read and calls onRead
+// before returning it
+type frameReader struct {
+	frames [][]byte
+	onRead func()
+}
+
+func (this *frameReader) Read(p []byte) (int, error) {
+	if len(this.frames) == 0 {
+		return 0, io.EOF
+	}
+	this.onRead()
+	n := copy(p, this.frames[0])
+	this.frames[0] = this.frames[0][n:]
+	if len(this.frames[0]) == 0 {
+		this.frames = this.frames[1:]
+	}
+	return n, nil
+}
+
+func TestReservedStreams(t *testing.T) {
+	for _, stream := range []string{stormcore.SystemStream, stormcore.TickStream, stormcore.MetricsStream, stormcore.HeartbeatStream} {
+		if !stormcore.IsReservedStream(stream) {
+			t.Fatalf("Stream %s is not reserved", stream)
+		}
+	}
+	if stormcore.IsReservedStream("default") || stormcore.IsReservedStream("_private") {
+		t.Fatalf("Unreserved stream reported as reserved")
+	}
+
+	inBuffer := bytes.NewBuffer(nil)
+	feedConf(inBuffer, t)
+	outBuffer := bytes.NewBuffer(nil)
+	input := stormenc.NewJsonObjectInput(inBuffer)
+	output := stormenc.NewJsonObjectOutput(outBuffer)
+	boltConn := newBoltConn(input, output, false)
+	boltConn.Connect()
+	expectPid(outBuffer, t)
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatalf("Expected a panic when emitting on an undeclared reserved stream")
+			}
+		}()
+		boltConn.Emit(nil, stormcore.SystemStream, "coordinate")
+	}()
+	if outBuffer.Len() != 0 {
+		t.Fatalf("Rejected emission was written: %s", outBuffer.String())
+	}
+
+	boltConn.DeclareOutputFields(stormcore.SystemStream, []string{"command"})
+	boltConn.Emit(nil, stormcore.SystemStream, "coordinate")
+	expect(`{"command":"emit","need_task_ids":false,"stream":"__system","tuple":["coordinate"]}`, outBuffer, t)
+	expect("end", outBuffer, t)
+}
+
+func TestOutputDeclarations(t *testing.T) {
+	boltConn := newBoltConn(stormenc.NewJsonObjectInput(bytes.NewBuffer(nil)), stormenc.NewJsonObjectOutput(bytes.NewBuffer(nil)), false)
+	declarer := boltConn.(stormcore.OutputDeclarer)
+	boltConn.DeclareOutputFields("", []string{"word"})
+	declarer.DeclareDirectOutputFields("counts", []string{"word", "count"})
+	boltConn.DeclareOutputFields("alerts", nil)
+
+	declarations := bytes.NewBuffer(nil)
+	checkErr(declarer.WriteOutputDeclarations(declarations), t)
+	expected := `[{"stream":"alerts","fields":[],"direct":false},{"stream":"counts","fields":["word","count"],"direct":true},{"stream":"default","fields":["word"],"direct":false}]` + "\n"
+	if declarations.String() != expected {
+		t.Fatalf("Unexpected output declarations: %s", declarations.String())
+	}
+}
+
+func TestFlushBeforeRead(t *testing.T) {
+	var frames [][]byte
+	for _, msg := range []interface{}{testBoltMsg(0), testBoltMsg(1), []int32{2}} {
+		buffer := bytes.NewBuffer(nil)
+		writeMsg(msg, buffer, t)
+		frames = append(frames, buffer.Bytes())
+	}
+	outBuffer := bytes.NewBuffer(nil)
+	var unflushed []string
+	reader := &frameReader{
+		frames: append([][]byte{conf}, frames...),
+	}
+	// Record the messages that were sent, but not yet written, when a
+	// read from Storm is made
+	var sent []string
+	reader.onRead = func() {
+		for _, msg := range sent {
+			if !strings.Contains(outBuffer.String(), msg) {
+				unflushed = append(unflushed, msg)
+			}
+		}
+	}
+	input := stormenc.NewJsonObjectInput(reader)
+	output := stormenc.NewJsonObjectOutput(outBuffer)
+	boltConn := newBoltConn(input, output, false)
+	boltConn.Connect()
+
+	var msg string
+	meta := &messages.BoltMsgMeta{}
+	checkErr(boltConn.ReadBoltMsg(meta, &msg), t)
+	boltConn.SendAck(meta.Id)
+	sent = append(sent, `"id":"`+meta.Id+`"`)
+	checkErr(boltConn.ReadBoltMsg(meta, &msg), t)
+	boltConn.EmitAsync([]string{meta.Id}, "", msg)
+	sent = append(sent, `"anchors":["`+meta.Id+`"]`)
+	boltConn.ReadPendingTaskIds()
+
+	if len(unflushed) != 0 {
+		t.Fatalf("Messages were not flushed before reading: %v", unflushed)
+	}
+}
+
+func TestTryEmitUnserializable(t *testing.T) {
+	inBuffer := bytes.NewBuffer(nil)
+	feedConf(inBuffer, t)
+	outBuffer := bytes.NewBuffer(nil)
+	input := stormenc.NewJsonObjectInput(inBuffer)
+	output := stormenc.NewJsonObjectOutput(outBuffer)
+	boltConn := newBoltConn(input, output, false)
+	boltConn.Connect()
+	expectPid(outBuffer, t)
+
+	var collector gostorm.OutputCollector = boltConn
+	checked, ok := collector.(gostorm.CheckedOutputCollector)
+	if !ok {
+		t.Fatalf("Bolt collector does not support checked emissions")
+	}
+	if _, err := checked.TryEmit([]string{"1"}, "", make(chan int)); err == nil {
+		t.Fatalf("Expected an error when emitting a channel")
+	}
+	if err := checked.TryEmitDirect(nil, "", 2, func() {}); err == nil {
+		t.Fatalf("Expected an error when emitting a function")
+	}
+	output.Flush()
+	if outBuffer.Len() != 0 {
+		t.Fatalf("Unserializable emissions were written: %s", outBuffer.String())
+	}
+	if emitted := boltConn.Stats().EmittedByStream["default"]; emitted != 0 {
+		t.Fatalf("Unserializable emissions were counted: %d", emitted)
+	}
+
+	// The connection can still be used after an unserializable emission
+	taskIds, err := checked.TryEmit([]string{"1"}, "", "a")
+	checkErr(err, t)
+	if taskIds != nil {
+		t.Fatalf("Expected no task ids, got %v", taskIds)
+	}
+	expect(`{"anchors":["1"],"command":"emit","need_task_ids":false,"tuple":["a"]}`, outBuffer, t)
+	expect("end", outBuffer, t)
+
+	// Spouts return the error from TryEmit as well
+	inBuffer = bytes.NewBuffer(nil)
+	feedConf(inBuffer, t)
+	writeMsg(newSpoutMsg("next", ""), inBuffer, t)
+	spoutConn := newSpoutConn(stormenc.NewJsonEncodedInput(inBuffer), stormenc.NewJsonEncodedOutput(bytes.NewBuffer(nil)), false)
+	spoutConn.Connect()
+	_, _, err = spoutConn.ReadSpoutMsg()
+	checkErr(err, t)
+	if _, err := spoutConn.(stormcore.CheckedEmitter).TryEmit("1", "", make(chan int)); err == nil {
+		t.Fatalf("Expected an error when emitting a channel from a spout")
+	}
+	if spoutConn.TuplesSentSinceNext() {
+		t.Fatalf("Unserializable emission counted as sent")
+	}
+}
+
+func TestTaskIdsTimeout(t *testing.T) {
+	// Storm never replies with the task ids of the emission
+	pipeReader, pipeWriter := io.Pipe()
+	defer pipeWriter.Close()
+	go pipeWriter.Write(conf)
+	input := stormenc.NewJsonObjectInput(pipeReader)
+	output := stormenc.NewJsonObjectOutput(bytes.NewBuffer(nil))
+	boltConn := newBoltConn(input, output, true)
+	boltConn.(stormcore.TaskIdsTimeoutSetter).SetTaskIdsTimeout(10 * time.Millisecond)
+	boltConn.Connect()
+
+	if _, err := boltConn.(stormcore.CheckedBoltEmitter).TryEmit(nil, "", "a"); err != stormcore.ErrReadTimeout {
+		t.Fatalf("Expected a read timeout, received: %v", err)
+	}
+	// The reply may still arrive, so the connection cannot be read from
+	var msg string
+	if err := boltConn.ReadBoltMsg(&messages.BoltMsgMeta{}, &msg); err != stormcore.ErrReadTimeout {
+		t.Fatalf("Expected a read timeout after the task ids timed out, received: %v", err)
+	}
+	expectPanic(t, func() { boltConn.Emit(nil, "", "a") })
+
+	// The read timeout of the input is returned in the same way
+	pipeReader, pipeWriter = io.Pipe()
+	defer pipeWriter.Close()
+	go pipeWriter.Write(conf)
+	reader := stormcore.NewTimeoutReader(pipeReader)
+	boltConn = newBoltConn(stormenc.NewJsonObjectInput(reader), output, true)
+	boltConn.Connect()
+	reader.SetReadTimeout(10 * time.Millisecond)
+	if _, err := boltConn.(stormcore.CheckedBoltEmitter).TryEmit(nil, "", "a"); err != stormcore.ErrReadTimeout {
+		t.Fatalf("Expected a read timeout of the input, received: %v", err)
+	}
+
+	checkPidFile(t)
+}
+
+func TestDefaultStream(t *testing.T) {
+	emit := func(stream string) string {
+		inBuffer := bytes.NewBuffer(nil)
+		feedConf(inBuffer, t)
+		outBuffer := bytes.NewBuffer(nil)
+		output := stormenc.NewJsonObjectOutput(outBuffer)
+		boltConn := newBoltConn(stormenc.NewJsonObjectInput(inBuffer), output, false)
+		boltConn.Connect()
+		expectPid(outBuffer, t)
+		boltConn.Emit([]string{"1"}, stream, "a")
+		boltConn.EmitDirect(nil, stream, 2, "b")
+		output.Flush()
+		return outBuffer.String()
+	}
+	// The default stream is sent in its canonical form, which leaves it out
+	expected := `{"anchors":["1"],"command":"emit","need_task_ids":false,"tuple":["a"]}` + "\nend\n" +
+		`{"command":"emit","need_task_ids":false,"task":2,"tuple":["b"]}` + "\nend\n"
+	if emitted, defaulted := emit(""), emit(stormcore.DefaultStream); emitted != expected || defaulted != expected {
+		t.Fatalf("Expected the default stream to be emitted as %q, received %q and %q", expected, emitted, defaulted)
+	}
+
+	checkPidFile(t)
+}
+
+func TestMalformedTaskIds(t *testing.T) {
+	inBuffer := bytes.NewBuffer(nil)
+	feedConf(inBuffer, t)
+	// An empty frame is not taken for task ids, but kept as a message
+	inBuffer.WriteString("\nend\n[1,\nend\n")
+	input := stormenc.NewJsonObjectInput(inBuffer)
+	output := stormenc.NewJsonObjectOutput(bytes.NewBuffer(nil))
+	boltConn := newBoltConn(input, output, true)
+	boltConn.Connect()
+
+	if _, err := boltConn.(stormcore.CheckedBoltEmitter).TryEmit(nil, "", "a"); err == nil {
+		t.Fatalf("Expected an error for malformed task ids")
+	}
+	var msg string
+	if err := boltConn.ReadBoltMsg(&messages.BoltMsgMeta{}, &msg); err == nil {
+		t.Fatalf("Expected an error for an empty message")
+	}
+
+	checkPidFile(t)
+}
+
+func TestAutoResync(t *testing.T) {
+	inBuffer := bytes.NewBuffer(nil)
+	feedConf(inBuffer, t)
+	writeMsg(testBoltMsg(0), inBuffer, t)
+	// A tuple that lost its end statement and a truncated tuple
+	inBuffer.WriteString(`{"id":"1","tuple":["lost"]}` + "\n" + `{"id":"2","tu` + "\nend\n")
+	writeMsg(testBoltMsg(1), inBuffer, t)
+	input := stormenc.NewJsonObjectInput(inBuffer)
+	output := stormenc.NewJsonObjectOutput(bytes.NewBuffer(nil))
+	boltConn := newBoltConn(input, output, false)
+	boltConn.Connect()
+
+	resyncer, ok := boltConn.(stormcore.Resyncer)
+	if !ok {
+		t.Fatalf("Bolt connection does not support resyncing")
+	}
+	resyncer.SetAutoResync(true)
+
+	logBuffer := bytes.NewBuffer(nil)
+	defaultLogger := stormcore.Logger()
+	stormcore.SetLogger(log.New(logBuffer, "", 0))
+	defer stormcore.SetLogger(defaultLogger)
+
+	var msg string
+	for i := 0; i < 2; i++ {
+		meta := &messages.BoltMsgMeta{}
+		checkErr(boltConn.ReadBoltMsg(meta, &msg), t)
+		msgCheck(msg, contents[i], t)
+		metaTest(meta, i, t)
+	}
+	if !strings.Contains(logBuffer.String(), "lost") {
+		t.Fatalf("Skipped tuple was not logged: %s", logBuffer.String())
+	}
+
+	checkPidFile(t)
+}
+
+func TestSync(t *testing.T) {
+	file, err := ioutil.TempFile("", "gostorm")
+	checkErr(err, t)
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	inBuffer := bytes.NewBuffer(nil)
+	feedConf(inBuffer, t)
+	input := stormenc.NewJsonObjectInput(inBuffer)
+	output := stormenc.NewJsonObjectOutput(file)
+	boltConn := newBoltConn(input, output, false)
+	boltConn.Connect()
+	boltConn.Emit(nil, "", "a")
+
+	syncer, ok := boltConn.(stormcore.Syncer)
+	if !ok {
+		t.Fatalf("Bolt connection does not support syncing")
+	}
+	checkErr(syncer.Sync(), t)
+	contents, err := ioutil.ReadFile(file.Name())
+	checkErr(err, t)
+	if !strings.Contains(string(contents), `"command":"emit"`) {
+		t.Fatalf("Emission was not written to the file: %s", contents)
+	}
+
+	// Writers that cannot be synced are only flushed
+	reader, writer, err := os.Pipe()
+	checkErr(err, t)
+	defer reader.Close()
+	defer writer.Close()
+	for _, w := range []io.Writer{bytes.NewBuffer(nil), writer} {
+		output := stormenc.NewJsonObjectOutput(w)
+		output.SendMsg("a")
+		checkErr(output.(stormcore.Syncer).Sync(), t)
+	}
+
+	checkPidFile(t)
+}
+
+func TestEmitDirectToComponent(t *testing.T) {
+	inBuffer := bytes.NewBufferString(`{"pidDir":"","context":{"task->component":{"1":"__acker","9":"count","2":"count","5":"count","3":"split"},"taskid":3},"conf":{}}` + "\nend\n")
+	outBuffer := bytes.NewBuffer(nil)
+	input := stormenc.NewJsonObjectInput(inBuffer)
+	output := stormenc.NewJsonObjectOutput(outBuffer)
+	boltConn := newBoltConn(input, output, false)
+
+	var collector gostorm.OutputCollector = boltConn
+	emitter, ok := collector.(gostorm.ComponentOutputCollector)
+	if !ok {
+		t.Fatalf("Bolt collector does not support emitting to components")
+	}
+	if _, err := emitter.EmitDirectToComponent(nil, "", "count", "a"); err == nil {
+		t.Fatalf("Expected an error for an uninitialised connection")
+	}
+	boltConn.Connect()
+	expectPid(outBuffer, t)
+
+	if tasks := boltConn.Context().ComponentTasks("count"); !reflect.DeepEqual(tasks, []int64{2, 5, 9}) {
+		t.Fatalf("Unexpected tasks for component count: %v", tasks)
+	}
+	// Tasks are chosen round robin in ascending order
+	for _, expected := range []int64{2, 5, 9, 2} {
+		task, err := emitter.EmitDirectToComponent([]string{"1"}, "direct", "count", "a")
+		checkErr(err, t)
+		if task != expected {
+			t.Fatalf("Emitted to task %d, expected task %d", task, expected)
+		}
+		output.Flush()
+		expect(fmt.Sprintf(`{"anchors":["1"],"command":"emit","need_task_ids":false,"stream":"direct","task":%d,"tuple":["a"]}`, expected), outBuffer, t)
+		expect("end", outBuffer, t)
+	}
+	if _, err := emitter.EmitDirectToComponent(nil, "", "unknown", "a"); err == nil {
+		t.Fatalf("Expected an error for an unknown component")
+	}
+	output.Flush()
+	if outBuffer.Len() != 0 {
+		t.Fatalf("Emission to an unknown component was sent: %s", outBuffer.String())
+	}
+
+	checkPidFile(t)
+}
+
+func TestRecordReplay(t *testing.T) {
+	buffer := bytes.NewBuffer(nil)
+	feedReadBoltMsg(buffer, t)
+
+	recording := bytes.NewBuffer(nil)
+	input := stormenc.NewJsonObjectInput(buffer)
+	output := stormenc.NewJsonObjectOutput(bytes.NewBuffer(nil))
+	boltConn := newBoltConn(input, output, false)
+	boltConn.SetRecordTo(recording)
+	boltConn.Connect()
+
+	var msg string
+	for i := 0; i < 6; i++ {
+		err := boltConn.ReadBoltMsg(&messages.BoltMsgMeta{}, &msg)
+		checkErr(err, t)
+	}
+	checkPidFile(t)
+
+	// Replaying the recording should produce the same tuples
+	input = stormenc.NewJsonObjectInput(recording)
+	boltConn = newBoltConn(input, output, false)
+	boltConn.Connect()
+
+	for i := 0; i < 6; i++ {
+		meta := &messages.BoltMsgMeta{}
+		err := boltConn.ReadBoltMsg(meta, &msg)
+		checkErr(err, t)
+		msgCheck(msg, contents[i], t)
+		metaTest(meta, i, t)
+	}
+	checkPidFile(t)
+}
+
+func TestBoltAsyncEmission(t *testing.T) {
+	inBuffer := bytes.NewBuffer(nil)
+	feedConf(inBuffer, t)
+	writeMsg(testBoltMsg(0), inBuffer, t)
+	writeMsg([]int32{1, 2}, inBuffer, t)
+	// A tuple may arrive before all task ids have been received
+	writeMsg(testBoltMsg(1), inBuffer, t)
+	writeMsg([]int32{3}, inBuffer, t)
+
+	outBuffer := bytes.NewBuffer(nil)
+	input := stormenc.NewJsonObjectInput(inBuffer)
+	output := stormenc.NewJsonObjectOutput(outBuffer)
+	boltConn := newBoltConn(input, output, false)
+	boltConn.Connect()
+
+	expectPid(outBuffer, t)
+
+	var msg string
+	meta := &messages.BoltMsgMeta{}
+	checkErr(boltConn.ReadBoltMsg(meta, &msg), t)
+	metaTest(meta, 0, t)
+
+	first := boltConn.EmitAsync([]string{meta.Id}, "", "Msg0")
+	second := boltConn.EmitAsync([]string{meta.Id}, "", "Msg1")
+	for i := 0; i < 2; i++ {
+		expect(fmt.Sprintf(`{"anchors":["%s"],"command":"emit","tuple":["Msg%d"]}`, meta.Id, i), outBuffer, t)
+		expect("end", outBuffer, t)
+	}
+
+	checkErr(boltConn.ReadBoltMsg(meta, &msg), t)
+	metaTest(meta, 1, t)
+	msgCheck(msg, contents[1], t)
+
+	if taskIds := <-first; len(taskIds) != 2 || taskIds[0] != 1 || taskIds[1] != 2 {
+		t.Fatalf("Unexpected task ids for first emission: %v", taskIds)
+	}
+	if taskIds := <-second; len(taskIds) != 1 || taskIds[0] != 3 {
+		t.Fatalf("Unexpected task ids for second emission: %v", taskIds)
+	}
+
+	checkPidFile(t)
+}
+
+type recordingWaitStrategy struct {
+	commands   []string
+	tuplesSent []bool
+}
+
+func (this *recordingWaitStrategy) Wait(command string, tuplesSent bool) time.Duration {
+	this.commands = append(this.commands, command)
+	this.tuplesSent = append(this.tuplesSent, tuplesSent)
+	return 0
+}
+
+func TestWaitStrategy(t *testing.T) {
+	inBuffer := bytes.NewBuffer(nil)
+	feedConf(inBuffer, t)
+	writeMsg(newSpoutMsg("next", ""), inBuffer, t)
+	writeMsg(newSpoutMsg("next", ""), inBuffer, t)
+	writeMsg(newSpoutMsg("ack", "1"), inBuffer, t)
+	input := stormenc.NewJsonObjectInput(inBuffer)
+	output := stormenc.NewJsonObjectOutput(bytes.NewBuffer(nil))
+	spoutConn := newSpoutConn(input, output, false)
+	spoutConn.Connect()
+
+	strategy := &recordingWaitStrategy{}
+	spoutConn.SetWaitStrategy(strategy)
+
+	for i := 0; i < 3; i++ {
+		_, _, err := spoutConn.ReadSpoutMsg()
+		checkErr(err, t)
+		if spoutConn.TuplesSentSinceNext() {
+			t.Fatalf("Tuples reported as sent before emitting")
+		}
+		if i == 1 {
+			spoutConn.Emit("1", "", "Msg")
+			if !spoutConn.TuplesSentSinceNext() {
+				t.Fatalf("Tuples not reported as sent after emitting")
+			}
+		}
+		spoutConn.SendSync()
+	}
+
+	expectedCommands := []string{"next", "next", "ack"}
+	expectedSent := []bool{false, true, false}
+	if len(strategy.commands) != len(expectedCommands) {
+		t.Fatalf("Wait strategy called %d times, expected %d", len(strategy.commands), len(expectedCommands))
+	}
+	for i := range expectedCommands {
+		if strategy.commands[i] != expectedCommands[i] || strategy.tuplesSent[i] != expectedSent[i] {
+			t.Fatalf("Wait strategy call %d received (%s, %v), expected (%s, %v)", i, strategy.commands[i], strategy.tuplesSent[i], expectedCommands[i], expectedSent[i])
+		}
+	}
+
+	checkPidFile(t)
+}
+
+func TestStats(t *testing.T) {
+	inBuffer := bytes.NewBuffer(nil)
+	feedConf(inBuffer, t)
+	for i := 0; i < 3; i++ {
+		writeMsg(testBoltMsg(i), inBuffer, t)
+	}
+	input := stormenc.NewJsonObjectInput(inBuffer)
+	output := stormenc.NewJsonObjectOutput(bytes.NewBuffer(nil))
+	boltConn := newBoltConn(input, output, false)
+	boltConn.Connect()
+
+	var msg string
+	meta := &messages.BoltMsgMeta{}
+	for i := 0; i < 3; i++ {
+		checkErr(boltConn.ReadBoltMsg(meta, &msg), t)
+		boltConn.Emit([]string{meta.Id}, "", msg)
+		boltConn.Emit([]string{meta.Id}, "other", msg)
+		if i == 0 {
+			boltConn.SendFail(meta.Id)
+		} else {
+			boltConn.SendAck(meta.Id)
+		}
+	}
+	boltConn.Emit(nil, "default", "Msg")
+
+	stats := boltConn.Stats()
+	if stats.Read != 3 || stats.Acked != 2 || stats.Failed != 1 {
+		t.Fatalf("Unexpected bolt stats: %+v", stats)
+	}
+	if len(stats.EmittedByStream) != 2 || stats.EmittedByStream["default"] != 4 || stats.EmittedByStream["other"] != 3 {
+		t.Fatalf("Unexpected bolt emission counts: %v", stats.EmittedByStream)
+	}
+
+	// Stats are a snapshot, which are not affected by later emissions
+	boltConn.Emit(nil, "", "Msg")
+	if stats.EmittedByStream["default"] != 4 {
+		t.Fatalf("Stats snapshot modified by later emission: %v", stats.EmittedByStream)
+	}
+
+	inBuffer = bytes.NewBuffer(nil)
+	feedConf(inBuffer, t)
+	writeMsg(newSpoutMsg("next", ""), inBuffer, t)
+	writeMsg(newSpoutMsg("ack", "1"), inBuffer, t)
+	writeMsg(newSpoutMsg("fail", "2"), inBuffer, t)
+	input = stormenc.NewJsonObjectInput(inBuffer)
+	spoutConn := newSpoutConn(input, output, false)
+	spoutConn.Connect()
+
+	for i := 0; i < 3; i++ {
+		_, _, err := spoutConn.ReadSpoutMsg()
+		checkErr(err, t)
+		if i == 0 {
+			spoutConn.Emit("1", "", "Msg")
+		}
+		spoutConn.SendSync()
+	}
+
+	stats = spoutConn.Stats()
+	if stats.Read != 3 || stats.Acked != 1 || stats.Failed != 1 || stats.EmittedByStream["default"] != 1 {
+		t.Fatalf("Unexpected spout stats: %+v", stats)
+	}
+
+	checkPidFile(t)
+}
+
+// TestStatsConcurrency reads the stats on another goroutine while a bolt
+// emits and acks tuples, which should be run with -race
+func TestStatsConcurrency(t *testing.T) {
+	inBuffer := bytes.NewBuffer(nil)
+	feedConf(inBuffer, t)
+	input := stormenc.NewJsonObjectInput(inBuffer)
+	output := stormenc.NewJsonObjectOutput(bytes.NewBuffer(nil))
+	boltConn := newBoltConn(input, output, false)
+	boltConn.Connect()
+
+	done := make(chan struct{})
+	polled := make(chan error)
+	go func() {
+		var last uint64
+		for {
+			stats := boltConn.Stats()
+			// Every tuple is emitted before it is acked, so a consistent
+			// snapshot never holds more acks than emissions, nor more
+			// than a single emission that has not been acked yet
+			emitted := stats.EmittedByStream["default"]
+			if stats.Acked > emitted || emitted > stats.Acked+1 || stats.Acked < last {
+				polled <- fmt.Errorf("Inconsistent stats: %d emitted, %d acked after %d", emitted, stats.Acked, last)
+				return
+			}
+			last = stats.Acked
+			select {
+			case <-done:
+				polled <- nil
+				return
+			default:
+			}
+		}
+	}()
+
+	for i := 0; i < 2000; i++ {
+		boltConn.Emit(nil, "", "Msg")
+		boltConn.SendAck(strconv.Itoa(i))
+	}
+	close(done)
+	checkErr(<-polled, t)
+
+	if stats := boltConn.Stats(); stats.Acked != 2000 || stats.EmittedByStream["default"] != 2000 {
+		t.Fatalf("Unexpected stats: %+v", stats)
+	}
+}
+
+func TestAckEmitOrdering(t *testing.T) {
+	inBuffer := bytes.NewBuffer(nil)
+	feedConf(inBuffer, t)
+	outBuffer := bytes.NewBuffer(nil)
+	input := stormenc.NewJsonObjectInput(inBuffer)
+	output := stormenc.NewJsonObjectOutput(outBuffer)
+	boltConn := newBoltConn(input, output, false)
+	boltConn.Connect()
+
+	expectPid(outBuffer, t)
+
+	// The ack is buffered, while the emission is flushed immediately.
+	// The emission should still be written after the ack.
+	boltConn.SendAck("1")
+	boltConn.Emit(nil, "", "Msg")
+	expect(`{"command":"ack","id":"1"}`, outBuffer, t)
+	expect("end", outBuffer, t)
+	expect(`{"command":"emit","need_task_ids":false,"tuple":["Msg"]}`, outBuffer, t)
+	expect("end", outBuffer, t)
+
+	checkPidFile(t)
+}
+
+func TestMarshalHooks(t *testing.T) {
+	timestamp := time.Date(2013, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	inBuffer := bytes.NewBuffer(nil)
+	feedConf(inBuffer, t)
+	writeMsg(genBoltMsg(ids[0], timestamp.Format(time.RFC3339)), inBuffer, t)
+	outBuffer := bytes.NewBuffer(nil)
+	input := stormenc.NewJsonObjectInput(inBuffer)
+	output := stormenc.NewJsonObjectOutput(outBuffer)
+	boltConn := newBoltConn(input, output, false)
+	boltConn.Connect()
+
+	expectPid(outBuffer, t)
+
+	boltConn.SetMarshalHook(func(content interface{}) interface{} {
+		if ts, ok := content.(time.Time); ok {
+			return ts.Format(time.RFC3339)
+		}
+		return content
+	})
+	boltConn.SetDecodeHook(func(contents []interface{}) error {
+		for _, content := range contents {
+			if field, ok := content.(*interface{}); ok {
+				if str, ok := (*field).(string); ok {
+					ts, err := time.Parse(time.RFC3339, str)
+					if err != nil {
+						return err
+					}
+					*field = ts
+				}
+			}
+		}
+		return nil
+	})
+
+	var field interface{}
+	meta := &messages.BoltMsgMeta{}
+	checkErr(boltConn.ReadBoltMsg(meta, &field), t)
+	if ts, ok := field.(time.Time); !ok || !ts.Equal(timestamp) {
+		t.Fatalf("Decode hook failed to convert field: %v", field)
+	}
+
+	boltConn.Emit(nil, "", timestamp, 1)
+	expect(`{"command":"emit","need_task_ids":false,"tuple":["2013-10-01T12:00:00Z",1]}`, outBuffer, t)
+	expect("end", outBuffer, t)
+
+	checkPidFile(t)
+}
+
+func TestMaxFieldSize(t *testing.T) {
+	inBuffer := bytes.NewBuffer(nil)
+	feedConf(inBuffer, t)
+	input := stormenc.NewJsonObjectInput(inBuffer)
+	output := stormenc.NewJsonObjectOutput(bytes.NewBuffer(nil))
+	boltConn := newBoltConn(input, output, false)
+	boltConn.Connect()
+
+	long := strings.Repeat("a", 10)
+	boltConn.Emit(nil, "", long, long)
+
+	boltConn.SetMaxFieldSize(10)
+	boltConn.Emit(nil, "", long, []byte(long))
+	expectPanic(t, func() { boltConn.Emit(nil, "", long+"a") })
+	// Values other than strings and byte slices are measured as JSON
+	expectPanic(t, func() { boltConn.Emit(nil, "", []string{long}) })
+
+	boltConn.SetMaxFieldSizeAt(1, 20)
+	boltConn.Emit(nil, "", long, long+long)
+	expectPanic(t, func() { boltConn.Emit(nil, "", long, long+long+"a") })
+
+	boltConn.SetMaxFieldSize(0)
+	boltConn.Emit(nil, "", long+long+long, long)
+	boltConn.SetMaxFieldSizeAt(1, 0)
+	boltConn.Emit(nil, "", long, long+long+long)
+
+	checkPidFile(t)
+}
+
+type testLocation struct {
+	Lat float64
+	Lon float64
+}
+
+type testEvent struct {
+	Name     string
+	Count    int
+	internal string
+	Skipped  string `storm:"-"`
+	Location testLocation
+}
+
+func TestEmitStruct(t *testing.T) {
+	inBuffer := bytes.NewBuffer(nil)
+	feedConf(inBuffer, t)
+	outBuffer := bytes.NewBuffer(nil)
+	input := stormenc.NewJsonObjectInput(inBuffer)
+	output := stormenc.NewJsonObjectOutput(outBuffer)
+	boltConn := newBoltConn(input, output, false)
+	boltConn.Connect()
+
+	expectPid(outBuffer, t)
+
+	event := &testEvent{
+		Name:     "event",
+		Count:    2,
+		internal: "internal",
+		Skipped:  "skipped",
+		Location: testLocation{Lat: 1.5, Lon: -2},
+	}
+	boltConn.EmitStruct(event, []string{"1"}, "")
+	expect(`{"anchors":["1"],"command":"emit","need_task_ids":false,"tuple":["event",2,{"Lat":1.5,"Lon":-2}]}`, outBuffer, t)
+	expect("end", outBuffer, t)
+
+	boltConn.EmitStruct(*event, nil, "")
+	expect(`{"command":"emit","need_task_ids":false,"tuple":["event",2,{"Lat":1.5,"Lon":-2}]}`, outBuffer, t)
+	expect("end", outBuffer, t)
+
+	expectPanic(t, func() { boltConn.EmitStruct("event", nil, "") })
+
+	checkPidFile(t)
+}
+
+func TestOnInitialised(t *testing.T) {
+	pidDir, err := ioutil.TempDir("", "gostorm")
+	checkErr(err, t)
+	defer os.RemoveAll(pidDir)
+
+	inBuffer := bytes.NewBuffer(nil)
+	handshake := strings.Replace(string(conf), `"pidDir":""`, fmt.Sprintf(`"pidDir":%q`, pidDir), 1)
+	inBuffer.WriteString(handshake)
+	outBuffer := bytes.NewBuffer(nil)
+	input := stormenc.NewJsonObjectInput(inBuffer)
+	output := stormenc.NewJsonObjectOutput(outBuffer)
+	boltConn := newBoltConn(input, output, false)
+
+	if boltConn.PidDir() != "" {
+		t.Fatalf("Pid directory known before connecting: %s", boltConn.PidDir())
+	}
+
+	calls := 0
+	boltConn.OnInitialised(func(context *messages.Context) {
+		calls++
+		// The pid file should already have been written
+		_, err := os.Stat(filepath.Join(context.PidDir, strconv.Itoa(os.Getpid())))
+		checkErr(err, t)
+	})
+	boltConn.Connect()
+
+	if calls != 1 {
+		t.Fatalf("Initialised handler called %d times, expected once", calls)
+	}
+	if boltConn.PidDir() != pidDir {
+		t.Fatalf("Unexpected pid directory: %s, expected: %s", boltConn.PidDir(), pidDir)
+	}
+	checkErr(boltConn.Close(), t)
+}
+
+func TestValidateAcks(t *testing.T) {
+	inBuffer := bytes.NewBuffer(nil)
+	feedConf(inBuffer, t)
+	for i := 0; i < 6; i++ {
+		writeMsg(testBoltMsg(i), inBuffer, t)
+	}
+	input := stormenc.NewJsonObjectInput(inBuffer)
+	outBuffer := bytes.NewBuffer(nil)
+	output := stormenc.NewJsonObjectOutput(outBuffer)
+	boltConn := newBoltConn(input, output, false)
+	var rejected []string
+	boltConn.SetHooks(stormcore.Hooks{
+		OnError: func(err error) {
+			rejected = append(rejected, err.Error())
+		},
+	})
+	boltConn.Connect()
+	expectPid(outBuffer, t)
+
+	// Without validation, any id can be acked
+	boltConn.SendAck("unknown")
+	output.Flush()
+	expect(`{"command":"ack","id":"unknown"}`, outBuffer, t)
+	expect("end", outBuffer, t)
+
+	boltConn.SetValidateAcks(2)
+	var msg string
+	meta := &messages.BoltMsgMeta{}
+	for i := 0; i < 3; i++ {
+		checkErr(boltConn.ReadBoltMsg(meta, &msg), t)
+	}
+
+	// Rejected acks and fails are not sent to Storm
+	boltConn.SendAck("unknown")
+	// The first id was evicted once the limit was reached, but can
+	// still be acked
+	boltConn.SendAck(ids[0])
+	boltConn.SendAck(ids[1])
+	boltConn.SendFail(ids[2])
+	boltConn.SendAck(ids[0])
+	boltConn.SendAck(ids[1])
+	boltConn.SendFail(ids[2])
+	output.Flush()
+	for _, exp := range []string{
+		fmt.Sprintf(`{"command":"ack","id":"%s"}`, ids[0]),
+		fmt.Sprintf(`{"command":"ack","id":"%s"}`, ids[1]),
+		fmt.Sprintf(`{"command":"fail","id":"%s"}`, ids[2]),
+	} {
+		expect(exp, outBuffer, t)
+		expect("end", outBuffer, t)
+	}
+	if outBuffer.Len() != 0 {
+		t.Fatalf("Rejected acks were sent: %s", outBuffer.String())
+	}
+	if len(rejected) != 4 || !strings.Contains(rejected[0], "ack for id unknown") {
+		t.Fatalf("Unexpected rejections: %v", rejected)
+	}
+
+	// Once more ids have been evicted than the limit, unknown ids can no
+	// longer be validated
+	boltConn.SetValidateAcks(1)
+	for i := 3; i < 6; i++ {
+		checkErr(boltConn.ReadBoltMsg(meta, &msg), t)
+	}
+	rejected = nil
+	boltConn.SendAck("unknown")
+	if len(rejected) != 0 {
+		t.Fatalf("Expected validation to be skipped: %v", rejected)
+	}
+
+	// Empty ids are always rejected
+	boltConn.SetValidateAcks(0)
+	boltConn.SendFail("")
+	output.Flush()
+	expect(`{"command":"ack","id":"unknown"}`, outBuffer, t)
+	expect("end", outBuffer, t)
+	if outBuffer.Len() != 0 {
+		t.Fatalf("Fail with an empty id was sent: %s", outBuffer.String())
+	}
+	if len(rejected) != 1 || !strings.Contains(rejected[0], "empty id") {
+		t.Fatalf("Unexpected rejections: %v", rejected)
+	}
+
+	// Heartbeats are answered with a sync instead of an ack, so their ids
+	// are not tracked
+	boltConn.SetValidateAcks(2)
+	writeMsg(newJsonBoltMsg("-1", "", stormcore.HeartbeatStream, 0), inBuffer, t)
+	checkErr(boltConn.ReadBoltMsg(meta, &msg), t)
+	rejected = nil
+	boltConn.SendAck("-1")
+	if len(rejected) != 1 || !strings.Contains(rejected[0], "ack for id -1") {
+		t.Fatalf("Unexpected rejections: %v", rejected)
+	}
+
+	checkPidFile(t)
+}
+
+func TestNormalizeId(t *testing.T) {
+	for id, normalized := range map[string]string{
+		"-6955786537413359385": "-6955786537413359385",
+		`"42"`:                 "42",
+		" 42 ":                 "42",
+		"4.2e1":                "42",
+		"42.0":                 "42",
+		"4.5":                  "4.5",
+		`"spout-1"`:            "spout-1",
+		"spout-1":              "spout-1",
+		"":                     "",
+	} {
+		if result := stormcore.NormalizeId(id); result != normalized {
+			t.Errorf("Normalized %q to %q, expected %q", id, result, normalized)
+		}
+	}
+	tuple := &stormcore.Tuple{Meta: messages.BoltMsgMeta{Id: `"7"`}}
+	if tuple.NormalizedId() != "7" || tuple.Meta.Id != `"7"` {
+		t.Errorf("Unexpected normalized id %q for id %q", tuple.NormalizedId(), tuple.Meta.Id)
+	}
+}
+
+func TestAnchorSet(t *testing.T) {
+	inBuffer := bytes.NewBuffer(nil)
+	feedConf(inBuffer, t)
+	for i := 0; i < 3; i++ {
+		writeMsg(testBoltMsg(i), inBuffer, t)
+	}
+	outBuffer := bytes.NewBuffer(nil)
+	input := stormenc.NewJsonObjectInput(inBuffer)
+	output := stormenc.NewJsonObjectOutput(outBuffer)
+	boltConn := newBoltConn(input, output, false)
+	boltConn.Connect()
+
+	expectPid(outBuffer, t)
+
+	anchors := &stormcore.AnchorSet{}
+	for i := 0; i < 3; i++ {
+		var msg string
+		tuple := &stormcore.Tuple{Fields: []interface{}{&msg}}
+		checkErr(boltConn.ReadBoltMsg(&tuple.Meta, tuple.Fields...), t)
+		anchors.Add(tuple)
+		anchors.Add(tuple)
+	}
+	anchors.AddId(ids[0])
+	if anchors.Len() != 3 {
+		t.Fatalf("Anchor set contains %d ids, expected 3: %v", anchors.Len(), anchors.Ids())
+	}
+
+	boltConn.Emit(anchors.Ids(), "", "Msg")
+	expect(fmt.Sprintf(`{"anchors":["%s","%s","%s"],"command":"emit","need_task_ids":false,"tuple":["Msg"]}`, ids[0], ids[1], ids[2]), outBuffer, t)
+	expect("end", outBuffer, t)
+
+	anchors.Reset()
+	if anchors.Len() != 0 || anchors.Ids() != nil {
+		t.Fatalf("Anchor set not empty after reset: %v", anchors.Ids())
+	}
+
+	checkPidFile(t)
+}
+
+func TestAnchorWindow(t *testing.T) {
+	if _, err := stormcore.NewAnchorWindow(0); err == nil {
+		t.Fatalf("Expected an error for an empty anchor window")
+	}
+	window, err := stormcore.NewAnchorWindow(2)
+	checkErr(err, t)
+	if _, ok := window.AddId("1"); ok {
+		t.Fatalf("Evicted an id from a window that was not full")
+	}
+	window.AddId("2")
+	if evicted, ok := window.AddId("3"); !ok || evicted != "1" {
+		t.Fatalf("Evicted %q, expected 1", evicted)
+	}
+	if ids := window.Ids(); !reflect.DeepEqual(ids, []string{"2", "3"}) {
+		t.Fatalf("Unexpected window: %v", ids)
+	}
+
+	// Growing keeps all ids and shrinking evicts the oldest ones
+	evicted, err := window.SetSize(3)
+	checkErr(err, t)
+	window.AddId("4")
+	if len(evicted) != 0 || !reflect.DeepEqual(window.Ids(), []string{"2", "3", "4"}) {
+		t.Fatalf("Unexpected window after growing: %v, evicted %v", window.Ids(), evicted)
+	}
+	evicted, err = window.SetSize(1)
+	checkErr(err, t)
+	if !reflect.DeepEqual(evicted, []string{"2", "3"}) || !reflect.DeepEqual(window.Ids(), []string{"4"}) {
+		t.Fatalf("Unexpected window after shrinking: %v, evicted %v", window.Ids(), evicted)
+	}
+	if _, err := window.SetSize(-1); err == nil || window.Size() != 1 {
+		t.Fatalf("Expected an error for a negative size")
+	}
+	window.Reset()
+	if window.Len() != 0 || window.Size() != 1 {
+		t.Fatalf("Unexpected window after reset: %v", window.Ids())
+	}
+
+	inBuffer := bytes.NewBuffer(nil)
+	feedConf(inBuffer, t)
+	for i := 0; i < 3; i++ {
+		writeMsg(testBoltMsg(i), inBuffer, t)
+	}
+	outBuffer := bytes.NewBuffer(nil)
+	input := stormenc.NewJsonObjectInput(inBuffer)
+	output := stormenc.NewJsonObjectOutput(outBuffer)
+	boltConn := newBoltConn(input, output, false)
+	boltConn.Connect()
+	expectPid(outBuffer, t)
+
+	emitter, err := gostorm.NewWindowEmitter(boltConn, 2)
+	checkErr(err, t)
+	emitter.EmitAnchoredToWindow("", "empty")
+	expect(`{"command":"emit","need_task_ids":false,"tuple":["empty"]}`, outBuffer, t)
+	expect("end", outBuffer, t)
+	for i := 0; i < 3; i++ {
+		var msg string
+		tuple := &stormcore.Tuple{Fields: []interface{}{&msg}}
+		checkErr(boltConn.ReadBoltMsg(&tuple.Meta, tuple.Fields...), t)
+		if evicted, ok := emitter.Add(tuple); ok {
+			boltConn.SendAck(evicted)
+		}
+		emitter.EmitAnchoredToWindow("", "Msg")
+	}
+	for _, line := range []string{
+		fmt.Sprintf(`{"anchors":["%s"],"command":"emit","need_task_ids":false,"tuple":["Msg"]}`, ids[0]),
+		fmt.Sprintf(`{"anchors":["%s","%s"],"command":"emit","need_task_ids":false,"tuple":["Msg"]}`, ids[0], ids[1]),
+		fmt.Sprintf(`{"command":"ack","id":"%s"}`, ids[0]),
+		fmt.Sprintf(`{"anchors":["%s","%s"],"command":"emit","need_task_ids":false,"tuple":["Msg"]}`, ids[1], ids[2]),
+	} {
+		expect(line, outBuffer, t)
+		expect("end", outBuffer, t)
+	}
+
+	checkPidFile(t)
+}
+
+func TestAutoAnchor(t *testing.T) {
+	inBuffer := bytes.NewBuffer(nil)
+	feedConf(inBuffer, t)
+	writeMsg(testBoltMsg(0), inBuffer, t)
+	writeMsg(newJsonBoltMsg("-1", "", stormcore.HeartbeatStream, 0), inBuffer, t)
+	writeMsg(testBoltMsg(1), inBuffer, t)
+	outBuffer := bytes.NewBuffer(nil)
+	input := stormenc.NewJsonObjectInput(inBuffer)
+	output := stormenc.NewJsonObjectOutput(outBuffer)
+	boltConn := newBoltConn(input, output, false)
+	boltConn.(stormcore.AutoAnchorer).SetAutoAnchor(true)
+	boltConn.Connect()
+	expectPid(outBuffer, t)
+
+	expectEmit := func(anchors string) {
+		output.Flush()
+		expect(fmt.Sprintf(`{%s"command":"emit","need_task_ids":false,"tuple":["Msg"]}`, anchors), outBuffer, t)
+		expect("end", outBuffer, t)
+	}
+	anchoredTo := func(id string) string {
+		return fmt.Sprintf(`"anchors":["%s"],`, id)
+	}
+
+	// Without a current tuple, emissions are unanchored
+	boltConn.Emit(nil, "", "Msg")
+	expectEmit("")
+
+	var msg string
+	meta := &messages.BoltMsgMeta{}
+	checkErr(boltConn.ReadBoltMsg(meta, &msg), t)
+	boltConn.Emit(nil, "", "Msg")
+	expectEmit(anchoredTo(ids[0]))
+	boltConn.EmitDirect(nil, "", 0, "Msg")
+	expectEmit(anchoredTo(ids[0]))
+	// Explicit anchors are sent unchanged
+	boltConn.Emit([]string{ids[2]}, "", "Msg")
+	expectEmit(anchoredTo(ids[2]))
+	boltConn.Emit([]string{}, "", "Msg")
+	expectEmit("")
+
+	// Heartbeats do not change the current tuple
+	checkErr(boltConn.ReadBoltMsg(meta, &msg), t)
+	boltConn.Emit(nil, "", "Msg")
+	expectEmit(anchoredTo(ids[0]))
+
+	// Acking the current tuple ends auto anchoring to it
+	boltConn.SendAck(ids[0])
+	boltConn.Emit(nil, "", "Msg")
+	output.Flush()
+	expect(fmt.Sprintf(`{"command":"ack","id":"%s"}`, ids[0]), outBuffer, t)
+	expect("end", outBuffer, t)
+	expectEmit("")
+
+	checkErr(boltConn.ReadBoltMsg(meta, &msg), t)
+	boltConn.SendFail(ids[1])
+	boltConn.Emit(nil, "", "Msg")
+	output.Flush()
+	expect(fmt.Sprintf(`{"command":"fail","id":"%s"}`, ids[1]), outBuffer, t)
+	expect("end", outBuffer, t)
+	expectEmit("")
+
+	checkPidFile(t)
+}
+
+func TestEmit1(t *testing.T) {
+	inBuffer := bytes.NewBuffer(nil)
+	feedConf(inBuffer, t)
+	writeMsg(testBoltMsg(0), inBuffer, t)
+	outBuffer := bytes.NewBuffer(nil)
+	input := stormenc.NewJsonObjectInput(inBuffer)
+	output := stormenc.NewJsonObjectOutput(outBuffer)
+	// Emit1 anchors to the current tuple without auto anchoring
+	boltConn := newBoltConn(input, output, false)
+	boltConn.Connect()
+	expectPid(outBuffer, t)
+
+	var collector gostorm.OutputCollector = boltConn
+	emitter := collector.(gostorm.DefaultStreamOutputCollector)
+	emitter.Emit1("a", 1)
+	expect(`{"command":"emit","need_task_ids":false,"tuple":["a",1]}`, outBuffer, t)
+	expect("end", outBuffer, t)
+
+	var msg string
+	checkErr(boltConn.ReadBoltMsg(&messages.BoltMsgMeta{}, &msg), t)
+	emitter.Emit1("b", 2)
+	expect(fmt.Sprintf(`{"anchors":["%s"],"command":"emit","need_task_ids":false,"tuple":["b",2]}`, ids[0]), outBuffer, t)
+	expect("end", outBuffer, t)
+	// Emissions with nil anchors are still unanchored
+	boltConn.Emit(nil, "", "c")
+	expect(`{"command":"emit","need_task_ids":false,"tuple":["c"]}`, outBuffer, t)
+	expect("end", outBuffer, t)
+
+	inBuffer = bytes.NewBuffer(nil)
+	feedConf(inBuffer, t)
+	writeMsg(newSpoutMsg("next", ""), inBuffer, t)
+	outBuffer = bytes.NewBuffer(nil)
+	spoutConn := newSpoutConn(stormenc.NewJsonObjectInput(inBuffer), stormenc.NewJsonObjectOutput(outBuffer), false)
+	spoutConn.Connect()
+	expectPid(outBuffer, t)
+	_, _, err := spoutConn.ReadSpoutMsg()
+	checkErr(err, t)
+	var spoutCollector gostorm.SpoutOutputCollector = spoutConn
+	spoutCollector.(gostorm.DefaultStreamSpoutOutputCollector).Emit1("1", "a")
+	expect(`{"command":"emit","id":"1","need_task_ids":false,"tuple":["a"]}`, outBuffer, t)
+	expect("end", outBuffer, t)
+
+	checkPidFile(t)
+}
+
+func TestHandleSignals(t *testing.T) {
+	pipeReader, pipeWriter := io.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	input := stormenc.NewJsonObjectInput(stormcore.HandleSignals(ctx, pipeReader))
+
+	go writeMsg(contents[0], pipeWriter, t)
+	var msg string
+	checkErr(input.ReadMsg(&msg), t)
+	msgCheck(msg, contents[0], t)
+
+	// Cancelling the context should unblock a pending read
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if err := input.ReadMsg(&msg); err != io.EOF {
+		t.Fatalf("Expected EOF, received: %v", err)
+	}
+	if err := input.ReadMsg(&msg); err != io.EOF {
+		t.Fatalf("Expected EOF, received: %v", err)
+	}
+	pipeWriter.Close()
+
+	// A message that is cut off by the signal ends the input cleanly
+	pipeReader, pipeWriter = io.Pipe()
+	ctx, cancel = context.WithCancel(context.Background())
+	outBuffer := bytes.NewBuffer(nil)
+	boltConn := stormcore.LookupBoltConn("jsonObject", stormcore.HandleSignals(ctx, pipeReader), outBuffer)
+	go feedConf(pipeWriter, t)
+	boltConn.Connect()
+	go pipeWriter.Write([]byte(`{"id":"partial",`))
+	time.AfterFunc(10*time.Millisecond, cancel)
+	meta := &messages.BoltMsgMeta{}
+	if err := boltConn.ReadBoltMsg(meta, &msg); err != io.EOF {
+		t.Fatalf("Expected EOF, received: %v", err)
+	}
+	boltConn.(io.Closer).Close()
+	pipeWriter.Close()
+}
+
+type tickBolt struct {
+	executed []string
+	ticks    []string
+}
+
+func (this *tickBolt) Fields() []interface{} {
+	var msg string
+	return []interface{}{&msg}
+}
+
+func (this *tickBolt) Prepare(context *messages.Context, collector gostorm.OutputCollector) {}
+
+func (this *tickBolt) Execute(meta messages.BoltMsgMeta, fields ...interface{}) {
+	this.executed = append(this.executed, meta.Id)
+}
+
+func (this *tickBolt) Tick(meta messages.BoltMsgMeta) {
+	this.ticks = append(this.ticks, meta.Id)
+}
+
+func (this *tickBolt) Cleanup() {}
+
+func TestTickTuples(t *testing.T) {
+	tick := newJsonBoltMsg("tick", stormcore.SystemComponent, stormcore.TickStream, -1)
+	tick.BoltMsgJson.Contents = append(tick.BoltMsgJson.Contents, "30")
+	tuple := &stormcore.Tuple{Meta: *tick.BoltMsgJson.BoltMsgMeta}
+	if !tuple.IsTick() {
+		t.Fatalf("Tick tuple not detected: %+v", tuple.Meta)
+	}
+	tuple.Meta.Stream = "default"
+	if tuple.IsTick() {
+		t.Fatalf("Tuple on the default stream detected as tick: %+v", tuple.Meta)
+	}
+
+	inBuffer := bytes.NewBuffer(nil)
+	feedConf(inBuffer, t)
+	writeMsg(testBoltMsg(0), inBuffer, t)
+	writeMsg(tick, inBuffer, t)
+	writeMsg(testBoltMsg(1), inBuffer, t)
+	outBuffer := bytes.NewBuffer(nil)
+	input := stormenc.NewJsonObjectInput(inBuffer)
+	output := stormenc.NewJsonObjectOutput(outBuffer)
+	boltConn := newBoltConn(input, output, false)
+
+	bolt := &tickBolt{}
+	shellBolt := gostorm.NewShellBolt(bolt)
+	shellBolt.Initialise(boltConn)
+	shellBolt.Go()
+	boltConn.Close()
+
+	if len(bolt.executed) != 2 || bolt.executed[0] != ids[0] || bolt.executed[1] != ids[1] {
+		t.Fatalf("Unexpected executed tuples: %v", bolt.executed)
+	}
+	if len(bolt.ticks) != 1 || bolt.ticks[0] != "tick" {
+		t.Fatalf("Unexpected tick tuples: %v", bolt.ticks)
+	}
+
+	expectPid(outBuffer, t)
+	expect(`{"command":"ack","id":"tick"}`, outBuffer, t)
+	expect("end", outBuffer, t)
+}
+
+func TestLogger(t *testing.T) {
+	logBuffer := bytes.NewBuffer(nil)
+	defaultLogger := stormcore.Logger()
+	stormcore.SetLogger(log.New(logBuffer, "", 0))
+	defer stormcore.SetLogger(defaultLogger)
+
+	inBuffer := bytes.NewBufferString("{\"invalid\nend\n")
+	input := stormenc.NewJsonObjectInput(inBuffer)
+	var msg string
+	if err := input.ReadMsg(&msg); err == nil {
+		t.Fatal("Expected an error when reading invalid JSON")
+	}
+	if !strings.Contains(logBuffer.String(), `Unmarshalling: {"invalid`) {
+		t.Fatalf("Unexpected log output: %q", logBuffer.String())
+	}
+}
+
+type countFlusher struct {
+	batches int
+}
+
+func (this *countFlusher) Fields() []interface{} {
+	var msg string
+	return []interface{}{&msg}
+}
+
+func (this *countFlusher) Flush(batch []*stormcore.Tuple, emitter gostorm.BatchEmitter) error {
+	this.batches++
+	emitter.Emit("", len(batch))
+	if this.batches == 2 {
+		return errors.New("flush failed")
+	}
+	return nil
+}
+
+func TestBatchingBolt(t *testing.T) {
+	tick := newJsonBoltMsg("tick", stormcore.SystemComponent, stormcore.TickStream, -1)
+	tick.BoltMsgJson.Contents = append(tick.BoltMsgJson.Contents, "30")
+
+	inBuffer := bytes.NewBuffer(nil)
+	feedConf(inBuffer, t)
+	writeMsg(testBoltMsg(0), inBuffer, t)
+	writeMsg(testBoltMsg(1), inBuffer, t)
+	writeMsg(testBoltMsg(2), inBuffer, t)
+	writeMsg(tick, inBuffer, t)
+	writeMsg(testBoltMsg(3), inBuffer, t)
+	outBuffer := bytes.NewBuffer(nil)
+	input := stormenc.NewJsonObjectInput(inBuffer)
+	output := stormenc.NewJsonObjectOutput(outBuffer)
+	boltConn := newBoltConn(input, output, false)
+
+	shellBolt := gostorm.NewShellBolt(gostorm.NewBatchingBolt(&countFlusher{}, 2))
+	shellBolt.Initialise(boltConn)
+	shellBolt.Go()
+	boltConn.Close()
+
+	expectPid(outBuffer, t)
+
+	// The first batch is flushed when it reaches its size
+	expect(fmt.Sprintf(`{"anchors":["%s","%s"],"command":"emit","need_task_ids":false,"tuple":[2]}`, ids[0], ids[1]), outBuffer, t)
+	expect("end", outBuffer, t)
+	for i := 0; i < 2; i++ {
+		expect(fmt.Sprintf(`{"command":"ack","id":"%s"}`, ids[i]), outBuffer, t)
+		expect("end", outBuffer, t)
+	}
+
+	// The second batch is flushed on the tick tuple and fails
+	expect(fmt.Sprintf(`{"anchors":["%s"],"command":"emit","need_task_ids":false,"tuple":[1]}`, ids[2]), outBuffer, t)
+	expect("end", outBuffer, t)
+	expect(fmt.Sprintf(`{"command":"fail","id":"%s"}`, ids[2]), outBuffer, t)
+	expect("end", outBuffer, t)
+	expect(`{"command":"log","msg":"Failed batch of 1 tuples: flush failed"}`, outBuffer, t)
+	expect("end", outBuffer, t)
+	expect(`{"command":"ack","id":"tick"}`, outBuffer, t)
+	expect("end", outBuffer, t)
+
+	// The last batch is dropped when the bolt is cleaned up, since the
+	// stream has been closed
+	if outBuffer.Len() != 0 {
+		t.Fatalf("Pending batch was flushed after the stream was closed: %s", outBuffer.String())
+	}
+}
+
+func TestEmitRaw(t *testing.T) {
+	inBuffer := bytes.NewBuffer(nil)
+	feedConf(inBuffer, t)
+	inBuffer.WriteString(`{"id":"1","comp":"spout","stream":"default","task":4,"tuple":[1.10,{"b":1,"a":2}]}` + "\nend\n")
+	outBuffer := bytes.NewBuffer(nil)
+	input := stormenc.NewJsonObjectInput(inBuffer)
+	output := stormenc.NewJsonObjectOutput(outBuffer)
+	boltConn := newBoltConn(input, output, false)
+	boltConn.Connect()
+
+	expectPid(outBuffer, t)
+
+	// Fields decoded into raw messages keep their exact encoding
+	var number, object json.RawMessage
+	meta := &messages.BoltMsgMeta{}
+	checkErr(boltConn.ReadBoltMsg(meta, &number, &object), t)
+	if string(number) != "1.10" || string(object) != `{"b":1,"a":2}` {
+		t.Fatalf("Unexpected raw fields: %s, %s", number, object)
+	}
+	boltConn.Emit([]string{meta.Id}, "", number, object)
+	expect(`{"anchors":["1"],"command":"emit","need_task_ids":false,"tuple":[1.10,{"b":1,"a":2}]}`, outBuffer, t)
+	expect("end", outBuffer, t)
+
+	boltConn.EmitRaw(json.RawMessage(`[1.10, {"b":1,"a":2}]`), []string{meta.Id}, "")
+	expect(`{"anchors":["1"],"command":"emit","need_task_ids":false,"tuple":[1.10,{"b":1,"a":2}]}`, outBuffer, t)
+	expect("end", outBuffer, t)
+
+	expectPanic(t, func() { boltConn.EmitRaw(json.RawMessage(`{"a":1}`), nil, "") })
+
+	checkPidFile(t)
+}
+
+func TestTrackLatency(t *testing.T) {
+	inBuffer := bytes.NewBuffer(nil)
+	feedConf(inBuffer, t)
+	for i := 0; i < 3; i++ {
+		writeMsg(testBoltMsg(i), inBuffer, t)
+	}
+	input := stormenc.NewJsonObjectInput(inBuffer)
+	output := stormenc.NewJsonObjectOutput(bytes.NewBuffer(nil))
+	boltConn := newBoltConn(input, output, false)
+	boltConn.Connect()
+	boltConn.SetTrackLatency(true)
+
+	var msg string
+	meta := &messages.BoltMsgMeta{}
+	checkErr(boltConn.ReadBoltMsg(meta, &msg), t)
+	boltConn.SendAck(meta.Id)
+
+	checkErr(boltConn.ReadBoltMsg(meta, &msg), t)
+	time.Sleep(20 * time.Millisecond)
+	boltConn.SendAck(meta.Id)
+
+	// Failed tuples are not counted
+	checkErr(boltConn.ReadBoltMsg(meta, &msg), t)
+	boltConn.SendFail(meta.Id)
+
+	var total, slow uint64
+	for _, bucket := range boltConn.Stats().AckLatency {
+		total += bucket.Count
+		if bucket.Le > 10*time.Millisecond {
+			slow += bucket.Count
+		}
+	}
+	if total != 2 || slow != 1 {
+		t.Fatalf("Unexpected latency histogram: %+v", boltConn.Stats().AckLatency)
+	}
+
+	checkPidFile(t)
+}
+
+func TestInjectPid(t *testing.T) {
+	pidDir, err := ioutil.TempDir("", "gostorm")
+	checkErr(err, t)
+	defer os.RemoveAll(pidDir)
+
+	inBuffer := bytes.NewBuffer(nil)
+	feedConf(inBuffer, t)
+	outBuffer := bytes.NewBuffer(nil)
+	input := stormenc.NewJsonObjectInput(inBuffer)
+	output := stormenc.NewJsonObjectOutput(outBuffer)
+	boltConn := newBoltConn(input, output, false)
+	boltConn.SetPid(12345)
+	boltConn.SetPidDir(pidDir)
+	boltConn.Connect()
+
+	expect(`{"pid":12345}`, outBuffer, t)
+	expect("end", outBuffer, t)
+	contents, err := ioutil.ReadFile(filepath.Join(pidDir, "12345"))
+	checkErr(err, t)
+	if len(contents) != 0 {
+		t.Fatalf("Expected an empty pid file, received: %q", contents)
+	}
+
+	checkErr(boltConn.Close(), t)
+	if _, err = os.Stat(filepath.Join(pidDir, "12345")); !os.IsNotExist(err) {
+		t.Fatalf("Expected the pid file to be removed, received: %v", err)
+	}
+}
+
+func TestMaxMessageSize(t *testing.T) {
+	inBuffer := bytes.NewBuffer(nil)
+	feedConf(inBuffer, t)
+	writeMsg(genBoltMsg(ids[0], "short"), inBuffer, t)
+	writeMsg(genBoltMsg(ids[1], strings.Repeat("a", 1000)), inBuffer, t)
+	input := stormenc.NewJsonObjectInput(inBuffer)
+	output := stormenc.NewJsonObjectOutput(bytes.NewBuffer(nil))
+	boltConn := newBoltConn(input, output, false)
+	boltConn.Connect()
+	boltConn.SetMaxMessageSize(200)
+
+	var msg string
+	meta := &messages.BoltMsgMeta{}
+	checkErr(boltConn.ReadBoltMsg(meta, &msg), t)
+	msgCheck(msg, "short", t)
+	if err := boltConn.ReadBoltMsg(meta, &msg); err != stormcore.ErrMessageTooLarge {
+		t.Fatalf("Expected message too large, received: %v", err)
+	}
+
+	checkPidFile(t)
+}
+
+func expectEmptyTuples(name string, count int, outBuffer *bytes.Buffer, t *testing.T) {
+	expectPid(outBuffer, t)
+	for i := 0; i < count; i++ {
+		line, err := outBuffer.ReadString('\n')
+		checkErr(err, t)
+		if strings.Contains(line, `"tuple":null`) || !strings.Contains(line, `"tuple":[]`) {
+			t.Fatalf("%s: Expected an empty tuple, received: %s", name, line)
+		}
+		expect("end", outBuffer, t)
+	}
+}
+
+func TestEmitEmptyTuple(t *testing.T) {
+	outputs := map[string]func(io.Writer) stormcore.Output{
+		"jsonObject":  stormenc.NewJsonObjectOutput,
+		"jsonEncoded": stormenc.NewJsonEncodedOutput,
+	}
+	for name, newOutput := range outputs {
+		var contents []interface{}
+
+		inBuffer := bytes.NewBuffer(nil)
+		feedConf(inBuffer, t)
+		outBuffer := bytes.NewBuffer(nil)
+		boltConn := newBoltConn(stormenc.NewJsonObjectInput(inBuffer), newOutput(outBuffer), false)
+		boltConn.Connect()
+		boltConn.Emit(nil, "", contents...)
+		boltConn.EmitDirect(nil, "", 2, contents...)
+		boltConn.Emit(nil, "")
+		checkErr(boltConn.Close(), t)
+		expectEmptyTuples(name, 3, outBuffer, t)
+
+		inBuffer = bytes.NewBuffer(nil)
+		feedConf(inBuffer, t)
+		writeMsg(newSpoutMsg("next", ""), inBuffer, t)
+		spoutConn := newSpoutConn(stormenc.NewJsonObjectInput(inBuffer), newOutput(outBuffer), false)
+		spoutConn.Connect()
+		_, _, err := spoutConn.ReadSpoutMsg()
+		checkErr(err, t)
+		spoutConn.Emit("1", "", contents...)
+		spoutConn.EmitDirect("1", "", 2, contents...)
+		spoutConn.(stormcore.UnreliableEmitter).EmitUnreliable("")
+		checkErr(spoutConn.Close(), t)
+		expectEmptyTuples(name, 3, outBuffer, t)
+	}
+}
+
+func TestInitialised(t *testing.T) {
+	inBuffer := bytes.NewBuffer(nil)
+	feedConf(inBuffer, t)
+	writeMsg(testBoltMsg(0), inBuffer, t)
+	input := stormenc.NewJsonObjectInput(inBuffer)
+	output := stormenc.NewJsonObjectOutput(bytes.NewBuffer(nil))
+	boltConn := newBoltConn(input, output, false)
+	spoutConn := newSpoutConn(input, output, false)
+
+	for _, conn := range []interface{}{boltConn, spoutConn} {
+		if conn.(stormcore.InitialisedChecker).Initialised() {
+			t.Fatalf("Connection %T is initialised before Connect", conn)
+		}
+	}
+	var msg string
+	if err := boltConn.ReadBoltMsg(&messages.BoltMsgMeta{}, &msg); err != stormcore.ErrUninitialised {
+		t.Fatalf("Expected ErrUninitialised from an uninitialised bolt, got %v", err)
+	}
+	if _, _, err := spoutConn.ReadSpoutMsg(); err != stormcore.ErrUninitialised {
+		t.Fatalf("Expected ErrUninitialised from an uninitialised spout, got %v", err)
+	}
+
+	// The handshake was not consumed by the failed reads
+	boltConn.Connect()
+	if !boltConn.(stormcore.InitialisedChecker).Initialised() {
+		t.Fatalf("Bolt connection is not initialised after Connect")
+	}
+	meta := &messages.BoltMsgMeta{}
+	checkErr(boltConn.ReadBoltMsg(meta, &msg), t)
+	metaTest(meta, 0, t)
+
+	checkPidFile(t)
+}
+
+func TestSpoutCommands(t *testing.T) {
+	inBuffer := bytes.NewBuffer(nil)
+	feedConf(inBuffer, t)
+	writeMsg(newSpoutMsg("next", ""), inBuffer, t)
+	writeMsg(newSpoutMsg("ack", "1"), inBuffer, t)
+	writeMsg(newSpoutMsg("fail", "2"), inBuffer, t)
+	input := stormenc.NewJsonObjectInput(inBuffer)
+	output := stormenc.NewJsonObjectOutput(bytes.NewBuffer(nil))
+	spoutConn := newSpoutConn(input, output, false)
+	spoutConn.Connect()
+
+	expected := []struct{ command, id string }{
+		{stormcore.CommandNext, ""},
+		{stormcore.CommandAck, "1"},
+		{stormcore.CommandFail, "2"},
+	}
+	for _, exp := range expected {
+		command, id, err := spoutConn.ReadSpoutMsg()
+		checkErr(err, t)
+		if command != exp.command || id != exp.id {
+			t.Fatalf("Received command %s with id %q, expected %s with id %q", command, id, exp.command, exp.id)
+		}
+		spoutConn.SendSync()
+	}
+
+	checkPidFile(t)
+}
+
+// expectSpoutState checks the panic value of an emit made in the
+// given state
+func expectSpoutState(t *testing.T, state stormcore.SpoutState, f func()) {
+	defer func() {
+		err, ok := recover().(*stormcore.SpoutStateError)
+		if !ok {
+			t.Fatalf("Expected a panic with a SpoutStateError")
+		}
+		if err.State != state || err.Expected != stormcore.SpoutHandlingCommand {
+			t.Fatalf("Unexpected spout state error: %v", err)
+		}
+		if !strings.Contains(err.Error(), state.String()) {
+			t.Fatalf("Spout state error does not mention the state: %v", err)
+		}
+	}()
+	f()
+}
+
+func TestSpoutState(t *testing.T) {
+	inBuffer := bytes.NewBuffer(nil)
+	feedConf(inBuffer, t)
+	writeMsg(newSpoutMsg("next", ""), inBuffer, t)
+	writeMsg(newSpoutMsg("next", ""), inBuffer, t)
+	outBuffer := bytes.NewBuffer(nil)
+	input := stormenc.NewJsonObjectInput(inBuffer)
+	output := stormenc.NewJsonObjectOutput(outBuffer)
+	spoutConn := newSpoutConn(input, output, false)
+	stater := spoutConn.(stormcore.SpoutStater)
+
+	if stater.State() != stormcore.SpoutUninitialised {
+		t.Fatalf("Expected an uninitialised spout, got %v", stater.State())
+	}
+	expectSpoutState(t, stormcore.SpoutUninitialised, func() { spoutConn.Emit("1", "", "a") })
+	spoutConn.Connect()
+	if stater.State() != stormcore.SpoutAwaitingCommand {
+		t.Fatalf("Expected a spout awaiting a command, got %v", stater.State())
+	}
+	expectSpoutState(t, stormcore.SpoutAwaitingCommand, func() { spoutConn.Emit("1", "", "a") })
+
+	// A batch of tuples can be emitted for a single next
+	_, _, err := spoutConn.ReadSpoutMsg()
+	checkErr(err, t)
+	if stater.State() != stormcore.SpoutHandlingCommand {
+		t.Fatalf("Expected a spout handling a command, got %v", stater.State())
+	}
+	for i := 0; i < 3; i++ {
+		spoutConn.Emit(strconv.Itoa(i), "", "a")
+	}
+	spoutConn.SendSync()
+	// Emitting after the sync is out of sequence
+	expectSpoutState(t, stormcore.SpoutAwaitingCommand, func() { spoutConn.EmitDirect("4", "", 1, "a") })
+
+	_, _, err = spoutConn.ReadSpoutMsg()
+	checkErr(err, t)
+	spoutConn.SendSync()
+
+	if emits := strings.Count(outBuffer.String(), `"command":"emit"`); emits != 3 {
+		t.Fatalf("Expected 3 emissions, found %d in %s", emits, outBuffer.String())
+	}
+	if syncs := strings.Count(outBuffer.String(), `"command":"sync"`); syncs != 2 {
+		t.Fatalf("Expected 2 syncs, found %d in %s", syncs, outBuffer.String())
+	}
+
+	checkPidFile(t)
+}
+
+func TestSpoutTurns(t *testing.T) {
+	inBuffer := bytes.NewBuffer(nil)
+	feedConf(inBuffer, t)
+	writeMsg(newSpoutMsg("next", ""), inBuffer, t)
+	writeMsg(newSpoutMsg("ack", "1"), inBuffer, t)
+	writeMsg(newSpoutMsg("fail", "2"), inBuffer, t)
+	writeMsg(newSpoutMsg("next", ""), inBuffer, t)
+	outBuffer := bytes.NewBuffer(nil)
+	input := stormenc.NewJsonObjectInput(inBuffer)
+	output := stormenc.NewJsonObjectOutput(outBuffer)
+	spoutConn := newSpoutConn(input, output, false)
+	syncer, ok := spoutConn.(stormcore.CheckedSyncer)
+	if !ok {
+		t.Fatalf("Spout connection does not support checked syncs")
+	}
+	checked := spoutConn.(stormcore.CheckedEmitter)
+
+	expectStateErr := func(err error, state stormcore.SpoutState) {
+		stateErr, ok := err.(*stormcore.SpoutStateError)
+		if !ok || stateErr.State != state || stateErr.Expected != stormcore.SpoutHandlingCommand {
+			t.Fatalf("Expected a spout state error while %v, got %v", state, err)
+		}
+	}
+	read := func(expected string) {
+		command, _, err := spoutConn.ReadSpoutMsg()
+		checkErr(err, t)
+		if command != expected {
+			t.Fatalf("Received command %s, expected %s", command, expected)
+		}
+	}
+
+	expectStateErr(syncer.TrySendSync(), stormcore.SpoutUninitialised)
+	spoutConn.Connect()
+	expectPid(outBuffer, t)
+	expectStateErr(syncer.TrySendSync(), stormcore.SpoutAwaitingCommand)
+
+	// A next is answered with any number of tuples and a single sync
+	read(stormcore.CommandNext)
+	spoutConn.Emit("1", "", "a")
+	spoutConn.Emit("2", "", "b")
+	checkErr(syncer.TrySendSync(), t)
+	expectStateErr(syncer.TrySendSync(), stormcore.SpoutAwaitingCommand)
+	_, err := checked.TryEmit("3", "", "c")
+	expectStateErr(err, stormcore.SpoutAwaitingCommand)
+
+	// Tuples may be emitted while handling an ack or fail
+	read(stormcore.CommandAck)
+	checkErr(syncer.TrySendSync(), t)
+	read(stormcore.CommandFail)
+	spoutConn.Emit("2", "", "b")
+	checkErr(syncer.TrySendSync(), t)
+
+	read(stormcore.CommandNext)
+	checkErr(syncer.TrySendSync(), t)
+
+	for _, line := range []string{
+		`{"command":"emit","id":"1","need_task_ids":false,"tuple":["a"]}`,
+		`{"command":"emit","id":"2","need_task_ids":false,"tuple":["b"]}`,
+		`{"command":"sync"}`,
+		`{"command":"sync"}`,
+		`{"command":"emit","id":"2","need_task_ids":false,"tuple":["b"]}`,
+		`{"command":"sync"}`,
+		`{"command":"sync"}`,
+	} {
+		expect(line, outBuffer, t)
+		expect("end", outBuffer, t)
+	}
+	if outBuffer.Len() != 0 {
+		t.Fatalf("Unexpected output: %s", outBuffer.String())
+	}
+
+	checkPidFile(t)
+}
+
+func TestTryEmit(t *testing.T) {
+	inBuffer := bytes.NewBuffer(nil)
+	feedConf(inBuffer, t)
+	writeMsg(newSpoutMsg("next", ""), inBuffer, t)
+	outBuffer := bytes.NewBuffer(nil)
+	input := stormenc.NewJsonObjectInput(inBuffer)
+	output := stormenc.NewJsonObjectOutput(outBuffer)
+	spoutConn := newSpoutConn(input, output, false)
+	spoutConn.DeclareOutputFields("default", []string{"a"})
+	spoutConn.Connect()
+	expectPid(outBuffer, t)
+
+	var collector gostorm.SpoutOutputCollector = spoutConn
+	checked, ok := collector.(gostorm.CheckedSpoutOutputCollector)
+	if !ok {
+		t.Fatalf("Spout collector does not support checked emissions")
+	}
+
+	_, err := checked.TryEmit("1", "default", "a")
+	if stateErr, ok := err.(*stormcore.SpoutStateError); !ok || stateErr.State != stormcore.SpoutAwaitingCommand {
+		t.Fatalf("Expected a spout state error before reading a command, got %v", err)
+	}
+	if err := checked.TryEmitDirect("1", "default", 1, "a"); err == nil {
+		t.Fatalf("Expected an error for a direct emission before reading a command")
+	}
+
+	_, _, err = spoutConn.ReadSpoutMsg()
+	checkErr(err, t)
+	if _, err := checked.TryEmit(stormcore.TrackedIdPrefix+"1", "default", "a"); err == nil {
+		t.Fatalf("Expected an error for a reserved id")
+	}
+	if _, err := checked.TryEmit("1", "default", "a", "b"); err == nil {
+		t.Fatalf("Expected an error for a tuple with too many fields")
+	}
+	if outBuffer.Len() != 0 {
+		t.Fatalf("Rejected emissions were written: %s", outBuffer.String())
+	}
+
+	taskIds, err := checked.TryEmit("1", "default", "a")
+	checkErr(err, t)
+	if taskIds != nil {
+		t.Fatalf("Expected no task ids, got %v", taskIds)
+	}
+	checkErr(checked.TryEmitDirect("2", "default", 1, "a"), t)
+	output.Flush()
+	if emits := strings.Count(outBuffer.String(), `"command":"emit"`); emits != 2 {
+		t.Fatalf("Expected 2 emissions, found %d in %s", emits, outBuffer.String())
+	}
+
+	checkPidFile(t)
+}
+
+func TestEmitTracked(t *testing.T) {
+	inBuffer := bytes.NewBuffer(nil)
+	feedConf(inBuffer, t)
+	writeMsg(newSpoutMsg("next", ""), inBuffer, t)
+	input := stormenc.NewJsonObjectInput(inBuffer)
+	output := stormenc.NewJsonObjectOutput(bytes.NewBuffer(nil))
+	spoutConn := newSpoutConn(input, output, false)
+	spoutConn.Connect()
+	_, _, err := spoutConn.ReadSpoutMsg()
+	checkErr(err, t)
+
+	tracker, ok := spoutConn.(stormcore.TrackedEmitter)
+	if !ok {
+		t.Fatalf("Spout connection does not support tracked emissions")
+	}
+	// The collector passed to a spout exposes tracked emissions through
+	// an optional interface
+	var collector gostorm.SpoutOutputCollector = spoutConn
+	if _, ok := collector.(gostorm.TrackedSpoutOutputCollector); !ok {
+		t.Fatalf("Spout collector does not support tracked emissions")
+	}
+
+	var acked, failed int
+	onAck := func() { acked++ }
+	onFail := func() { failed++ }
+	ackId := tracker.EmitTracked("default", onAck, onFail, "a")
+	failId := tracker.EmitTracked("default", onAck, onFail, "b")
+	if ackId == failId {
+		t.Fatalf("Tracked emissions share id %s", ackId)
+	}
+	if !strings.HasPrefix(ackId, stormcore.TrackedIdPrefix) {
+		t.Fatalf("Tracked id %s does not start with %s", ackId, stormcore.TrackedIdPrefix)
+	}
+	// User ids cannot clash with tracked ids
+	expectPanic(t, func() { spoutConn.Emit(ackId, "default", "c") })
+	expectPanic(t, func() { spoutConn.EmitDirect(failId, "default", 1, "c") })
+
+	if tracker.Dispatch(stormcore.CommandAck, "untracked") {
+		t.Fatalf("Untracked id was dispatched")
+	}
+	if !tracker.Dispatch(stormcore.CommandAck, ackId) {
+		t.Fatalf("Tracked id %s was not dispatched", ackId)
+	}
+	if !tracker.Dispatch(stormcore.CommandFail, failId) {
+		t.Fatalf("Tracked id %s was not dispatched", failId)
+	}
+	if acked != 1 || failed != 1 {
+		t.Fatalf("Expected one ack and one fail callback, got %d and %d", acked, failed)
+	}
+	if tracker.Dispatch(stormcore.CommandAck, ackId) {
+		t.Fatalf("Tracked id %s was dispatched twice", ackId)
+	}
+
+	checkPidFile(t)
+}
+
+func TestPidFileContents(t *testing.T) {
+	pidDir, err := ioutil.TempDir("", "gostorm")
+	checkErr(err, t)
+	defer os.RemoveAll(pidDir)
+
+	inBuffer := bytes.NewBuffer(nil)
+	feedConf(inBuffer, t)
+	input := stormenc.NewJsonObjectInput(inBuffer)
+	output := stormenc.NewJsonObjectOutput(bytes.NewBuffer(nil))
+	spoutConn := newSpoutConn(input, output, false)
+	spoutConn.SetPid(12345)
+	spoutConn.SetPidDir(pidDir)
+	spoutConn.SetPidFileContents(true)
+	spoutConn.Connect()
+
+	contents, err := ioutil.ReadFile(filepath.Join(pidDir, "12345"))
+	checkErr(err, t)
+	if string(contents) != "12345" {
+		t.Fatalf("Expected the pid file to contain the pid, received: %q", contents)
+	}
+	checkErr(spoutConn.Close(), t)
+}
+
+// syncBuffer is a buffer that may be written to and read from
+// concurrently
+type syncBuffer struct {
+	sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (this *syncBuffer) Write(p []byte) (int, error) {
+	this.Lock()
+	defer this.Unlock()
+	return this.buffer.Write(p)
+}
+
+func (this *syncBuffer) String() string {
+	this.Lock()
+	defer this.Unlock()
+	return this.buffer.String()
+}
+
+type blockingSpout struct {
+	countingSpout
+	block time.Duration
+}
+
+func (this *blockingSpout) NextTuple() {
+	time.Sleep(this.block)
+}
+
+func TestUnresponsiveThreshold(t *testing.T) {
+	logBuffer := &syncBuffer{}
+	defaultLogger := stormcore.Logger()
+	stormcore.SetLogger(log.New(logBuffer, "", 0))
+	defer stormcore.SetLogger(defaultLogger)
+
+	inBuffer := bytes.NewBuffer(nil)
+	feedConf(inBuffer, t)
+	writeMsg(newSpoutMsg("next", ""), inBuffer, t)
+	writeMsg(newSpoutMsg("ack", "1"), inBuffer, t)
+	input := stormenc.NewJsonObjectInput(inBuffer)
+	output := stormenc.NewJsonObjectOutput(bytes.NewBuffer(nil))
+	spoutConn := newSpoutConn(input, output, false)
+
+	spout := &blockingSpout{block: 50 * time.Millisecond}
+	shellSpout := gostorm.NewShellSpout(spout)
+	shellSpout.SetUnresponsiveThreshold(10 * time.Millisecond)
+	shellSpout.Initialise(spoutConn)
+	shellSpout.Go()
+
+	logged := logBuffer.String()
+	if strings.Count(logged, "ShellSpout:") != 1 || !strings.Contains(logged, "next command not handled") {
+		t.Fatalf("Expected a single warning for the blocking next command, received: %q", logged)
+	}
+
+	checkPidFile(t)
+}
+
+type contextSpout struct {
+	countingSpout
+	deadlines []time.Time
+	contexts  []context.Context
+}
+
+func (this *contextSpout) NextTupleContext(ctx context.Context) {
+	deadline, _ := ctx.Deadline()
+	this.deadlines = append(this.deadlines, deadline)
+	this.contexts = append(this.contexts, ctx)
+}
+
+func TestContextSpout(t *testing.T) {
+	inBuffer := bytes.NewBuffer(nil)
+	feedConf(inBuffer, t)
+	writeMsg(newSpoutMsg("next", ""), inBuffer, t)
+	writeMsg(newSpoutMsg("next", ""), inBuffer, t)
+	input := stormenc.NewJsonObjectInput(inBuffer)
+	output := stormenc.NewJsonObjectOutput(bytes.NewBuffer(nil))
+	spoutConn := newSpoutConn(input, output, false)
+
+	spout := &contextSpout{}
+	shellSpout := gostorm.NewShellSpout(spout)
+	shellSpout.Initialise(spoutConn)
+	start := time.Now()
+	shellSpout.Go()
+
+	if len(spout.deadlines) != 2 {
+		t.Fatalf("Expected NextTupleContext to be called twice, got %d calls", len(spout.deadlines))
+	}
+	// The configuration sets topology.message.timeout.secs to 30
+	for _, deadline := range spout.deadlines {
+		if deadline.Before(start.Add(30*time.Second)) || deadline.After(time.Now().Add(30*time.Second)) {
+			t.Fatalf("Unexpected deadline %v for a next received at %v", deadline, start)
+		}
+	}
+	for _, ctx := range spout.contexts {
+		if ctx.Err() != context.Canceled {
+			t.Fatalf("Expected the context to be cancelled after NextTupleContext returned, got %v", ctx.Err())
+		}
+	}
+
+	checkPidFile(t)
+}
+
+func TestHooks(t *testing.T) {
+	var events []string
+	hooks := stormcore.Hooks{
+		OnRead: func(meta *messages.BoltMsgMeta) {
+			events = append(events, "read "+meta.Id)
+		},
+		OnEmit: func(stream string, n int) {
+			events = append(events, fmt.Sprintf("emit %s %d", stream, n))
+		},
+		OnAck: func(id string) {
+			events = append(events, "ack "+id)
+		},
+		OnFail: func(id string) {
+			events = append(events, "fail "+id)
+		},
+		OnError: func(err error) {
+			events = append(events, "error")
+		},
+	}
+
+	inBuffer := bytes.NewBuffer(nil)
+	feedConf(inBuffer, t)
+	writeMsg(testBoltMsg(0), inBuffer, t)
+	writeMsg(testBoltMsg(1), inBuffer, t)
+	inBuffer.WriteString("{\"invalid\nend\n")
+	input := stormenc.NewJsonObjectInput(inBuffer)
+	output := stormenc.NewJsonObjectOutput(bytes.NewBuffer(nil))
+	boltConn := newBoltConn(input, output, false)
+	boltConn.SetHooks(hooks)
+	boltConn.Connect()
+
+	var msg string
+	meta := &messages.BoltMsgMeta{}
+	checkErr(boltConn.ReadBoltMsg(meta, &msg), t)
+	boltConn.Emit([]string{meta.Id}, "", msg)
+	boltConn.SendAck(meta.Id)
+	checkErr(boltConn.ReadBoltMsg(meta, &msg), t)
+	boltConn.SendFail(meta.Id)
+	if err := boltConn.ReadBoltMsg(meta, &msg); err == nil {
+		t.Fatal("Expected an error when reading invalid JSON")
+	}
+	if err := boltConn.ReadBoltMsg(meta, &msg); err != io.EOF {
+		t.Fatalf("Expected EOF, received: %v", err)
+	}
+
+	expected := []string{
+		"read " + ids[0], "emit default 1", "ack " + ids[0],
+		"read " + ids[1], "fail " + ids[1],
+		"error",
+	}
+	if strings.Join(events, ",") != strings.Join(expected, ",") {
+		t.Fatalf("Unexpected bolt hook events: %v", events)
+	}
+
+	// Spouts call every hook but OnRead, since they do not read tuples
+	events = nil
+	inBuffer = bytes.NewBuffer(nil)
+	feedConf(inBuffer, t)
+	writeMsg(newSpoutMsg("next", ""), inBuffer, t)
+	writeMsg(newSpoutMsg("ack", "1"), inBuffer, t)
+	writeMsg(newSpoutMsg("fail", "2"), inBuffer, t)
+	inBuffer.WriteString("{\"invalid\nend\n")
+	input = stormenc.NewJsonObjectInput(inBuffer)
+	spoutOutput := stormenc.NewJsonObjectOutput(bytes.NewBuffer(nil))
+	spoutConn := newSpoutConn(input, spoutOutput, false)
+	spoutConn.SetHooks(hooks)
+	spoutConn.Connect()
+
+	for i := 0; i < 3; i++ {
+		_, _, err := spoutConn.ReadSpoutMsg()
+		checkErr(err, t)
+		if i == 0 {
+			spoutConn.Emit("1", "other", "Msg")
+		}
+		spoutConn.SendSync()
+	}
+	if _, _, err := spoutConn.ReadSpoutMsg(); err == nil {
+		t.Fatal("Expected an error when reading invalid JSON")
+	}
+
+	expected = []string{"emit other 1", "ack 1", "fail 2", "error"}
+	if strings.Join(events, ",") != strings.Join(expected, ",") {
+		t.Fatalf("Unexpected spout hook events: %v", events)
+	}
+
+	// Unset hooks are not called
+	events = nil
+	inBuffer = bytes.NewBuffer(nil)
+	feedConf(inBuffer, t)
+	writeMsg(testBoltMsg(0), inBuffer, t)
+	input = stormenc.NewJsonObjectInput(inBuffer)
+	boltConn = newBoltConn(input, stormenc.NewJsonObjectOutput(bytes.NewBuffer(nil)), false)
+	boltConn.SetHooks(stormcore.Hooks{OnAck: hooks.OnAck})
+	boltConn.Connect()
+	checkErr(boltConn.ReadBoltMsg(meta, &msg), t)
+	boltConn.Emit([]string{meta.Id}, "", msg)
+	boltConn.SendFail(meta.Id)
+	if err := boltConn.ReadBoltMsg(meta, &msg); err != io.EOF {
+		t.Fatalf("Expected EOF, received: %v", err)
+	}
+	if len(events) != 0 {
+		t.Fatalf("Unexpected events for unset hooks: %v", events)
+	}
+
+	checkPidFile(t)
+}
+
+// splitTrace splits a trace into the frames that were read from and
+// sent to Storm
+func splitTrace(trace []byte, t *testing.T) (in, out []byte) {
+	reader := bufio.NewReader(bytes.NewReader(trace))
+	for {
+		header, err := reader.ReadString('\n')
+		if err == io.EOF {
+			return in, out
+		}
+		checkErr(err, t)
+		parts := strings.Fields(header)
+		if len(parts) != 3 {
+			t.Fatalf("Invalid trace header: %q", header)
+		}
+		if _, err := time.Parse(time.RFC3339Nano, parts[0]); err != nil {
+			t.Fatalf("Invalid trace timestamp: %q", header)
+		}
+		length, err := strconv.Atoi(parts[2])
+		checkErr(err, t)
+		frame := make([]byte, length)
+		_, err = io.ReadFull(reader, frame)
+		checkErr(err, t)
+		switch parts[1] {
+		case stormcore.TraceIn:
+			in = append(in, frame...)
+		case stormcore.TraceOut:
+			out = append(out, frame...)
+		default:
+			t.Fatalf("Invalid trace direction: %q", header)
+		}
+	}
+}
+
+func TestTrace(t *testing.T) {
+	inBuffer := bytes.NewBuffer(nil)
+	feedConf(inBuffer, t)
+	writeMsg(testBoltMsg(0), inBuffer, t)
+	sent := append([]byte(nil), inBuffer.Bytes()...)
+	outBuffer := bytes.NewBuffer(nil)
+	input := stormenc.NewJsonObjectInput(inBuffer)
+	output := stormenc.NewJsonObjectOutput(outBuffer)
+	boltConn := newBoltConn(input, output, false)
+	trace := bytes.NewBuffer(nil)
+	boltConn.SetTrace(trace)
+	boltConn.Connect()
+
+	var msg string
+	meta := &messages.BoltMsgMeta{}
+	checkErr(boltConn.ReadBoltMsg(meta, &msg), t)
+	boltConn.Emit([]string{meta.Id}, "", msg)
+	boltConn.SendAck(meta.Id)
+	output.Flush()
+
+	in, out := splitTrace(trace.Bytes(), t)
+	if !bytes.Equal(in, sent) {
+		t.Fatalf("Traced input does not match the input:\n%s", in)
+	}
+	if !bytes.Equal(out, outBuffer.Bytes()) {
+		t.Fatalf("Traced output does not match the output:\n%s", out)
+	}
+
+	replayed, err := ioutil.ReadAll(stormcore.NewReplayReader(trace))
+	checkErr(err, t)
+	if !bytes.Equal(replayed, sent) {
+		t.Fatalf("Replayed trace does not match the input:\n%s", replayed)
+	}
+
+	checkPidFile(t)
+}
+
+func TestTestMode(t *testing.T) {
+	// The fixture contains no task ids, which would make Emit block or
+	// misread the next tuple
+	inBuffer := bytes.NewBuffer(nil)
+	feedConf(inBuffer, t)
+	writeMsg(testBoltMsg(0), inBuffer, t)
+	writeMsg(testBoltMsg(1), inBuffer, t)
+	input := stormenc.NewJsonObjectInput(inBuffer)
+	outBuffer := bytes.NewBuffer(nil)
+	output := stormenc.NewJsonObjectOutput(outBuffer)
+	boltConn := newBoltConn(input, output, true)
+	boltConn.SetTestMode([]int32{7})
+	boltConn.Connect()
+
+	var msg string
+	meta := &messages.BoltMsgMeta{}
+	for i := 0; i < 2; i++ {
+		checkErr(boltConn.ReadBoltMsg(meta, &msg), t)
+		metaTest(meta, i, t)
+		taskIds := boltConn.Emit([]string{meta.Id}, "", msg)
+		if len(taskIds) != 1 || taskIds[0] != 7 {
+			t.Fatalf("Unexpected task ids in test mode: %v", taskIds)
+		}
+		if taskIds := <-boltConn.EmitAsync([]string{meta.Id}, "", msg); len(taskIds) != 1 {
+			t.Fatalf("Unexpected asynchronous task ids in test mode: %v", taskIds)
+		}
+		boltConn.SendAck(meta.Id)
+	}
+	if err := boltConn.ReadBoltMsg(meta, &msg); err != io.EOF {
+		t.Fatalf("Expected EOF, received: %v", err)
+	}
+	// need_task_ids is omitted when it is true, which is the multilang
+	// default
+	if strings.Contains(outBuffer.String(), `"need_task_ids":false`) {
+		t.Fatalf("Expected emissions to request task ids: %s", outBuffer.String())
+	}
+
+	checkPidFile(t)
+}
+
+type splitBolt struct {
+	collector gostorm.OutputCollector
+	name      string
+}
+
+func (this *splitBolt) Fields() []interface{} {
+	var sentence string
+	return []interface{}{&sentence}
+}
+
+func (this *splitBolt) Prepare(context *messages.Context, collector gostorm.OutputCollector) {
+	this.collector = collector
+	this.name, _ = context.ConfString("topology.name")
+}
+
+func (this *splitBolt) Execute(meta messages.BoltMsgMeta, fields ...interface{}) {
+	for _, word := range strings.Fields(*fields[0].(*string)) {
+		this.collector.Emit([]string{meta.Id}, "", word)
+	}
+	this.collector.SendAck(meta.Id)
+}
+
+func (this *splitBolt) Cleanup() {}
+
+func TestFixture(t *testing.T) {
+	// The fixture starts with the handshake, which Initialise reads
+	// before the tuples
+	fixture, err := os.Open(filepath.Join("testdata", "bolt.fixture"))
+	checkErr(err, t)
+	defer fixture.Close()
+	pidDir, err := ioutil.TempDir("", "gostorm")
+	checkErr(err, t)
+	defer os.RemoveAll(pidDir)
+
+	outBuffer := bytes.NewBuffer(nil)
+	input := stormenc.NewJsonObjectInput(fixture)
+	output := stormenc.NewJsonObjectOutput(outBuffer)
+	boltConn := newBoltConn(input, output, true)
+	boltConn.SetTestMode([]int32{2})
+	boltConn.SetPidDir(pidDir)
+
+	bolt := &splitBolt{}
+	shellBolt := gostorm.NewShellBolt(bolt)
+	shellBolt.Initialise(boltConn)
+	if bolt.name != "fixture" {
+		t.Fatalf("Configuration not read from the fixture: %q", bolt.name)
+	}
+	if _, err := os.Stat(filepath.Join(pidDir, strconv.Itoa(os.Getpid()))); err != nil {
+		t.Fatalf("Pid file not created: %v", err)
+	}
+	shellBolt.Go()
+	boltConn.Close()
+
+	expectPid(outBuffer, t)
+	for id, sentence := range []string{"the cow jumped over the moon", "an apple a day keeps the doctor away"} {
+		for _, word := range strings.Fields(sentence) {
+			expect(fmt.Sprintf(`{"anchors":["%d"],"command":"emit","tuple":["%s"]}`, id+1, word), outBuffer, t)
+			expect("end", outBuffer, t)
+		}
+		expect(fmt.Sprintf(`{"command":"ack","id":"%d"}`, id+1), outBuffer, t)
+		expect("end", outBuffer, t)
+	}
+}
+
+func TestFixtures(t *testing.T) {
+	// Only the first fixture holds the handshake
+	fixtures, err := stormcore.OpenFixtures(filepath.Join("testdata", "bolt.fixture"), filepath.Join("testdata", "bolt2.fixture"))
+	checkErr(err, t)
+	defer fixtures.Close()
+	pidDir, err := ioutil.TempDir("", "gostorm")
+	checkErr(err, t)
+	defer os.RemoveAll(pidDir)
+
+	outBuffer := bytes.NewBuffer(nil)
+	input := stormenc.NewJsonObjectInput(fixtures)
+	output := stormenc.NewJsonObjectOutput(outBuffer)
+	boltConn := newBoltConn(input, output, false)
+	boltConn.SetPidDir(pidDir)
+
+	bolt := &completingBolt{output: outBuffer}
+	shellBolt := gostorm.NewShellBolt(bolt)
+	shellBolt.Initialise(boltConn)
+	shellBolt.Go()
+	boltConn.Close()
+
+	// The input only ended after the last fixture
+	for id := 1; id <= 3; id++ {
+		if !strings.Contains(bolt.completed, fmt.Sprintf(`{"command":"ack","id":"%d"}`, id)) {
+			t.Fatalf("Tuple %d not acked before the input ended: %s", id, bolt.completed)
+		}
+	}
+
+	if _, err := stormcore.OpenFixtures(filepath.Join("testdata", "missing.fixture")); err == nil {
+		t.Fatalf("Expected an error for a missing fixture")
+	}
+}
+
+// completingBolt acks every tuple and records the output that was
+// written by the time OnComplete is called
+type completingBolt struct {
+	splitBolt
+	output    *bytes.Buffer
+	completed string
+	cleaned   bool
+}
+
+func (this *completingBolt) OnComplete() {
+	if this.cleaned {
+		panic("OnComplete called after Cleanup")
+	}
+	this.completed = this.output.String()
+}
+
+func (this *completingBolt) Cleanup() {
+	this.cleaned = true
+}
+
+func TestOnComplete(t *testing.T) {
+	fixture, err := os.Open(filepath.Join("testdata", "bolt.fixture"))
+	checkErr(err, t)
+	defer fixture.Close()
+
+	outBuffer := bytes.NewBuffer(nil)
+	input := stormenc.NewJsonObjectInput(fixture)
+	output := stormenc.NewJsonObjectOutput(outBuffer)
+	boltConn := newBoltConn(input, output, false)
+
+	bolt := &completingBolt{output: outBuffer}
+	shellBolt := gostorm.NewShellBolt(bolt)
+	shellBolt.Initialise(boltConn)
+	shellBolt.Go()
+	boltConn.Close()
+
+	// The ack of the last tuple is written before OnComplete is called
+	if !strings.HasSuffix(bolt.completed, `{"command":"ack","id":"2"}`+"\nend\n") {
+		t.Fatalf("Last tuple not acked before OnComplete: %s", bolt.completed)
+	}
+	if !bolt.cleaned {
+		t.Fatalf("Bolt not cleaned up after OnComplete")
+	}
+}
+
+func TestTupleGet(t *testing.T) {
+	first, second := "first", "second"
+	tuple := &stormcore.Tuple{
+		Fields: []interface{}{&first, &second},
+	}
+	// Without declared names, no field can be accessed by name
+	if tuple.Get("a") != nil {
+		t.Fatalf("Expected no field without declared names")
+	}
+
+	// Fields beyond the last name can only be accessed by index
+	tuple.Names = []string{"a"}
+	if tuple.Get("a") != &first || tuple.Get("b") != nil {
+		t.Fatalf("Unexpected fields for names %v", tuple.Names)
+	}
+
+	// Names beyond the last field have no field
+	tuple.Names = []string{"a", "b", "c"}
+	if tuple.Get("b") != &second || tuple.Get("c") != nil || tuple.Get("unknown") != nil {
+		t.Fatalf("Unexpected fields for names %v", tuple.Names)
+	}
+}
+
+func TestTupleAccessors(t *testing.T) {
+	var decoded interface{} = float64(42)
+	var nilField interface{}
+	text, flag := "text", true
+	tuple := &stormcore.Tuple{
+		Fields: []interface{}{&text, &decoded, 1.5, []byte("bytes"), &flag, json.Number("7"), &nilField, uint64(math.MaxUint64)},
+	}
+
+	if s, err := tuple.String(0); err != nil || s != "text" {
+		t.Fatalf("Unexpected string field: %q, %v", s, err)
+	}
+	if s, err := tuple.String(3); err != nil || s != "bytes" {
+		t.Fatalf("Unexpected byte slice field: %q, %v", s, err)
+	}
+	// JSON numbers are decoded into float64s
+	if n, err := tuple.Int64(1); err != nil || n != 42 {
+		t.Fatalf("Unexpected int64 field: %d, %v", n, err)
+	}
+	if n, err := tuple.Int64(5); err != nil || n != 7 {
+		t.Fatalf("Unexpected json.Number field: %d, %v", n, err)
+	}
+	if f, err := tuple.Float64(2); err != nil || f != 1.5 {
+		t.Fatalf("Unexpected float64 field: %v, %v", f, err)
+	}
+	if f, err := tuple.Float64(1); err != nil || f != 42 {
+		t.Fatalf("Unexpected float64 field: %v, %v", f, err)
+	}
+	if b, err := tuple.Bool(4); err != nil || !b {
+		t.Fatalf("Unexpected bool field: %v, %v", b, err)
+	}
+
+	failures := []struct {
+		name string
+		read func() error
+	}{
+		{"negative index", func() error { _, err := tuple.String(-1); return err }},
+		{"index beyond the last field", func() error { _, err := tuple.Bool(8); return err }},
+		{"string as int64", func() error { _, err := tuple.Int64(0); return err }},
+		{"fraction as int64", func() error { _, err := tuple.Int64(2); return err }},
+		{"overflowing uint64 as int64", func() error { _, err := tuple.Int64(7); return err }},
+		{"number as string", func() error { _, err := tuple.String(1); return err }},
+		{"number as bool", func() error { _, err := tuple.Bool(1); return err }},
+		{"string as float64", func() error { _, err := tuple.Float64(0); return err }},
+		{"nil field", func() error { _, err := tuple.String(6); return err }},
+	}
+	for _, failure := range failures {
+		if failure.read() == nil {
+			t.Fatalf("Expected an error for %s", failure.name)
+		}
+	}
+}
+
+func TestTupleObject(t *testing.T) {
+	type object struct {
+		Name  string `json:"name"`
+		Count int64  `json:"count"`
+	}
+	var decoded interface{} = map[string]interface{}{"name": "a", "count": float64(3)}
+	raw := json.RawMessage(`{"name":"b","count":9007199254740993}`)
+	text := "text"
+	tuple := &stormcore.Tuple{
+		Fields: []interface{}{&decoded, &raw, &text},
+	}
+
+	var obj object
+	checkErr(tuple.Object(0, &obj), t)
+	if obj != (object{Name: "a", Count: 3}) {
+		t.Fatalf("Unexpected object decoded from a map: %+v", obj)
+	}
+	// Raw fields are decoded without the precision loss of float64
+	checkErr(tuple.Object(1, &obj), t)
+	if obj != (object{Name: "b", Count: 9007199254740993}) {
+		t.Fatalf("Unexpected object decoded from a raw field: %+v", obj)
+	}
+	if err := tuple.Object(2, &obj); err == nil {
+		t.Fatalf("Expected an error when decoding a string into a struct")
+	}
+	if err := tuple.Object(3, &obj); err == nil {
+		t.Fatalf("Expected an error for a field that is out of range")
+	}
+}
+
+func TestTupleBytes(t *testing.T) {
+	blob := []byte{0, 1, 0xfe, 0xff, '<'}
+	encoded := stormcore.EncodeBytes(blob)
+	if encoded != "AAH+/zw=" {
+		t.Fatalf("Unexpected encoding %s, expected standard base64 with padding", encoded)
+	}
+
+	// Emitting the []byte itself produces the same field
+	outBuffer := bytes.NewBuffer(nil)
+	output := stormenc.NewJsonObjectOutput(outBuffer)
+	output.EmitGeneric("emit", "", "", "", nil, 0, true, blob, encoded)
+	output.Flush()
+	expect(`{"command":"emit","tuple":["AAH+/zw=","AAH+/zw="]}`, outBuffer, t)
+
+	var decoded []byte
+	invalid := "not base64!"
+	tuple := &stormcore.Tuple{Fields: []interface{}{&encoded, &decoded, &invalid, 1.5}}
+	checkErr(json.Unmarshal([]byte(`"AAH+/zw="`), &decoded), t)
+	for i := 0; i < 2; i++ {
+		data, err := tuple.Bytes(i)
+		checkErr(err, t)
+		if !bytes.Equal(data, blob) {
+			t.Fatalf("Field %d decoded to %v, expected %v", i, data, blob)
+		}
+	}
+	for i := 2; i < 5; i++ {
+		if _, err := tuple.Bytes(i); err == nil {
+			t.Fatalf("Expected an error for field %d", i)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	inBuffer := bytes.NewBuffer(nil)
+	feedConf(inBuffer, t)
+	outBuffer := &syncBuffer{}
+	input := stormenc.NewJsonObjectInput(inBuffer)
+	output := stormenc.NewJsonObjectOutput(outBuffer)
+	boltConn := newBoltConn(input, output, false)
+	boltConn.Connect()
+
+	reporter := boltConn.(stormcore.MetricsReporter)
+	checkErr(reporter.ReportMetric("single", map[string]int{"a": 1}), t)
+
+	count := &stormcore.CountMetric{}
+	count.IncrBy(2)
+	reporter.RegisterMetric("count", count)
+	reporter.RegisterMetric("gauge", stormcore.MetricFunc(func() interface{} { return "full" }))
+	stop := reporter.StartMetrics(time.Millisecond)
+	// Emissions made while metrics are reported are never interleaved
+	// with them
+	for i := 0; i < 200; i++ {
+		boltConn.Emit(nil, "", "Msg")
+		count.Incr()
+	}
+	time.Sleep(10 * time.Millisecond)
+	stop()
+	checkErr(boltConn.Close(), t)
+
+	frames := strings.Split(strings.TrimSuffix(outBuffer.String(), "end\n"), "\nend\n")
+	var emitted int
+	var counted float64
+	var reports []string
+	for _, frame := range frames[1:] {
+		var msg map[string]interface{}
+		checkErr(json.Unmarshal([]byte(frame), &msg), t)
+		switch msg["command"] {
+		case "emit":
+			emitted++
+		case "metrics":
+			name := msg["name"].(string)
+			if len(reports) == 0 || reports[len(reports)-1] != name {
+				reports = append(reports, name)
+			}
+			if name == "count" {
+				counted += msg["params"].(float64)
+			}
+		default:
+			t.Fatalf("Unexpected message: %s", frame)
+		}
+	}
+	if emitted != 200 {
+		t.Fatalf("Expected 200 emissions, found %d", emitted)
+	}
+	if len(reports) < 3 || reports[0] != "single" || reports[1] != "count" || reports[2] != "gauge" {
+		t.Fatalf("Unexpected metric reports: %v", reports)
+	}
+	// Counts are reset when they are reported, so the reports add up to
+	// the total, except for increments after the last report
+	if counted > 202 || counted < 2 {
+		t.Fatalf("Unexpected total count: %v", counted)
+	}
+
+	// Encodings that cannot send metrics return an error
+	unsupported := newBoltConn(input, stormproto.NewProtobufOutput(bytes.NewBuffer(nil)), false)
+	if err := unsupported.(stormcore.MetricsReporter).ReportMetric("single", 1); err == nil {
+		t.Fatalf("Expected an error for an output that does not support metrics")
+	}
+}
+
+func TestStatsMetric(t *testing.T) {
+	inBuffer := bytes.NewBuffer(nil)
+	feedConf(inBuffer, t)
+	outBuffer := bytes.NewBuffer(nil)
+	input := stormenc.NewJsonObjectInput(inBuffer)
+	output := stormenc.NewJsonObjectOutput(outBuffer)
+	boltConn := newBoltConn(input, output, false)
+	boltConn.Connect()
+
+	boltConn.Emit(nil, "", "Msg")
+	metric := stormcore.NewStatsMetric(boltConn)
+	boltConn.Emit(nil, "", "Msg")
+	boltConn.Emit(nil, "other", "Msg")
+	boltConn.SendAck("1")
+	boltConn.SendFail("2")
+
+	// Counts before the metric was created are not reported
+	value := metric.ValueAndReset().(map[string]uint64)
+	expected := map[string]uint64{"acked": 1, "failed": 1, "read": 0, "emitted.default": 1, "emitted.other": 1}
+	if !reflect.DeepEqual(value, expected) {
+		t.Fatalf("Expected %v, received %v", expected, value)
+	}
+
+	// Every report starts a new interval, while Stats keeps counting
+	boltConn.SendAck("3")
+	value = metric.ValueAndReset().(map[string]uint64)
+	expected = map[string]uint64{"acked": 1, "failed": 0, "read": 0, "emitted.default": 0, "emitted.other": 0}
+	if !reflect.DeepEqual(value, expected) {
+		t.Fatalf("Expected %v, received %v", expected, value)
+	}
+	if stats := boltConn.Stats(); stats.Acked != 2 || stats.EmittedByStream["default"] != 2 {
+		t.Fatalf("Unexpected stats: %+v", stats)
+	}
+}
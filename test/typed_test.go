@@ -0,0 +1,104 @@
+//go:build go1.18
+// +build go1.18
+
+//   Copyright 2013 Vastech SA (PTY) LTD
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	stormcore "github.com/jsgilmore/gostorm/core"
+	stormenc "github.com/jsgilmore/gostorm/encodings/json"
+	"reflect"
+	"testing"
+)
+
+// testReading is a typed record that is emitted and decoded with the
+// generic helpers
+type testReading struct {
+	Sensor   string
+	Value    float64
+	Count    int
+	Tags     []string
+	Location testLocation
+	Note     string `storm:"-"`
+}
+
+func TestTypedTuples(t *testing.T) {
+	inBuffer := bytes.NewBuffer(nil)
+	feedConf(inBuffer, t)
+	outBuffer := bytes.NewBuffer(nil)
+	input := stormenc.NewJsonObjectInput(inBuffer)
+	output := stormenc.NewJsonObjectOutput(outBuffer)
+	boltConn := newBoltConn(input, output, false)
+	boltConn.Connect()
+	expectPid(outBuffer, t)
+
+	reading := testReading{
+		Sensor:   "s1",
+		Value:    21.5,
+		Count:    3,
+		Tags:     []string{"a", "b"},
+		Location: testLocation{Lat: 1.5, Lon: -2},
+		Note:     "not emitted",
+	}
+	_, err := stormcore.EmitTyped(boltConn, reading, []string{"1"}, "")
+	checkErr(err, t)
+	line, err := outBuffer.ReadString('\n')
+	checkErr(err, t)
+	expected := `{"anchors":["1"],"command":"emit","need_task_ids":false,"tuple":["s1",21.5,3,["a","b"],{"Lat":1.5,"Lon":-2}]}` + "\n"
+	if line != expected {
+		t.Fatalf("Expected: %s, received: %s", expected, line)
+	}
+	expect("end", outBuffer, t)
+
+	// The receiving bolt decodes the fields into interface{}s
+	emission := struct{ Tuple []interface{} }{}
+	checkErr(json.Unmarshal([]byte(line), &emission), t)
+	tuple := &stormcore.Tuple{Fields: emission.Tuple}
+	decoded, err := stormcore.DecodeTuple[testReading](tuple)
+	checkErr(err, t)
+	reading.Note = ""
+	if !reflect.DeepEqual(decoded, reading) {
+		t.Fatalf("Decoded %+v, expected %+v", decoded, reading)
+	}
+
+	// Fields of the right type are assigned and nil fields are skipped
+	name := "s2"
+	decoded, err = stormcore.DecodeTuple[testReading](&stormcore.Tuple{Fields: []interface{}{&name, nil, 4, nil, nil}})
+	checkErr(err, t)
+	if !reflect.DeepEqual(decoded, testReading{Sensor: "s2", Count: 4}) {
+		t.Fatalf("Unexpected decoded reading: %+v", decoded)
+	}
+
+	if _, err := stormcore.EmitTyped(boltConn, "reading", nil, ""); err == nil {
+		t.Fatalf("Expected an error for emitting a string")
+	}
+	if _, err := stormcore.DecodeTuple[string](tuple); err == nil {
+		t.Fatalf("Expected an error for decoding into a string")
+	}
+	if _, err := stormcore.DecodeTuple[testReading](&stormcore.Tuple{Fields: emission.Tuple[:2]}); err == nil {
+		t.Fatalf("Expected an error for a tuple with too few fields")
+	}
+	if _, err := stormcore.DecodeTuple[testReading](&stormcore.Tuple{Fields: []interface{}{1, "a", 3, nil, nil}}); err == nil {
+		t.Fatalf("Expected an error for fields of the wrong type")
+	}
+	if outBuffer.Len() != 0 {
+		t.Fatalf("Unexpected output: %s", outBuffer.String())
+	}
+
+	checkPidFile(t)
+}
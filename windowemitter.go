@@ -0,0 +1,52 @@
+//   Copyright 2013 Vastech SA (PTY) LTD
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package gostorm
+
+import (
+	"github.com/jsgilmore/gostorm/core"
+)
+
+// WindowEmitter emits tuples that are anchored to a window of the most
+// recent input tuples, as is common in windowed and streaming join
+// bolts. Tuples are added to the window with Add, which returns the id
+// of the tuple that was evicted from a full window, so that the bolt can
+// ack it: Storm ignores anchors to tuples that have already been acked,
+// so the tuples in the window should not be acked before they are
+// evicted. The size of the window can be changed with SetSize.
+type WindowEmitter struct {
+	*core.AnchorWindow
+	collector OutputCollector
+}
+
+// NewWindowEmitter returns an emitter that emits with the given
+// collector, anchored to the ids of the last size tuples added to it.
+// The size has to be at least one.
+func NewWindowEmitter(collector OutputCollector, size int) (*WindowEmitter, error) {
+	window, err := core.NewAnchorWindow(size)
+	if err != nil {
+		return nil, err
+	}
+	return &WindowEmitter{
+		AnchorWindow: window,
+		collector:    collector,
+	}, nil
+}
+
+// EmitAnchoredToWindow emits a tuple on the given stream, anchored to
+// every tuple in the current window. An empty window emits an unanchored
+// tuple, even if auto anchoring is enabled.
+func (this *WindowEmitter) EmitAnchoredToWindow(stream string, fields ...interface{}) (taskIds []int32) {
+	return this.collector.Emit(this.Ids(), stream, fields...)
+}